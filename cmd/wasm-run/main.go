@@ -9,9 +9,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 
 	"github.com/Ankr-network/wagon/exec"
+	"github.com/Ankr-network/wagon/exec/gas"
 	"github.com/Ankr-network/wagon/validate"
 	"github.com/Ankr-network/wagon/wasm"
 )
@@ -22,6 +24,7 @@ func main() {
 
 	verbose := flag.Bool("v", false, "enable/disable verbose mode")
 	verify := flag.Bool("verify-module", false, "run module verification")
+	gasLimit := flag.Uint64("gas", math.MaxUint64, "gas available to each exported function")
 
 	flag.Parse()
 
@@ -32,10 +35,10 @@ func main() {
 
 	wasm.SetDebugMode(*verbose)
 
-	run(os.Stdout, flag.Arg(0), *verify)
+	run(os.Stdout, flag.Arg(0), *verify, *gasLimit)
 }
 
-func run(w io.Writer, fname string, verify bool) {
+func run(w io.Writer, fname string, verify bool, gasLimit uint64) {
 	f, err := os.Open(fname)
 	if err != nil {
 		log.Fatal(err)
@@ -58,7 +61,7 @@ func run(w io.Writer, fname string, verify bool) {
 		log.Fatalf("module has no export section")
 	}
 
-	vm, err := exec.NewVM(m)
+	vm, err := exec.NewVM("", "", "", gas.NewMeter(gasLimit), nil, m, exec.WithMemoryLayout(exec.StandardLayout))
 	if err != nil {
 		log.Fatalf("could not create VM: %v", err)
 	}
@@ -80,7 +83,8 @@ func run(w io.Writer, fname string, verify bool) {
 			log.Printf("running exported functions with input parameters is not supported")
 			continue
 		}
-		o, err := vm.ExecCode(i)
+		vm.SetGasMetric(gas.NewMeter(gasLimit))
+		o, err := vm.ExecCode(i, "")
 		if err != nil {
 			fmt.Fprintf(w, "\n")
 			log.Printf("err=%v", err)
@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"io/ioutil"
+	"math"
 	"testing"
 )
 
@@ -28,7 +29,7 @@ func TestRun(t *testing.T) {
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			out := new(bytes.Buffer)
-			run(out, tc.name, tc.verify)
+			run(out, tc.name, tc.verify, math.MaxUint64)
 
 			want, err := ioutil.ReadFile(tc.want)
 			if err != nil {
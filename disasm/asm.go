@@ -21,7 +21,9 @@ func Assemble(instr []Instr) ([]byte, error) {
 		body.WriteByte(ins.Op.Code)
 		switch op := ins.Op.Code; op {
 		case ops.Block, ops.Loop, ops.If:
-			body.WriteByte(byte(ins.Immediates[0].(wasm.BlockType)))
+			if err := ins.Immediates[0].(wasm.BlockType).MarshalWASM(body); err != nil {
+				return nil, err
+			}
 		case ops.Br, ops.BrIf:
 			leb128.WriteVarUint32(body, ins.Immediates[0].(uint32))
 		case ops.BrTable:
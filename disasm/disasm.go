@@ -44,7 +44,7 @@ type Instr struct {
 // StackInfo stores details about a new stack created or unwound by an instruction.
 type StackInfo struct {
 	StackTopDiff int64 // The difference between the stack depths at the end of the block
-	PreserveTop  bool  // Whether the value on the top of the stack should be preserved while unwinding
+	Preserve     int   // The number of values on the top of the stack to preserve while unwinding
 	IsReturn     bool  // Whether the unwind is equivalent to a return
 }
 
@@ -105,8 +105,19 @@ func NewDisassembly(fn wasm.Function, module *wasm.Module) (*Disassembly, error)
 	// stack is maintained independently for calculating discard values
 	stackDepths := &stack.Stack{}
 	stackDepths.Push(0)
-	blockIndices := &stack.Stack{} // a stack of indices to operators which start new blocks
+	blockIndices := &stack.Stack{}               // a stack of indices to operators which start new blocks
+	blockSigs := make(map[int]*wasm.FunctionSig) // signatures of blocks, by index of their start operator
 	curIndex := 0
+
+	// labelArity returns the number of values a branch to the block
+	// started at index takes with it: the parameters of a loop, or the
+	// results of other blocks.
+	labelArity := func(index uint64) int {
+		if disas.Code[index].Op.Code == ops.Loop {
+			return len(blockSigs[int(index)].ParamTypes)
+		}
+		return len(blockSigs[int(index)].ReturnTypes)
+	}
 	var lastOpReturn bool
 
 	for _, instr := range instrs {
@@ -166,6 +177,7 @@ func NewDisassembly(fn wasm.Function, module *wasm.Module) (*Disassembly, error)
 			curDepth := stackDepths.Top()
 			blockStartIndex := blockIndices.Pop()
 			blockSig := disas.Code[blockStartIndex].Block.Signature
+			results := len(blockSigs[int(blockStartIndex)].ReturnTypes)
 			instr.Block = &BlockInfo{
 				Start:     false,
 				Signature: blockSig,
@@ -179,16 +191,16 @@ func NewDisassembly(fn wasm.Function, module *wasm.Module) (*Disassembly, error)
 			}
 
 			// The max depth reached while execing the last block
-			// If the signature of the current block is not empty,
-			// this will be incremented.
+			// If the block yields values, this will be incremented
+			// by their number.
 			// Same with ops.Br/BrIf, we subtract 2 instead of 1
 			// to get the depth of the *parent* block of the branch
 			// we want to take.
 			prevDepthIndex := stackDepths.Len() - 2
 			prevDepth := stackDepths.Get(prevDepthIndex)
 
-			if op != ops.Else && blockSig != wasm.BlockTypeEmpty && !instr.Unreachable {
-				stackDepths.Set(prevDepthIndex, prevDepth+1)
+			if op != ops.Else && results != 0 && !instr.Unreachable {
+				stackDepths.Set(prevDepthIndex, prevDepth+uint64(results))
 				disas.checkMaxDepth(int(stackDepths.Get(prevDepthIndex)))
 			}
 
@@ -199,9 +211,9 @@ func NewDisassembly(fn wasm.Function, module *wasm.Module) (*Disassembly, error)
 				}
 				instr.NewStack = &StackInfo{
 					StackTopDiff: int64(elemsDiscard),
-					PreserveTop:  blockSig != wasm.BlockTypeEmpty,
+					Preserve:     results,
 				}
-				logger.Printf("discard %d elements, preserve top: %v", elemsDiscard, instr.NewStack.PreserveTop)
+				logger.Printf("discard %d elements, preserve %d", elemsDiscard, instr.NewStack.Preserve)
 			} else {
 				instr.NewStack = &StackInfo{}
 			}
@@ -214,7 +226,10 @@ func NewDisassembly(fn wasm.Function, module *wasm.Module) (*Disassembly, error)
 
 			stackDepths.Pop()
 			if op == ops.Else {
-				stackDepths.Push(stackDepths.Top())
+				// The else branch starts with the parameters of the
+				// block on the stack, as the if branch did.
+				stackDepths.Push(stackDepths.Top() + uint64(len(blockSigs[int(blockStartIndex)].ParamTypes)))
+				blockSigs[curIndex] = blockSigs[int(blockStartIndex)]
 				blockIndices.Push(uint64(curIndex))
 				if !instr.Unreachable {
 					blockPolymorphicOps = append(blockPolymorphicOps, []int{})
@@ -223,8 +238,24 @@ func NewDisassembly(fn wasm.Function, module *wasm.Module) (*Disassembly, error)
 
 		case ops.Block, ops.Loop, ops.If:
 			sig := instr.Immediates[0].(wasm.BlockType)
+			blockSig, err := module.GetBlockSig(sig)
+			if err != nil {
+				return nil, err
+			}
+			blockSigs[curIndex] = blockSig
 			logger.Printf("if, depth is %d", stackDepths.Top())
-			stackDepths.Push(stackDepths.Top())
+			// The parameters of the block move from the stack of the
+			// parent block to the stack of the new one.
+			top := stackDepths.Top()
+			params := uint64(len(blockSig.ParamTypes))
+			if !instr.Unreachable {
+				if top < params {
+					return nil, ErrStackUnderflow
+				}
+				top -= params
+				stackDepths.SetTop(top)
+			}
+			stackDepths.Push(top + params)
 			// If this new block is unreachable, its
 			// entire instruction sequence is unreachable
 			// as well. To make sure that isInstrReachable
@@ -263,7 +294,7 @@ func NewDisassembly(fn wasm.Function, module *wasm.Module) (*Disassembly, error)
 				index := blockIndices.Get(blockIndices.Len() - 1 - int(depth))
 				instr.NewStack = &StackInfo{
 					StackTopDiff: int64(elemsDiscard),
-					PreserveTop:  disas.Code[index].Block.Signature != wasm.BlockTypeEmpty,
+					Preserve:     labelArity(index),
 				}
 			}
 			if op == ops.Br {
@@ -292,7 +323,7 @@ func NewDisassembly(fn wasm.Function, module *wasm.Module) (*Disassembly, error)
 					}
 					index := blockIndices.Get(blockIndices.Len() - 1 - int(entry))
 					info.StackTopDiff = int64(elemsDiscard)
-					info.PreserveTop = disas.Code[index].Block.Signature != wasm.BlockTypeEmpty
+					info.Preserve = labelArity(index)
 				}
 				instr.Branches = append(instr.Branches, info)
 			}
@@ -312,7 +343,7 @@ func NewDisassembly(fn wasm.Function, module *wasm.Module) (*Disassembly, error)
 				}
 				index := blockIndices.Get(blockIndices.Len() - 1 - int(defaultTarget))
 				info.StackTopDiff = int64(elemsDiscard)
-				info.PreserveTop = disas.Code[index].Block.Signature != wasm.BlockTypeEmpty
+				info.Preserve = labelArity(index)
 			}
 			instr.Branches = append(instr.Branches, info)
 			pushPolymorphicOp(blockPolymorphicOps, curIndex)
@@ -391,11 +422,11 @@ func Disassemble(code []byte) ([]Instr, error) {
 
 		switch op {
 		case ops.Block, ops.Loop, ops.If:
-			sig, err := wasm.ReadByte(reader)
-			if err != nil {
+			var sig wasm.BlockType
+			if err := sig.UnmarshalWASM(reader); err != nil {
 				return nil, err
 			}
-			instr.Immediates = append(instr.Immediates, wasm.BlockType(sig))
+			instr.Immediates = append(instr.Immediates, sig)
 		case ops.Br, ops.BrIf:
 			depth, err := leb128.ReadVarUint32(reader)
 			if err != nil {
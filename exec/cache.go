@@ -0,0 +1,287 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/Ankr-network/wagon/exec/internal/compile"
+	"github.com/Ankr-network/wagon/wasm"
+)
+
+// cacheVersion is the version of the compiler and of the encoding of the
+// compile cache. It must be increased whenever either changes, so that
+// entries written by previous versions are compiled again.
+const cacheVersion = 2
+
+var errCacheMismatch = errors.New("exec: cache entry does not match the module")
+
+// cacheEntry is the content of a file of the compile cache.
+type cacheEntry struct {
+	Version uint32
+	Key     [sha256.Size]byte
+	Funcs   []cachedFunc
+}
+
+// cachedFunc holds a compiledFunction, without its gas blocks, which
+// depend on the gas schedule of the VMs.
+type cachedFunc struct {
+	Index          int
+	Code           []byte
+	Instructions   []compile.InstructionMetadata
+	BranchTables   []*compile.BranchTable
+	InboundTargets []int64
+	MaxDepth       int
+	TotalLocalVars int
+	Args           int
+	Returns        int
+	Native         []cachedNative
+}
+
+// cachedNative holds an asmBlock.
+type cachedNative struct {
+	Code     []byte
+	StartPC  uint
+	ResumePC uint
+}
+
+// cacheKey returns the key of the compiled code of module. It covers all
+// the inputs of the compilation, along with the target architecture if the
+// code is natively compiled, whether it is compiled for journaled VMs, and
+// whether its native code canonicalizes NaNs.
+func cacheKey(module *wasm.Module, aot, journaled, canonicalNaNs bool) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "wagon/%d/%v/%v/%v/%s\n", cacheVersion, aot, journaled, canonicalNaNs, runtime.GOARCH)
+	hashModule(h, module)
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// moduleKey returns a key identifying the code of module, which does not
+// depend on the compiler, nor on the architecture.
+func moduleKey(module *wasm.Module) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "wagon/module\n")
+	hashModule(h, module)
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// hashModule writes the types, globals and functions of module to h.
+func hashModule(h io.Writer, module *wasm.Module) {
+	if module.Types != nil {
+		for i := range module.Types.Entries {
+			module.Types.Entries[i].MarshalWASM(h)
+		}
+	}
+	for i := range module.GlobalIndexSpace {
+		module.GlobalIndexSpace[i].Type.MarshalWASM(h)
+	}
+	for _, fn := range module.FunctionIndexSpace {
+		if fn.Sig != nil {
+			fn.Sig.MarshalWASM(h)
+		}
+		if fn.IsHost() {
+			h.Write([]byte{0})
+			continue
+		}
+		h.Write([]byte{1})
+		fn.Body.MarshalWASM(h)
+	}
+}
+
+// cachePath returns the file holding the compiled code of module in the
+// cache directory dir.
+func cachePath(dir string, module *wasm.Module, aot, journaled, canonicalNaNs bool) string {
+	key := cacheKey(module, aot, journaled, canonicalNaNs)
+	return filepath.Join(dir, hex.EncodeToString(key[:])+".wagon")
+}
+
+// loadCache sets the functions of the VM from the cache file path, which
+// must have been written by storeCache for the same module. A file is
+// made of the SHA-256 checksum of its content, followed by a gob encoded
+// cacheEntry.
+func (vm *VM) loadCache(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(raw) < sha256.Size {
+		return errCacheMismatch
+	}
+	if sum := sha256.Sum256(raw[sha256.Size:]); !bytes.Equal(sum[:], raw[:sha256.Size]) {
+		return errCacheMismatch
+	}
+	var entry cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(raw[sha256.Size:])).Decode(&entry); err != nil {
+		return err
+	}
+	if entry.Version != cacheVersion || entry.Key != cacheKey(vm.module, vm.nativeBackend != nil, vm.journaled, vm.canonicalNaNs) {
+		return errCacheMismatch
+	}
+
+	funcs := make([]function, len(vm.module.FunctionIndexSpace))
+	for i, fn := range vm.module.FunctionIndexSpace {
+		if fn.IsHost() {
+			funcs[i] = newHostFunction(fn)
+		}
+	}
+	// The whole entry is validated before any native code is allocated,
+	// and the native code of the entry is released if allocating it fails
+	// partway through.
+	for _, cf := range entry.Funcs {
+		if cf.Index < 0 || cf.Index >= len(funcs) || funcs[cf.Index] != nil || !vm.validCachedFunc(cf) {
+			return errCacheMismatch
+		}
+		funcs[cf.Index] = compiledFunction{}
+	}
+	for _, fn := range funcs {
+		if fn == nil {
+			return errCacheMismatch
+		}
+	}
+	var mark compile.AllocatorMark
+	if vm.nativeBackend != nil {
+		mark = vm.nativeBackend.allocator.Mark()
+	}
+	for _, cf := range entry.Funcs {
+		fn, err := vm.cachedFunction(cf)
+		if err != nil {
+			if rerr := vm.nativeBackend.allocator.Release(mark); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+		funcs[cf.Index] = fn
+	}
+	vm.funcs = funcs
+	return nil
+}
+
+// validCachedFunc reports whether the native code of cf can be run by the
+// VM, and resumes within its bytecode.
+func (vm *VM) validCachedFunc(cf cachedFunc) bool {
+	if len(cf.Native) != 0 && vm.nativeBackend == nil {
+		return false
+	}
+	for _, n := range cf.Native {
+		if n.StartPC >= n.ResumePC || n.ResumePC > uint(len(cf.Code)) {
+			return false
+		}
+	}
+	return true
+}
+
+// cachedFunction returns the compiled function held by cf, which must be
+// valid, allocating its native code.
+func (vm *VM) cachedFunction(cf cachedFunc) (compiledFunction, error) {
+	meta := &compile.BytecodeMetadata{
+		BranchTables:   cf.BranchTables,
+		Instructions:   cf.Instructions,
+		InboundTargets: make(map[int64]struct{}, len(cf.InboundTargets)),
+	}
+	for _, target := range cf.InboundTargets {
+		meta.InboundTargets[target] = struct{}{}
+	}
+	fn := compiledFunction{
+		codeMeta:       meta,
+		code:           cf.Code,
+		branchTables:   meta.BranchTables,
+		maxDepth:       cf.MaxDepth,
+		totalLocalVars: cf.TotalLocalVars,
+		args:           cf.Args,
+		returns:        cf.Returns,
+	}
+	for _, n := range cf.Native {
+		unit, err := vm.nativeBackend.allocator.AllocateExec(n.Code)
+		if err != nil {
+			return fn, err
+		}
+		fn.asm = append(fn.asm, asmBlock{
+			nativeUnit: unit,
+			code:       n.Code,
+			startPC:    n.StartPC,
+			resumePC:   n.ResumePC,
+		})
+	}
+	return fn, nil
+}
+
+// storeCache writes the functions of the VM to the cache file path. The
+// file is written under a temporary name, then renamed, so that readers
+// never see a partial file.
+func (vm *VM) storeCache(path string) error {
+	entry := cacheEntry{
+		Version: cacheVersion,
+		Key:     cacheKey(vm.module, vm.nativeBackend != nil, vm.journaled, vm.canonicalNaNs),
+	}
+	for i, f := range vm.funcs {
+		fn, ok := f.(compiledFunction)
+		if !ok {
+			continue
+		}
+		cf := cachedFunc{
+			Index:          i,
+			Code:           fn.code,
+			Instructions:   fn.codeMeta.Instructions,
+			BranchTables:   fn.branchTables,
+			MaxDepth:       fn.maxDepth,
+			TotalLocalVars: fn.totalLocalVars,
+			Args:           fn.args,
+			Returns:        fn.returns,
+		}
+		for target := range fn.codeMeta.InboundTargets {
+			cf.InboundTargets = append(cf.InboundTargets, target)
+		}
+		for _, block := range fn.asm {
+			cf.Native = append(cf.Native, cachedNative{
+				Code:     block.code,
+				StartPC:  block.startPC,
+				ResumePC: block.resumePC,
+			})
+		}
+		entry.Funcs = append(entry.Funcs, cf)
+	}
+
+	payload := new(bytes.Buffer)
+	if err := gob.NewEncoder(payload).Encode(&entry); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(payload.Bytes())
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(sum[:])
+	if err == nil {
+		_, err = f.Write(payload.Bytes())
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+func TestCompileCache(t *testing.T) {
+	for _, aot := range []bool{false, true} {
+		dir := t.TempDir()
+		// main computes 1 + 4 - 1, which is natively compiled with AOT.
+		code := []byte{ops.I32Const, 1, ops.I32Const, 4, ops.I32Add, ops.I32Const, 1, ops.I32Sub}
+		m := newTestModule(i32Result, nil, code)
+		run := func(when string) {
+			t.Helper()
+			c, err := Compile(m, EnableAOT(aot), WithCacheDir(dir))
+			if err != nil {
+				t.Fatalf("AOT %v, %s: %v", aot, when, err)
+			}
+			defer c.Close()
+			vm, err := NewVMFromCompiled("contract", "owner", "caller", gas.NewMeter(1<<20), nil, c)
+			if err != nil {
+				t.Fatalf("AOT %v, %s: %v", aot, when, err)
+			}
+			if res, err := vm.ExecCode(0, ""); err != nil || res != int32(4) {
+				t.Errorf("AOT %v, %s: main() = %v, %v, want 4", aot, when, res, err)
+			}
+		}
+		// loaded reports whether the cache holds a valid entry for m.
+		loaded := func(path string) bool {
+			vm := &VM{module: m, funcs: make([]function, len(m.FunctionIndexSpace))}
+			if aot {
+				if ok, backend := nativeBackend(); ok {
+					vm.nativeBackend = backend
+					defer backend.Close()
+				}
+			}
+			if vm.loadCache(path) != nil {
+				return false
+			}
+			if native := len(vm.funcs[0].(compiledFunction).asm) != 0; native != (vm.nativeBackend != nil) {
+				t.Errorf("AOT %v: cached function has native code: %v", aot, native)
+			}
+			return true
+		}
+
+		run("cold start")
+		files, err := filepath.Glob(filepath.Join(dir, "*.wagon"))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("AOT %v: cache files = %v, %v, want one", aot, files, err)
+		}
+		path := files[0]
+		if !loaded(path) {
+			t.Fatalf("AOT %v: cache entry cannot be loaded", aot)
+		}
+		run("warm start")
+
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw[len(raw)-1] ^= 0xff
+		if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if loaded(path) {
+			t.Errorf("AOT %v: corrupted cache entry was loaded", aot)
+		}
+		run("corrupted cache")
+		if !loaded(path) {
+			t.Errorf("AOT %v: corrupted cache entry was not replaced", aot)
+		}
+
+		// An entry for another module is stale.
+		other := newTestModule(i32Result, nil, append(code[:len(code):len(code)], ops.I32Const, 1, ops.I32Add))
+		vm := &VM{module: other, funcs: make([]function, 1)}
+		if err := vm.compileFuncs(); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.storeCache(path); err != nil {
+			t.Fatal(err)
+		}
+		if loaded(path) {
+			t.Errorf("AOT %v: stale cache entry was loaded", aot)
+		}
+		run("stale cache")
+	}
+}
+
+func TestCacheIsValidatedBeforeAllocation(t *testing.T) {
+	code := []byte{ops.I32Const, 1, ops.I32Const, 4, ops.I32Add}
+	m := newTestModule(i32Result, nil, code)
+	vm := &VM{module: m, funcs: make([]function, 1), nativeBackend: fakeNativeCompiler(t)}
+	if err := vm.compileFuncs(); err != nil {
+		t.Fatal(err)
+	}
+	// The second native block resumes past the end of the bytecode.
+	fn := vm.funcs[0].(compiledFunction)
+	fn.asm = []asmBlock{
+		{code: []byte{1}, startPC: 0, resumePC: 1},
+		{code: []byte{2}, startPC: 1, resumePC: uint(len(fn.code)) + 1},
+	}
+	vm.funcs[0] = fn
+	path := filepath.Join(t.TempDir(), "entry.wagon")
+	if err := vm.storeCache(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.loadCache(path); err != errCacheMismatch {
+		t.Errorf("loadCache: error = %v, want %v", err, errCacheMismatch)
+	}
+	if n := vm.nativeBackend.allocator.(*mockPageAllocator).allocated; n != 0 {
+		t.Errorf("%d native units allocated for an invalid entry", n)
+	}
+}
+
+func TestCacheReleasesOnAllocationFailure(t *testing.T) {
+	code := []byte{ops.I32Const, 1, ops.I32Const, 4, ops.I32Add}
+	m := newTestModule(i32Result, nil, code)
+	vm := &VM{module: m, funcs: make([]function, 1), nativeBackend: fakeNativeCompiler(t)}
+	if err := vm.compileFuncs(); err != nil {
+		t.Fatal(err)
+	}
+	fn := vm.funcs[0].(compiledFunction)
+	fn.asm = []asmBlock{
+		{code: []byte{1}, startPC: 0, resumePC: 1},
+		{code: []byte{2}, startPC: 1, resumePC: 2},
+	}
+	vm.funcs[0] = fn
+	path := filepath.Join(t.TempDir(), "entry.wagon")
+	if err := vm.storeCache(path); err != nil {
+		t.Fatal(err)
+	}
+
+	allocator := vm.nativeBackend.allocator.(*mockPageAllocator)
+	allocator.failAt = 2
+	if err := vm.loadCache(path); err != errAllocation {
+		t.Errorf("loadCache: error = %v, want %v", err, errAllocation)
+	}
+	if allocator.allocated != 0 {
+		t.Errorf("%d native units kept after a failed allocation", allocator.allocated)
+	}
+}
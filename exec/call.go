@@ -28,28 +28,28 @@ func (vm *VM) callIndirect() {
 	fnExpect := vm.module.Types.Entries[index]
 	_ = vm.fetchUint32() // reserved (https://github.com/WebAssembly/design/blob/27ac254c854994103c24834a994be16f74f54186/BinaryEncoding.md#call-operators-described-here)
 	tableIndex := vm.popUint32()
-	if int(tableIndex) >= len(vm.module.TableIndexSpace[0]) {
-		panic(ErrUndefinedElementIndex)
+	if int(tableIndex) >= len(vm.table) {
+		vm.trap(TrapUndefinedElement, ErrUndefinedElementIndex)
 	}
-	elemIndex := vm.module.TableIndexSpace[0][tableIndex]
+	elemIndex := vm.table[tableIndex]
 	fnActual := vm.module.FunctionIndexSpace[elemIndex]
 
 	if len(fnExpect.ParamTypes) != len(fnActual.Sig.ParamTypes) {
-		panic(ErrSignatureMismatch)
+		vm.trap(TrapSignatureMismatch, ErrSignatureMismatch)
 	}
 	if len(fnExpect.ReturnTypes) != len(fnActual.Sig.ReturnTypes) {
-		panic(ErrSignatureMismatch)
+		vm.trap(TrapSignatureMismatch, ErrSignatureMismatch)
 	}
 
 	for i := range fnExpect.ParamTypes {
 		if fnExpect.ParamTypes[i] != fnActual.Sig.ParamTypes[i] {
-			panic(ErrSignatureMismatch)
+			vm.trap(TrapSignatureMismatch, ErrSignatureMismatch)
 		}
 	}
 
 	for i := range fnExpect.ReturnTypes {
 		if fnExpect.ReturnTypes[i] != fnActual.Sig.ReturnTypes[i] {
-			panic(ErrSignatureMismatch)
+			vm.trap(TrapSignatureMismatch, ErrSignatureMismatch)
 		}
 	}
 
@@ -7,8 +7,10 @@ package exec
 import (
 	"bytes"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/Ankr-network/wagon/exec/gas"
 	"github.com/Ankr-network/wagon/wasm"
 )
 
@@ -74,7 +76,7 @@ func TestHostCall(t *testing.T) {
 
 	// Once called, NewVM will execute the module's main
 	// function.
-	vm, err := NewVM(m)
+	vm, err := NewVM("contract", "owner", "caller", gas.NewMeter(1<<20), nil, m)
 	if err != nil {
 		t.Fatalf("Error creating VM: %v", vm)
 	}
@@ -178,15 +180,15 @@ func TestHostSymbolCall(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not read module: %v", err)
 	}
-	vm, err := NewVM(m)
+	vm, err := NewVM("contract", "owner", "caller", gas.NewMeter(1<<20), nil, m)
 	if err != nil {
 		t.Fatalf("Could not instantiate vm: %v", err)
 	}
-	rtrns, err := vm.ExecCode(1)
+	rtrns, err := vm.ExecCode(1, "")
 	if err != nil {
 		t.Fatalf("Error executing the default function: %v", err)
 	}
-	if int(rtrns.(uint32)) != 3 {
+	if rtrns != int32(3) {
 		t.Fatalf("Did not get the right value. Got %d, wanted %d", rtrns, 3)
 	}
 }
@@ -196,22 +198,17 @@ func TestGoFunctionCallChecksForFirstArgument(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not read module: %v", err)
 	}
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("This code should have panicked.")
-		} else {
-			if r != "exec: the first argument of a host function was int32, expected ptr" {
-				t.Errorf("This should have panicked because of the wrong type being used as a first argument, and it panicked because of %v", r)
-			}
-		}
-	}()
-	vm, err := NewVM(m)
+	vm, err := NewVM("contract", "owner", "caller", gas.NewMeter(1<<20), nil, m)
 	if err != nil {
 		t.Fatalf("Could not instantiate vm: %v", err)
 	}
-	_, err = vm.ExecCode(1)
-	if err != nil {
-		t.Fatalf("Error executing the default function: %v", err)
+	_, err = vm.ExecCode(1, "")
+	trap, ok := err.(*Trap)
+	if !ok || trap.Kind != TrapHostFunction {
+		t.Fatalf("ExecCode with a host function not taking a *Process: error = %v, want a %v trap", err, TrapHostFunction)
+	}
+	if want := "exec: the first argument of a host function was int32, expected ptr"; !strings.HasSuffix(trap.Err.Error(), want) {
+		t.Errorf("trap error = %q, want it to end with %q", trap.Err, want)
 	}
 }
 
@@ -225,13 +222,13 @@ func TestHostTerminate(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not read module: %v", err)
 	}
-	vm, err := NewVM(m)
+	vm, err := NewVM("contract", "owner", "caller", gas.NewMeter(1<<20), nil, m)
 	if err != nil {
 		t.Fatalf("Could not instantiate vm: %v", err)
 	}
-	_, err = vm.ExecCode(1)
-	if err != nil {
-		t.Fatalf("Error executing the default function: %v", err)
+	_, err = vm.ExecCode(1, "")
+	if trap, ok := err.(*Trap); !ok || trap.Kind != TrapTerminated {
+		t.Fatalf("ExecCode = %v, want a %v trap", err, TrapTerminated)
 	}
 	if vm.abort == false || vm.ctx.pc > 0xa {
 		t.Fatalf("Terminate did not abort execution: abort=%v, pc=%#x", vm.abort, vm.ctx.pc)
@@ -1,5 +1,80 @@
 package exec
 
+import "errors"
+
+// ErrNoContractInvoker is returned by Process.InvokeInternal when the
+// running VM has no ContractInvoker.
+var ErrNoContractInvoker = errors.New("exec: no contract invoker")
+
 type ContractInvoker interface {
 	InvokeInternal(contractAddr string, ownerAddr string, callerAddr string, vmContext *VMContext, code []byte, contractName string, method string, params interface{}, rtnType string) (interface{}, error)
 }
+
+// InvokeInternal calls the ContractInvoker of the running VM with the VM
+// context of proc. The journaled VMs the ContractInvoker sets as running
+// VMs, other than the calling one, run the nested call in a savepoint,
+// which is rolled back if the call fails, and released otherwise.
+func (proc *Process) InvokeInternal(contractAddr string, ownerAddr string, callerAddr string, code []byte, contractName string, method string, params interface{}, rtnType string) (interface{}, error) {
+	vm := proc.vmContext.runningVM
+	if vm.contrInvoker == nil {
+		return nil, ErrNoContractInvoker
+	}
+	call := &nestedCall{caller: vm}
+	prev := proc.vmContext.nested
+	proc.vmContext.nested = call
+	res, err := vm.contrInvoker.InvokeInternal(contractAddr, ownerAddr, callerAddr, proc.vmContext, code, contractName, method, params, rtnType)
+	proc.vmContext.nested = prev
+	// VMs running the nested call replace the running VM of the context.
+	proc.vmContext.runningVM = vm
+
+	if cerr := call.close(err != nil); cerr != nil {
+		return nil, cerr
+	}
+	return res, err
+}
+
+// nestedCall holds the savepoints opened on the VMs running a nested call.
+type nestedCall struct {
+	caller     *VM
+	vms        []*VM
+	savepoints []int
+	err        error // error opening a savepoint
+}
+
+// enter opens a savepoint on vm, unless it is the calling VM, is not
+// journaled, or already has one.
+func (c *nestedCall) enter(vm *VM) {
+	if vm == c.caller || !vm.journaled || c.err != nil {
+		return
+	}
+	for _, v := range c.vms {
+		if v == vm {
+			return
+		}
+	}
+	sp, err := vm.Savepoint()
+	if err != nil {
+		c.err = err
+		return
+	}
+	c.vms = append(c.vms, vm)
+	c.savepoints = append(c.savepoints, sp)
+}
+
+// close rolls back the savepoints of the call, or releases them, and
+// returns the first error met, including one opening a savepoint.
+func (c *nestedCall) close(rollback bool) error {
+	err := c.err
+	for i := len(c.vms) - 1; i >= 0; i-- {
+		var cerr error
+		if rollback {
+			cerr = c.vms[i].RollbackSavepoint(c.savepoints[i])
+		} else {
+			cerr = c.vms[i].ReleaseSavepoint(c.savepoints[i])
+		}
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
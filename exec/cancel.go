@@ -0,0 +1,52 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	gocontext "context"
+)
+
+// ExecCodeContext calls the function with the given index and arguments,
+// as ExecCode does, and stops its execution once ctx is done. Cancellation
+// is checked when the execution jumps back to the start of a loop, on
+// calls, and when native code returns to the interpreter. The execution
+// then fails with a Trap of kind TrapCanceled, whose error is ErrCanceled,
+// or ErrDeadlineExceeded if the deadline of ctx expired.
+//
+// Executions re-entered by host functions are stopped along with the one
+// they interrupted, whether they are started by ExecCode or by
+// ExecCodeContext with a context of their own.
+func (vm *VM) ExecCodeContext(ctx gocontext.Context, fnIndex int64, rtnType string, args ...uint64) (interface{}, error) {
+	prevCtx, prevDone := vm.execCtx, vm.done
+	if prevCtx != nil {
+		var cancel gocontext.CancelCauseFunc
+		ctx, cancel = gocontext.WithCancelCause(ctx)
+		stop := gocontext.AfterFunc(prevCtx, func() { cancel(prevCtx.Err()) })
+		defer func() {
+			stop()
+			cancel(nil)
+		}()
+	}
+	vm.execCtx, vm.done = ctx, ctx.Done()
+	defer func() {
+		vm.execCtx, vm.done = prevCtx, prevDone
+	}()
+	return vm.ExecCode(fnIndex, rtnType, args...)
+}
+
+// checkCanceled traps the VM if the context of its execution is done.
+func (vm *VM) checkCanceled() {
+	if vm.done == nil {
+		return
+	}
+	select {
+	case <-vm.done:
+		if gocontext.Cause(vm.execCtx) == gocontext.DeadlineExceeded {
+			vm.trap(TrapCanceled, ErrDeadlineExceeded)
+		}
+		vm.trap(TrapCanceled, ErrCanceled)
+	default:
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	gocontext "context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+func TestExecCodeContext(t *testing.T) {
+	loops := map[string][]byte{
+		"br":    {ops.Loop, byte(wasm.BlockTypeEmpty), ops.Br, 0, ops.End},
+		"br_if": {ops.Loop, byte(wasm.BlockTypeEmpty), ops.I32Const, 1, ops.BrIf, 0, ops.End},
+	}
+	for name, code := range loops {
+		vm := newTestVM(t, newTestModule(wasm.FunctionSig{}, nil, code), gas.NewMeter(1<<62))
+
+		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 10*time.Millisecond)
+		_, err := vm.ExecCodeContext(ctx, 0, "")
+		cancel()
+		if trap, ok := err.(*Trap); !ok || trap.Kind != TrapCanceled || trap.Err != ErrDeadlineExceeded {
+			t.Errorf("%s loop with a deadline: error = %v, want %v", name, err, ErrDeadlineExceeded)
+		}
+
+		ctx, cancel = gocontext.WithCancel(gocontext.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		_, err = vm.ExecCodeContext(ctx, 0, "")
+		if trap, ok := err.(*Trap); !ok || trap.Kind != TrapCanceled || trap.Err != ErrCanceled {
+			t.Errorf("%s loop canceled: error = %v, want %v", name, err, ErrCanceled)
+		}
+	}
+
+	// Executions are not started with a context that is already done,
+	// and later ones are not affected by it.
+	vm := newTestVM(t, newTestModule(i32Result, nil, addCode), gas.NewMeter(1<<20))
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+	if _, err := vm.ExecCodeContext(ctx, 0, ""); err == nil || err.(*Trap).Err != ErrCanceled {
+		t.Errorf("canceled context: error = %v, want %v", err, ErrCanceled)
+	}
+	if res, err := vm.ExecCode(0, ""); err != nil || res != int32(4) {
+		t.Errorf("ExecCode after cancellation = %v, %v, want 4", res, err)
+	}
+}
+
+func TestExecCodeContextReentry(t *testing.T) {
+	// main(a) calls nested(a), then loops forever unless a is 0. nested
+	// runs main(0) with a context of its own if a is 1, which returns at
+	// once, and main(3) through ExecCode if a is 2, or with a context of
+	// its own if a is 4, which both loop forever.
+	h := NewHostModule("env").Func("nested", func(p *Process, a int32) error {
+		var err error
+		switch a {
+		case 1:
+			_, err = p.VM().ExecCodeContext(gocontext.Background(), 1, "", 0)
+		case 2:
+			_, err = p.VM().ExecCode(1, "", 3)
+		case 4:
+			_, err = p.VM().ExecCodeContext(gocontext.Background(), 1, "", 3)
+		}
+		return err
+	})
+	body := []byte{
+		0, // no locals
+		ops.GetLocal, 0,
+		ops.Call, 0,
+		ops.GetLocal, 0,
+		ops.If, byte(wasm.BlockTypeEmpty),
+		ops.Loop, byte(wasm.BlockTypeEmpty),
+		ops.Br, 0,
+		ops.End,
+		ops.End,
+		ops.End,
+	}
+	raw := bytes.Join([][]byte{
+		wasmHeader,
+		wasmSection(wasm.SectionIDType, 1, []byte{0x60, 1, 0x7f, 0}),
+		wasmSection(wasm.SectionIDImport, 1, wasmImport("nested", byte(wasm.ExternalFunction), 0)),
+		wasmSection(wasm.SectionIDFunction, 1, []byte{0}),
+		wasmSection(wasm.SectionIDCode, 1, append([]byte{byte(len(body))}, body...)),
+	}, nil)
+	m, err := wasm.ReadModule(bytes.NewReader(raw), h.Resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, a := range []uint64{1, 2, 4} {
+		// Without the deadline, the loop runs out of gas instead.
+		vm := newTestVM(t, m, gas.NewMeter(1<<28))
+		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 10*time.Millisecond)
+		_, err := vm.ExecCodeContext(ctx, 1, "", a)
+		cancel()
+		if !errors.Is(err, ErrDeadlineExceeded) {
+			t.Errorf("main(%d) with a deadline: error = %v, want %v", a, err, ErrDeadlineExceeded)
+		}
+		if vm.execCtx != nil || vm.done != nil {
+			t.Errorf("main(%d): context kept after the execution", a)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"errors"
+
+	"github.com/Ankr-network/wagon/disasm"
+	vmevent "github.com/Ankr-network/wagon/exec/event"
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/exec/internal/compile"
+	"github.com/Ankr-network/wagon/validate"
+	"github.com/Ankr-network/wagon/wasm"
+)
+
+// CompiledModule is a module compiled for execution. It is immutable, and
+// can back any number of VMs, executing concurrently.
+type CompiledModule struct {
+	module  *wasm.Module
+	options config
+	funcs   []function
+	native  *nativeCompiler // backend holding the native code, if any
+}
+
+// Compile disassembles and compiles the functions of module, and natively
+// compiles them if EnableAOT is set. opts also apply to the VMs created
+// from the compiled module. The module must not be modified afterwards.
+func Compile(module *wasm.Module, opts ...VMOption) (*CompiledModule, error) {
+	var options config
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.GasSchedule == nil {
+		options.GasSchedule = defaultGasSchedule
+	}
+	if module.Memory != nil && len(module.Memory.Entries) > 1 {
+		return nil, ErrMultipleLinearMemories
+	}
+	if options.FloatMode == RejectFloats {
+		if err := validate.VerifyModule(module, validate.RejectFloats()); err != nil {
+			var verr validate.Error
+			if errors.As(err, &verr) {
+				if op, ok := verr.Err.(validate.FloatOpError); ok {
+					return nil, FloatOpcodeError{FuncIndex: verr.Function, Op: byte(op)}
+				}
+			}
+			return nil, err
+		}
+	}
+
+	// Compilation is carried out by a VM holding the functions being
+	// compiled, which is never run.
+	vm := &VM{
+		module:        module,
+		gasSchedule:   options.GasSchedule,
+		journaled:     options.Journal,
+		canonicalNaNs: options.FloatMode == CanonicalNaNs,
+		funcs:         make([]function, len(module.FunctionIndexSpace)),
+	}
+
+	aot := false
+	if options.EnableAOT {
+		supportedBackend, backend := nativeBackend()
+		if supportedBackend {
+			if be, ok := backend.Builder.(*compile.AMD64Backend); ok {
+				be.CanonicalizeNaNs = vm.canonicalNaNs
+			}
+			vm.nativeBackend = backend
+			aot = true
+		}
+	}
+
+	var cache string
+	if options.CacheDir != "" {
+		cache = cachePath(options.CacheDir, module, aot, vm.journaled, vm.canonicalNaNs)
+	}
+	if cache == "" || vm.loadCache(cache) != nil {
+		err := vm.compileFuncs()
+		if err == nil {
+			err = vm.tryNativeCompile()
+		}
+		if err != nil {
+			if vm.nativeBackend != nil {
+				vm.nativeBackend.Close()
+			}
+			return nil, err
+		}
+		if cache != "" {
+			// The cache only spares later compilations, so failing to
+			// write it is not an error.
+			vm.storeCache(cache)
+		}
+	}
+
+	for i, fn := range vm.funcs {
+		compiled, ok := fn.(compiledFunction)
+		if !ok {
+			continue
+		}
+		blocks, err := buildGasBlocks(vm.gasSchedule, i, compiled)
+		if err != nil {
+			if vm.nativeBackend != nil {
+				vm.nativeBackend.Close()
+			}
+			return nil, err
+		}
+		compiled.gasBlocks = blocks
+		vm.funcs[i] = compiled
+	}
+
+	return &CompiledModule{
+		module:  module,
+		options: options,
+		funcs:   vm.funcs,
+		native:  vm.nativeBackend,
+	}, nil
+}
+
+// Module returns the module that was compiled.
+func (c *CompiledModule) Module() *wasm.Module {
+	return c.module
+}
+
+// Close frees the native code of the compiled module. The VMs created
+// from it must not be used afterwards.
+func (c *CompiledModule) Close() error {
+	if c.native == nil {
+		return nil
+	}
+	return c.native.Close()
+}
+
+// NewVMFromCompiled creates a new VM executing the compiled module c. If
+// the module defines a start function, it is executed.
+//
+// Each VM has its own linear memory, globals and table, and its heap is
+// managed by its own FreeListHeap rather than by the HeapMem of the module.
+func NewVMFromCompiled(contractAddr string, ownerAddr string, callerAddr string, metric gas.GasMetric, publisher vmevent.Publisher, c *CompiledModule) (*VM, error) {
+	vm, err := newVM(contractAddr, ownerAddr, callerAddr, metric, publisher, c, NewFreeListHeap())
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.runStart(); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// compileFuncs disassembles and compiles the functions of the module.
+func (vm *VM) compileFuncs() error {
+	for i, fn := range vm.module.FunctionIndexSpace {
+		// Skip native methods as they need not be
+		// disassembled; simply add them at the end
+		// of the `funcs` array as is, as specified
+		// in the spec. See the "host functions"
+		// section of:
+		// https://webassembly.github.io/spec/core/exec/modules.html#allocation
+		if fn.IsHost() {
+			vm.funcs[i] = newHostFunction(fn)
+			continue
+		}
+
+		disassembly, err := disasm.NewDisassembly(fn, vm.module)
+		if err != nil {
+			return err
+		}
+
+		totalLocalVars := 0
+		totalLocalVars += len(fn.Sig.ParamTypes)
+		for _, entry := range fn.Body.Locals {
+			totalLocalVars += int(entry.Count)
+		}
+		code, meta := compile.Compile(disassembly.Code)
+		vm.funcs[i] = compiledFunction{
+			codeMeta:       meta,
+			code:           code,
+			branchTables:   meta.BranchTables,
+			maxDepth:       disassembly.MaxDepth,
+			totalLocalVars: totalLocalVars,
+			args:           len(fn.Sig.ParamTypes),
+			returns:        len(fn.Sig.ReturnTypes),
+		}
+	}
+	return nil
+}
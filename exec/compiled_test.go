@@ -0,0 +1,86 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+func TestCompiledModule(t *testing.T) {
+	// main increments, and returns, a counter stored in the linear memory,
+	// initially 5.
+	code := []byte{
+		ops.I32Const, 0,
+		ops.I32Const, 0,
+		ops.I32Load, 2, 0,
+		ops.I32Const, 1,
+		ops.I32Add,
+		ops.I32Store, 2, 0,
+		ops.I32Const, 0,
+		ops.I32Load, 2, 0,
+	}
+	m := newTestModule(i32Result, nil, code)
+	m.Memory = &wasm.SectionMemories{Entries: []wasm.Memory{{Limits: wasm.ResizableLimits{Initial: 1}}}}
+	m.LinearMemoryIndexSpace = [][]byte{{5, 0, 0, 0}}
+	exportHeapBase(m, 1024)
+
+	for _, aot := range []bool{false, true} {
+		c, err := Compile(m, EnableAOT(aot), WithMemoryLayout(StandardLayout))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const vms, calls = 4, 100
+		var wg sync.WaitGroup
+		errs := make(chan error, vms)
+		for i := 0; i < vms; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				vm, err := NewVMFromCompiled("contract", "owner", "caller", gas.NewMeter(1<<30), nil, c)
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer vm.Close()
+				if _, err := vm.SetBytes([]byte("private")); err != nil {
+					errs <- err
+					return
+				}
+				var res interface{}
+				for j := 0; j < calls; j++ {
+					if res, err = vm.ExecCode(0, ""); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if res != int32(5+calls) {
+					t.Errorf("AOT %v: main() after %d calls = %v, want %d", aot, calls, res, 5+calls)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("AOT %v: %v", aot, err)
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("AOT %v: Close: %v", aot, err)
+		}
+	}
+	if m.LinearMemoryIndexSpace[0][0] != 5 {
+		t.Errorf("VMs modified the memory of the compiled module")
+	}
+
+	m.Memory.Entries = append(m.Memory.Entries, m.Memory.Entries[0])
+	if _, err := Compile(m); err != ErrMultipleLinearMemories {
+		t.Errorf("compiling two memories: error = %v, want %v", err, ErrMultipleLinearMemories)
+	}
+}
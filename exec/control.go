@@ -11,7 +11,7 @@ import "errors"
 var ErrUnreachable = errors.New("exec: reached unreachable")
 
 func (vm *VM) unreachable() {
-	panic(ErrUnreachable)
+	vm.trap(TrapUnreachable, ErrUnreachable)
 }
 
 func (vm *VM) nop() {}
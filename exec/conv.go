@@ -8,24 +8,37 @@ import (
 	"math"
 )
 
+// truncFloat truncates f towards zero, trapping the VM if f is NaN or if
+// the result does not lie within [min, max).
+func (vm *VM) truncFloat(f float64, min, max float64) float64 {
+	if math.IsNaN(f) {
+		vm.trap(TrapInvalidConversionToInteger, ErrInvalidConversionToInteger)
+	}
+	t := math.Trunc(f)
+	if t < min || t >= max {
+		vm.trap(TrapIntegerOverflow, ErrIntegerOverflow)
+	}
+	return t
+}
+
 func (vm *VM) i32Wrapi64() {
 	vm.pushUint32(uint32(vm.popUint64()))
 }
 
 func (vm *VM) i32TruncSF32() {
-	vm.pushInt32(int32(math.Trunc(float64(vm.popFloat32()))))
+	vm.pushInt32(int32(vm.truncFloat(float64(vm.popFloat32()), -1<<31, 1<<31)))
 }
 
 func (vm *VM) i32TruncUF32() {
-	vm.pushUint32(uint32(math.Trunc(float64(vm.popFloat32()))))
+	vm.pushUint32(uint32(vm.truncFloat(float64(vm.popFloat32()), 0, 1<<32)))
 }
 
 func (vm *VM) i32TruncSF64() {
-	vm.pushInt32(int32(math.Trunc(vm.popFloat64())))
+	vm.pushInt32(int32(vm.truncFloat(vm.popFloat64(), -1<<31, 1<<31)))
 }
 
 func (vm *VM) i32TruncUF64() {
-	vm.pushUint32(uint32(math.Trunc(vm.popFloat64())))
+	vm.pushUint32(uint32(vm.truncFloat(vm.popFloat64(), 0, 1<<32)))
 }
 
 func (vm *VM) i64ExtendSI32() {
@@ -37,19 +50,19 @@ func (vm *VM) i64ExtendUI32() {
 }
 
 func (vm *VM) i64TruncSF32() {
-	vm.pushInt64(int64(math.Trunc(float64(vm.popFloat32()))))
+	vm.pushInt64(int64(vm.truncFloat(float64(vm.popFloat32()), -1<<63, 1<<63)))
 }
 
 func (vm *VM) i64TruncUF32() {
-	vm.pushUint64(uint64(math.Trunc(float64(vm.popFloat32()))))
+	vm.pushUint64(uint64(vm.truncFloat(float64(vm.popFloat32()), 0, 1<<64)))
 }
 
 func (vm *VM) i64TruncSF64() {
-	vm.pushInt64(int64(math.Trunc(vm.popFloat64())))
+	vm.pushInt64(int64(vm.truncFloat(vm.popFloat64(), -1<<63, 1<<63)))
 }
 
 func (vm *VM) i64TruncUF64() {
-	vm.pushUint64(uint64(math.Trunc(vm.popFloat64())))
+	vm.pushUint64(uint64(vm.truncFloat(vm.popFloat64(), 0, 1<<64)))
 }
 
 func (vm *VM) f32ConvertSI32() {
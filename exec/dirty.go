@@ -0,0 +1,153 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"errors"
+
+	"github.com/Ankr-network/wagon/exec/internal/compile"
+)
+
+// DirtyChunkSize is the granularity, in bytes, at which VMs created with
+// TrackDirtyMemory track writes to their linear memory.
+const DirtyChunkSize = 1 << compile.DirtyChunkShift
+
+// memoryDiffVersion is the version of the encoding of memory diffs.
+const memoryDiffVersion = 1
+
+var (
+	// ErrNotTrackingDirty is returned by MemoryDiff for VMs created
+	// without TrackDirtyMemory.
+	ErrNotTrackingDirty = errors.New("exec: the VM does not track dirty memory")
+	// ErrInvalidMemoryDiff is returned when decoding or applying a
+	// malformed memory diff.
+	ErrInvalidMemoryDiff = errors.New("exec: invalid memory diff")
+)
+
+// MemoryChunk is a chunk of linear memory, at an offset that is a
+// multiple of DirtyChunkSize.
+type MemoryChunk struct {
+	Offset uint64
+	Data   []byte
+}
+
+// MemoryDiff holds the chunks of linear memory written since dirty memory
+// was last cleared, and the size of the memory, which may have grown.
+type MemoryDiff struct {
+	Size   uint64
+	Chunks []MemoryChunk // sorted by offset
+}
+
+// MemoryDiff returns the chunks of linear memory written since the VM was
+// created or reset, or since ClearDirtyMemory was last called. The chunks
+// hold a copy of the memory. Writes made through the slice returned by
+// Memory are not tracked.
+func (vm *VM) MemoryDiff() (*MemoryDiff, error) {
+	if !vm.trackDirty {
+		return nil, ErrNotTrackingDirty
+	}
+	d := &MemoryDiff{Size: uint64(len(vm.memory))}
+	for i, dirty := range vm.dirty {
+		start := i * DirtyChunkSize
+		if dirty == 0 || start >= len(vm.memory) {
+			continue
+		}
+		end := start + DirtyChunkSize
+		if end > len(vm.memory) {
+			end = len(vm.memory)
+		}
+		d.Chunks = append(d.Chunks, MemoryChunk{
+			Offset: uint64(start),
+			Data:   append([]byte(nil), vm.memory[start:end]...),
+		})
+	}
+	return d, nil
+}
+
+// ClearDirtyMemory marks all the linear memory as clean.
+func (vm *VM) ClearDirtyMemory() {
+	for i := range vm.dirty {
+		vm.dirty[i] = 0
+	}
+}
+
+// ApplyMemoryDiff resizes the linear memory of the VM to the size of d,
+// and writes its chunks. It is meant for VMs of the same module as the VM
+// d was taken from, and in the same state before d. The state of the heap
+// is not part of memory diffs, and is not changed.
+func (vm *VM) ApplyMemoryDiff(d *MemoryDiff) error {
+	if d.Size > uint64(vm.maxMemoryPages)*wasmPageSize {
+		return ErrInvalidMemoryDiff
+	}
+	for _, c := range d.Chunks {
+		if c.Offset+uint64(len(c.Data)) > d.Size {
+			return ErrInvalidMemoryDiff
+		}
+	}
+
+	if size := int(d.Size); size <= len(vm.memory) {
+		vm.memory = vm.memory[:size]
+	} else {
+		vm.memory = append(vm.memory, make([]byte, size-len(vm.memory))...)
+	}
+	for _, c := range d.Chunks {
+		if vm.journaled || vm.trackDirty {
+			vm.recordWrite(c.Offset, uint64(len(c.Data)))
+		}
+		copy(vm.memory[c.Offset:], c.Data)
+	}
+	return nil
+}
+
+// MarshalBinary encodes the diff, starting with the version of its
+// encoding.
+func (d *MemoryDiff) MarshalBinary() ([]byte, error) {
+	var w snapshotWriter
+	w.uvarint(memoryDiffVersion)
+	w.uvarint(d.Size)
+	w.uvarint(uint64(len(d.Chunks)))
+	for _, c := range d.Chunks {
+		w.uvarint(c.Offset)
+		w.bytes(c.Data)
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary decodes a diff encoded by MarshalBinary.
+func (d *MemoryDiff) UnmarshalBinary(data []byte) error {
+	r := snapshotReader{buf: data}
+	if r.uvarint() != memoryDiffVersion {
+		return ErrInvalidMemoryDiff
+	}
+	size := r.uvarint()
+	chunks := make([]MemoryChunk, r.count())
+	for i := range chunks {
+		chunks[i].Offset = r.uvarint()
+		chunks[i].Data = append([]byte(nil), r.bytes()...)
+	}
+	if r.end() != nil {
+		return ErrInvalidMemoryDiff
+	}
+	d.Size, d.Chunks = size, chunks
+	return nil
+}
+
+// markDirty marks the chunks holding the n bytes at off as dirty.
+func (vm *VM) markDirty(off, n uint64) {
+	if n == 0 {
+		return
+	}
+	vm.growDirty()
+	for i := off / DirtyChunkSize; i <= (off+n-1)/DirtyChunkSize && i < uint64(len(vm.dirty)); i++ {
+		vm.dirty[i] = 1
+	}
+}
+
+// growDirty extends the dirty chunks to cover the whole linear memory.
+func (vm *VM) growDirty() {
+	if n := (len(vm.memory) + DirtyChunkSize - 1) / DirtyChunkSize; len(vm.dirty) < n {
+		vm.dirty = append(vm.dirty, make([]byte, n-len(vm.dirty))...)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+func TestMemoryDiff(t *testing.T) {
+	// main stores 7 at 0, and an i64 spanning chunks 3 and 4, at 16382.
+	code := []byte{
+		ops.I32Const, 0,
+		ops.I32Const, 7,
+		ops.I32Store, 2, 0,
+		ops.I32Const, 0xfe, 0xff, 0x00,
+		ops.I64Const, 1,
+		ops.I64Store, 3, 0,
+		ops.I32Const, 0,
+		ops.I32Load, 2, 0,
+	}
+	newVM := func(aot bool) *VM {
+		m := newTestModule(i32Result, nil, code)
+		m.Memory = &wasm.SectionMemories{Entries: []wasm.Memory{{Limits: wasm.ResizableLimits{Initial: 1}}}}
+		m.LinearMemoryIndexSpace = [][]byte{nil}
+		exportHeapBase(m, 1024)
+		return newTestVM(t, m, gas.NewMeter(1<<30), EnableAOT(aot), TrackDirtyMemory(true))
+	}
+
+	for _, aot := range []bool{false, true} {
+		vm := newVM(aot)
+		if _, err := vm.ExecCode(0, ""); err != nil {
+			t.Fatal(err)
+		}
+		ptr, err := vm.SetBytes([]byte("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := vm.MemoryDiff()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offsets []uint64
+		for _, c := range d.Chunks {
+			offsets = append(offsets, c.Offset)
+		}
+		want := []uint64{0, 3 * DirtyChunkSize, 4 * DirtyChunkSize}
+		if heapChunk := ptr / DirtyChunkSize * DirtyChunkSize; heapChunk > want[0] {
+			want = append(want, heapChunk)
+		}
+		if len(offsets) != len(want) {
+			t.Fatalf("AOT %v: dirty chunks at %v, want %v", aot, offsets, want)
+		}
+		for i := range want {
+			if offsets[i] != want[i] {
+				t.Errorf("AOT %v: dirty chunks at %v, want %v", aot, offsets, want)
+				break
+			}
+		}
+
+		raw, err := d.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded MemoryDiff
+		if err := decoded.UnmarshalBinary(raw); err != nil {
+			t.Fatal(err)
+		}
+		other := newVM(aot)
+		if err := other.ApplyMemoryDiff(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(other.memory, vm.memory) {
+			t.Errorf("AOT %v: memory differs after applying the diff", aot)
+		}
+		if err := decoded.UnmarshalBinary(raw[:len(raw)-1]); err != ErrInvalidMemoryDiff {
+			t.Errorf("AOT %v: decoding a truncated diff: error = %v, want %v", aot, err, ErrInvalidMemoryDiff)
+		}
+
+		vm.ClearDirtyMemory()
+		if d, _ := vm.MemoryDiff(); len(d.Chunks) != 0 {
+			t.Errorf("AOT %v: %d dirty chunks after ClearDirtyMemory, want 0", aot, len(d.Chunks))
+		}
+	}
+
+	vm := newTestVM(t, newTestModule(i32Result, nil, addCode), gas.NewMeter(1<<20))
+	if _, err := vm.MemoryDiff(); err != ErrNotTrackingDirty {
+		t.Errorf("MemoryDiff on a VM not tracking dirty memory: error = %v, want %v", err, ErrNotTrackingDirty)
+	}
+}
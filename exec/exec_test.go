@@ -6,6 +6,7 @@ package exec_test
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
@@ -19,6 +20,7 @@ import (
 	"testing"
 
 	"github.com/Ankr-network/wagon/exec"
+	"github.com/Ankr-network/wagon/exec/gas"
 	"github.com/Ankr-network/wagon/validate"
 	"github.com/Ankr-network/wagon/wasm"
 )
@@ -237,6 +239,11 @@ func parseArgs(args []string) (arr []uint64) {
 	return arr
 }
 
+// unlimitedGas returns a gas metric that never runs out.
+func unlimitedGas() *gas.Meter {
+	return gas.NewMeter(math.MaxUint64)
+}
+
 func fnString(fn string, args []string) string {
 	if len(args) == 0 {
 		return fn
@@ -244,17 +251,6 @@ func fnString(fn string, args []string) string {
 	return fmt.Sprintf("%s(%v)", fn, args)
 }
 
-func panics(fn func()) (panicked bool, msg string) {
-	defer func() {
-		r := recover()
-		panicked = r != nil
-		msg = fmt.Sprint(r)
-	}()
-
-	fn()
-	return
-}
-
 func runTest(fileName string, testCases []testCase, t testing.TB, nativeBackend bool, repeat bool) {
 	file, err := os.Open(fileName)
 	if err != nil {
@@ -270,7 +266,7 @@ func runTest(fileName string, testCases []testCase, t testing.TB, nativeBackend
 		t.Fatalf("%s: %v", fileName, err)
 	}
 
-	vm, err := exec.NewVM(module, exec.EnableAOT(nativeBackend))
+	vm, err := exec.NewVM("", "", "", unlimitedGas(), nil, module, exec.EnableAOT(nativeBackend), exec.WithMemoryLayout(exec.StandardLayout))
 	if err != nil {
 		t.Fatalf("%s: %v", fileName, err)
 	}
@@ -302,14 +298,10 @@ func runTest(fileName string, testCases []testCase, t testing.TB, nativeBackend
 
 		if testCase.Trap != "" {
 			// don't benchmark tests that involve trapping the VM
-			fn := func() {
-				_, err := vm.ExecCode(int64(index), args...)
-				if err != nil {
-					t.Fatalf("%s, %s: %v", fileName, testCase.Function, err)
-				}
-			}
-			if p, msg := panics(fn); p && msg != testCase.Trap {
-				t.Errorf("%s, %s: unexpected trap message: got=%s, want=%s", fileName, fnString(testCase.Function, testCase.Args), msg, testCase.Trap)
+			_, err := vm.ExecCode(int64(index), "", args...)
+			var trap *exec.Trap
+			if err != nil && (!errors.As(err, &trap) || trap.Err.Error() != testCase.Trap) {
+				t.Errorf("%s, %s: unexpected trap: got=%v, want=%s", fileName, fnString(testCase.Function, testCase.Args), err, testCase.Trap)
 			}
 			continue
 		}
@@ -331,7 +323,7 @@ func runTest(fileName string, testCases []testCase, t testing.TB, nativeBackend
 		var err error
 
 		for i := 0; i < times; i++ {
-			res, err = vm.ExecCode(int64(index), args...)
+			res, err = vm.ExecCode(int64(index), "", args...)
 			if repeat {
 				vm.Restart()
 			}
@@ -339,6 +331,13 @@ func runTest(fileName string, testCases []testCase, t testing.TB, nativeBackend
 		if ok {
 			b.StopTimer()
 		}
+		// ExecCode returns signed integers, and parseValue unsigned ones.
+		switch v := res.(type) {
+		case int32:
+			res = uint32(v)
+		case int64:
+			res = uint64(v)
+		}
 
 		if err != nil && err.Error() != testCase.ErrorMsg {
 			t.Fatalf("%s, %s: %v", fileName, testCase.Function, err)
@@ -455,7 +454,7 @@ func loadModuleFindFunc(t *testing.B, fileName, funcName string, nativeBackend b
 		t.Fatalf("%s: %v", fileName, err)
 	}
 
-	vm, err := exec.NewVM(module, exec.EnableAOT(nativeBackend))
+	vm, err := exec.NewVM("", "", "", unlimitedGas(), nil, module, exec.EnableAOT(nativeBackend), exec.WithMemoryLayout(exec.StandardLayout))
 	if err != nil {
 		t.Fatalf("%s: %v", fileName, err)
 	}
@@ -468,7 +467,7 @@ func BenchmarkU64Arithmetic10Interpreted(b *testing.B) {
 	vm, funcIndex := loadModuleFindFunc(b, "testdata/rust-basic.wasm", "loopedArithmeticI64Benchmark", false)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), 10, 10)
+		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), "", 10, 10)
 	}
 }
 
@@ -480,7 +479,7 @@ func BenchmarkU64Arithmetic10Native(b *testing.B) {
 	vm, funcIndex := loadModuleFindFunc(b, "testdata/rust-basic.wasm", "loopedArithmeticI64Benchmark", true)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), 10, 10)
+		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), "", 10, 10)
 	}
 }
 
@@ -488,7 +487,7 @@ func BenchmarkF64Arithmetic10Interpreted(b *testing.B) {
 	vm, funcIndex := loadModuleFindFunc(b, "testdata/rust-basic.wasm", "loopedArithmeticF64Benchmark", false)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), 10, 10)
+		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), "", 10, 10)
 	}
 }
 
@@ -500,7 +499,7 @@ func BenchmarkF64Arithmetic10Native(b *testing.B) {
 	vm, funcIndex := loadModuleFindFunc(b, "testdata/rust-basic.wasm", "loopedArithmeticF64Benchmark", true)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), 10, 10)
+		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), "", 10, 10)
 	}
 }
 
@@ -508,7 +507,7 @@ func BenchmarkF32Arithmetic10Interpreted(b *testing.B) {
 	vm, funcIndex := loadModuleFindFunc(b, "testdata/rust-basic.wasm", "loopedArithmeticF32Benchmark", false)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), 10, 10)
+		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), "", 10, 10)
 	}
 }
 
@@ -520,7 +519,7 @@ func BenchmarkF32Arithmetic10Native(b *testing.B) {
 	vm, funcIndex := loadModuleFindFunc(b, "testdata/rust-basic.wasm", "loopedArithmeticF32Benchmark", true)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), 10, 10)
+		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), "", 10, 10)
 	}
 }
 
@@ -528,7 +527,7 @@ func BenchmarkU64Arithmetic50Interpreted(b *testing.B) {
 	vm, funcIndex := loadModuleFindFunc(b, "testdata/rust-basic.wasm", "loopedArithmeticI64Benchmark", false)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), 50, 1234)
+		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), "", 50, 1234)
 	}
 }
 
@@ -540,7 +539,7 @@ func BenchmarkU64Arithmetic50Native(b *testing.B) {
 	vm, funcIndex := loadModuleFindFunc(b, "testdata/rust-basic.wasm", "loopedArithmeticI64Benchmark", true)
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), 50, 1234)
+		benchmarkDummy, _ = vm.ExecCode(int64(funcIndex), "", 50, 1234)
 	}
 }
 
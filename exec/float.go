@@ -0,0 +1,83 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/Ankr-network/wagon/exec/internal/compile"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+// FloatMode describes how a VM executes floating-point operators. The bit
+// patterns of the NaNs they produce are left unspecified by the
+// WebAssembly spec, and depend on the host, so VMs which must compute
+// identical results everywhere should not use HardwareFloats.
+type FloatMode int
+
+const (
+	// HardwareFloats executes floating-point operators as the host does,
+	// NaNs included.
+	HardwareFloats FloatMode = iota
+	// CanonicalNaNs replaces the NaNs produced by floating-point operators
+	// by the canonical NaN, a positive quiet NaN with no payload. Operators
+	// which only move bits around, such as loads, constants and
+	// reinterpretations, are left as they are.
+	CanonicalNaNs
+	// RejectFloats fails the compilation of modules using any
+	// floating-point operator with a FloatOpcodeError, as reported by
+	// validate.VerifyModule with the validate.RejectFloats option.
+	RejectFloats
+)
+
+// FloatOpcodeError is returned by NewVM and Compile, in the RejectFloats
+// mode, when a function of the module uses a floating-point operator.
+type FloatOpcodeError struct {
+	FuncIndex int
+	Op        byte
+}
+
+func (e FloatOpcodeError) Error() string {
+	return fmt.Sprintf("exec: function %d uses the floating-point opcode %#x", e.FuncIndex, e.Op)
+}
+
+// canonicalizeNaNs wraps the floating-point operators of the function
+// table that compute their result, so that the NaNs they push are
+// replaced by the canonical NaN.
+func (vm *VM) canonicalizeNaNs() {
+	for code, fn := range vm.funcTable {
+		o, err := ops.New(byte(code))
+		if fn == nil || err != nil {
+			continue
+		}
+		switch o.Code {
+		case ops.F32Const, ops.F64Const, ops.F32Load, ops.F64Load,
+			ops.F32ReinterpretI32, ops.F64ReinterpretI64:
+			continue
+		}
+
+		fn := fn
+		switch o.Returns {
+		case wasm.ValueTypeF32:
+			vm.funcTable[code] = func() {
+				fn()
+				top := len(vm.ctx.stack) - 1
+				if f := math.Float32frombits(uint32(vm.ctx.stack[top])); f != f {
+					vm.ctx.stack[top] = uint64(compile.CanonicalNaN32)
+				}
+			}
+		case wasm.ValueTypeF64:
+			vm.funcTable[code] = func() {
+				fn()
+				top := len(vm.ctx.stack) - 1
+				if f := math.Float64frombits(vm.ctx.stack[top]); f != f {
+					vm.ctx.stack[top] = compile.CanonicalNaN64
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"math"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/exec/internal/compile"
+	"github.com/Ankr-network/wagon/validate"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+var i32i32ToI32 = wasm.FunctionSig{
+	Form:        0,
+	ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32},
+	ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32},
+}
+
+func TestCanonicalNaNs(t *testing.T) {
+	// The functions reinterpret their arguments as floats, apply op, and
+	// return the bits of the result.
+	f64Code := func(op ...byte) []byte {
+		code := []byte{ops.GetLocal, 0, ops.F64ReinterpretI64, ops.GetLocal, 1, ops.F64ReinterpretI64}
+		return append(append(code, op...), ops.I64ReinterpretF64)
+	}
+	f32Code := func(op ...byte) []byte {
+		code := []byte{ops.GetLocal, 0, ops.F32ReinterpretI32, ops.GetLocal, 1, ops.F32ReinterpretI32}
+		return append(append(code, op...), ops.I32ReinterpretF32)
+	}
+	nan64 := math.Float64bits(math.NaN()) | 0x8000000000000123
+	nan32 := uint64(math.Float32bits(float32(math.NaN())) | 0x80000123)
+	zero64, one64, minusOne64 := math.Float64bits(0), math.Float64bits(1), math.Float64bits(-1)
+	zero32, one32 := uint64(math.Float32bits(0)), uint64(math.Float32bits(1))
+
+	tests := []struct {
+		name   string
+		f32    bool
+		native bool // the function is natively compiled if AOT is enabled
+		code   []byte
+		args   []uint64
+		want   uint64
+	}{
+		{"f64.div 0/0", false, true, f64Code(ops.F64Div), []uint64{zero64, zero64}, compile.CanonicalNaN64},
+		{"f64.add NaN payload", false, true, f64Code(ops.F64Add), []uint64{nan64, one64}, compile.CanonicalNaN64},
+		{"f64.mul", false, true, f64Code(ops.F64Mul), []uint64{one64, minusOne64}, minusOne64},
+		{"f64.min NaN payload", false, true, f64Code(ops.F64Min), []uint64{one64, nan64}, compile.CanonicalNaN64},
+		{"f64.sqrt -1", false, false, f64Code(ops.Drop, ops.F64Sqrt), []uint64{minusOne64, zero64}, compile.CanonicalNaN64},
+		{"f64.neg NaN payload", false, false, f64Code(ops.Drop, ops.F64Neg), []uint64{nan64, zero64}, compile.CanonicalNaN64},
+		{"f64 reinterpretation", false, false, f64Code(ops.Drop), []uint64{nan64, zero64}, nan64},
+		{"f32.div 0/0", true, true, f32Code(ops.F32Div), []uint64{zero32, zero32}, uint64(compile.CanonicalNaN32)},
+		{"f32.sub NaN payload", true, true, f32Code(ops.F32Sub), []uint64{nan32, one32}, uint64(compile.CanonicalNaN32)},
+		{"f32.add", true, true, f32Code(ops.F32Add), []uint64{one32, one32}, uint64(math.Float32bits(2))},
+		{"f32.demote NaN payload", true, false, f32Code(ops.Drop, ops.F64PromoteF32, ops.F32DemoteF64), []uint64{nan32, zero32}, uint64(compile.CanonicalNaN32)},
+		{"f32 reinterpretation", true, false, f32Code(ops.Drop), []uint64{nan32, zero32}, nan32},
+	}
+
+	for _, tt := range tests {
+		sig := i64i64ToI64
+		if tt.f32 {
+			sig = i32i32ToI32
+		}
+		for _, aot := range []bool{false, true} {
+			vm := newTestVM(t, newTestModule(sig, nil, tt.code), gas.NewMeter(1<<20), EnableAOT(aot), WithFloatMode(CanonicalNaNs))
+			if aot && tt.native && vm.nativeBackend != nil && vm.CompileStats().NumCompiledBlocks == 0 {
+				t.Fatalf("%s: no code was compiled to native", tt.name)
+			}
+			for run := 0; run < 3; run++ {
+				res, err := vm.ExecCode(0, "", tt.args...)
+				if err != nil {
+					t.Fatalf("%s, AOT %v: %v", tt.name, aot, err)
+				}
+				got := uint64(0)
+				switch res := res.(type) {
+				case int32:
+					got = uint64(uint32(res))
+				case int64:
+					got = uint64(res)
+				}
+				if got != tt.want {
+					t.Errorf("%s, AOT %v, run %d: result = %#x, want %#x", tt.name, aot, run, got, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestRejectFloats(t *testing.T) {
+	m := newTestModule(i32Result, nil, addCode)
+	_, err := Compile(m, WithFloatMode(RejectFloats))
+	if want := (FloatOpcodeError{FuncIndex: 0, Op: ops.F64Const}); err != want {
+		t.Errorf("Compile(addCode): error = %v, want %v", err, want)
+	}
+	if _, err := Compile(m); err != nil {
+		t.Errorf("Compile(addCode) with hardware floats: %v", err)
+	}
+	if err, ok := validate.VerifyModule(m, validate.RejectFloats()).(validate.Error); !ok || err.Err != validate.FloatOpError(ops.F64Const) {
+		t.Errorf("VerifyModule(addCode): error = %v, want a %T", err, validate.FloatOpError(0))
+	}
+
+	vm := newTestVM(t, newTestModule(i32Result, nil, []byte{ops.I32Const, 4}), gas.NewMeter(1<<20), WithFloatMode(RejectFloats))
+	if res, err := vm.ExecCode(0, ""); err != nil || res != int32(4) {
+		t.Errorf("ExecCode = %v, %v, want 4", res, err)
+	}
+
+	// The operands of select have different types.
+	code := []byte{ops.I32Const, 1, ops.I64Const, 1, ops.I32Const, 1, ops.Select}
+	_, err = Compile(newTestModule(i32Result, nil, code), WithFloatMode(RejectFloats))
+	if err, ok := err.(validate.Error); !ok || err.Err != (validate.InvalidTypeError{Wanted: wasm.ValueTypeI32, Got: wasm.ValueTypeI64}) {
+		t.Errorf("Compile(mismatched select): error = %v, want an invalid type error", err)
+	}
+}
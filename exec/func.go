@@ -6,10 +6,10 @@ package exec
 
 import (
 	"fmt"
-	"math"
 	"reflect"
 
 	"github.com/Ankr-network/wagon/exec/internal/compile"
+	"github.com/Ankr-network/wagon/wasm"
 )
 
 type function interface {
@@ -20,10 +20,12 @@ type compiledFunction struct {
 	code           []byte
 	codeMeta       *compile.BytecodeMetadata
 	branchTables   []*compile.BranchTable
-	maxDepth       int  // maximum stack depth reached while executing the function body
-	totalLocalVars int  // number of local variables used by the function
-	args           int  // number of arguments the function accepts
-	returns        bool // whether the function returns a value
+	maxDepth       int // maximum stack depth reached while executing the function body
+	totalLocalVars int // number of local variables used by the function
+	args           int // number of arguments the function accepts
+	returns        int // number of values the function returns
+
+	gasBlocks map[int64]gasBlock // gas blocks, keyed by their first instruction
 
 	asm []asmBlock
 }
@@ -31,16 +33,60 @@ type compiledFunction struct {
 type asmBlock struct {
 	// Compiled unit in native machine code.
 	nativeUnit compile.NativeCodeUnit
+	// machine code of nativeUnit, kept for the compile cache.
+	code []byte
+	// where in the instruction stream native execution is entered.
+	startPC uint
 	// where in the instruction stream to resume after native execution.
 	resumePC uint
 }
 
+// hostFunction calls a host function without reflection, either because
+// it is a HostFunc, or through an adapter for its signature.
+type hostFunction struct {
+	fn      HostFunc
+	name    string
+	args    int // number of arguments the function accepts
+	returns int // number of values the function returns
+}
+
+// newHostFunction returns the function calling the host function fn.
+func newHostFunction(fn wasm.Function) function {
+	raw := asHostFunc(fn.Host)
+	if raw == nil {
+		return goFunction{typ: fn.Host.Type(), val: fn.Host, name: fn.Name}
+	}
+	return hostFunction{
+		fn:      raw,
+		name:    fn.Name,
+		args:    len(fn.Sig.ParamTypes),
+		returns: len(fn.Sig.ReturnTypes),
+	}
+}
+
+func (fn hostFunction) call(vm *VM, index int64) {
+	vm.spendGas(vm.schedule().HostCallCost())
+
+	// The arguments are passed in place, and are discarded from the stack
+	// once the function returns.
+	n := len(vm.ctx.stack) - fn.args
+	rtrns, err := fn.fn(NewProcess(vm), vm.ctx.stack[n:])
+	vm.hostReturned(fn.name, err)
+	if len(rtrns) != fn.returns {
+		vm.hostTrap(fn.name, fmt.Errorf("exec: host function returned %d values, expected %d", len(rtrns), fn.returns))
+	}
+	vm.ctx.stack = append(vm.ctx.stack[:n], rtrns...)
+}
+
 type goFunction struct {
-	val reflect.Value
-	typ reflect.Type
+	val  reflect.Value
+	typ  reflect.Type
+	name string
 }
 
 func (fn goFunction) call(vm *VM, index int64) {
+	vm.spendGas(vm.schedule().HostCallCost())
+
 	// numIn = # of call inputs + vm, as the function expects
 	// an additional *VM argument
 	numIn := fn.typ.NumIn()
@@ -50,46 +96,75 @@ func (fn goFunction) call(vm *VM, index int64) {
 	// Pass proc as an argument. Check that the function indeed
 	// expects a *Process argument.
 	if reflect.ValueOf(proc).Kind() != fn.typ.In(0).Kind() {
-		panic(fmt.Sprintf("exec: the first argument of a host function was %s, expected %s", fn.typ.In(0).Kind(), reflect.ValueOf(vm).Kind()))
+		vm.hostTrap(fn.name, fmt.Errorf("exec: the first argument of a host function was %s, expected %s", fn.typ.In(0).Kind(), reflect.ValueOf(vm).Kind()))
 	}
 	args[0] = reflect.ValueOf(proc)
 
 	for i := numIn - 1; i >= 1; i-- {
 		val := reflect.New(fn.typ.In(i)).Elem()
-		raw := vm.popUint64()
 		kind := fn.typ.In(i).Kind()
 
-		switch kind {
-		case reflect.Float64, reflect.Float32:
-			val.SetFloat(math.Float64frombits(raw))
-		case reflect.Uint32, reflect.Uint64:
-			val.SetUint(raw)
-		case reflect.Int32, reflect.Int64:
-			val.SetInt(int64(raw))
+		switch {
+		case kind == reflect.String:
+			n := vm.popUint32()
+			val.SetString(string(vm.hostBytes(vm.popUint32(), n)))
+		case isHostBytes(fn.typ.In(i)):
+			n := vm.popUint32()
+			val.SetBytes(vm.hostBytes(vm.popUint32(), n))
+		case kind == reflect.Bool:
+			val.SetBool(vm.popUint32() != 0)
+		case kind == reflect.Float32:
+			val.SetFloat(float64(vm.popFloat32()))
+		case kind == reflect.Float64:
+			val.SetFloat(vm.popFloat64())
+		case kind == reflect.Uint32, kind == reflect.Uint64:
+			val.SetUint(vm.popUint64())
+		case kind == reflect.Int32, kind == reflect.Int64:
+			val.SetInt(vm.popInt64())
 		default:
-			panic(fmt.Sprintf("exec: args %d invalid kind=%v", i, kind))
+			vm.hostTrap(fn.name, fmt.Errorf("exec: args %d invalid kind=%v", i, kind))
 		}
 
 		args[i] = val
 	}
 
 	rtrns := fn.val.Call(args)
+	// A trailing error result is not returned to the module, but traps
+	// the VM when it is not nil.
+	var err error
+	if n := len(rtrns); n > 0 && rtrns[n-1].Type() == errorType {
+		err, _ = rtrns[n-1].Interface().(error)
+		rtrns = rtrns[:n-1]
+	}
+	vm.hostReturned(fn.name, err)
 	for i, out := range rtrns {
 		kind := out.Kind()
 		switch kind {
-		case reflect.Float64, reflect.Float32:
+		case reflect.Bool:
+			vm.pushBool(out.Bool())
+		case reflect.Float32:
+			vm.pushFloat32(float32(out.Float()))
+		case reflect.Float64:
 			vm.pushFloat64(out.Float())
 		case reflect.Uint32, reflect.Uint64:
 			vm.pushUint64(out.Uint())
-		case reflect.Int32, reflect.Int64:
+		case reflect.Int32:
+			vm.pushInt32(int32(out.Int()))
+		case reflect.Int64:
 			vm.pushInt64(out.Int())
 		default:
-			panic(fmt.Sprintf("exec: return value %d invalid kind=%v", i, kind))
+			vm.hostTrap(fn.name, fmt.Errorf("exec: return value %d invalid kind=%v", i, kind))
 		}
 	}
 }
 
 func (compiled compiledFunction) call(vm *VM, index int64) {
+	vm.spendGas(vm.schedule().CallCost())
+	vm.checkCanceled()
+	if vm.callDepth >= vm.maxCallDepth {
+		vm.trap(TrapCallStackExhausted, ErrCallStackExhausted)
+	}
+
 	// Make space on the stack for all intermediate values and
 	// a possible return value.
 	newStack := make([]uint64, 0, compiled.maxDepth+1)
@@ -111,12 +186,12 @@ func (compiled compiledFunction) call(vm *VM, index int64) {
 		curFunc: index,
 	}
 
-	rtrn := vm.execCode(compiled)
+	vm.callDepth++
+	rtrns := vm.execCode(compiled)
+	vm.callDepth--
 
 	//restore execution context
 	vm.ctx = prevCtxt
 
-	if compiled.returns {
-		vm.pushUint64(rtrn)
-	}
+	vm.ctx.stack = append(vm.ctx.stack, rtrns...)
 }
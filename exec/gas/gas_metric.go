@@ -1,141 +1,144 @@
 package gas
 
 import (
-  "math/big"
-
-  "github.com/Ankr-network/wagon/exec/internal/compile"
-  ops "github.com/Ankr-network/wagon/wasm/operators"
+	"math/big"
 )
 
 const (
-  GasQuickStep    uint64 = 2
-  GasFastestStep  uint64 = 3
-  GasFastStep     uint64 = 5
-  GasMidStep      uint64 = 8
-  GasSlowStep     uint64 = 10
-  GasExtStep      uint64 = 20
-
-  GasReturn       uint64 = 0
-  GasStop         uint64 = 0
-  GasContractByte uint64 = 200
+	GasQuickStep   uint64 = 2
+	GasFastestStep uint64 = 3
+	GasFastStep    uint64 = 5
+	GasMidStep     uint64 = 8
+	GasSlowStep    uint64 = 10
+	GasExtStep     uint64 = 20
+
+	GasReturn       uint64 = 0
+	GasStop         uint64 = 0
+	GasContractByte uint64 = 200
+
+	GasCallFrame  uint64 = GasMidStep // pushing a new wasm call frame
+	GasHostCall   uint64 = GasExtStep // invoking a host function
+	GasMemoryPage uint64 = 1024       // each 64KiB page added by grow_memory
 )
 
+// GasMetric tracks the gas spent by a VM. SpendGas reports whether there
+// was enough gas left to spend gas, and must leave the metric unchanged
+// when there was not.
 type GasMetric interface {
-  SpendGas(gas *big.Int) bool
-}
-
-var OpsGasTable = map[byte]uint64{
-  ops.I32Clz : GasQuickStep,
-  ops.I32Ctz : GasQuickStep,
-  ops.I32Popcnt : GasQuickStep,
-  ops.I32Add : GasFastestStep,
-  ops.I32Sub : GasFastestStep,
-  ops.I32Mul : GasFastestStep,
-  ops.I32DivS : GasFastestStep,
-  ops.I32DivU : GasFastestStep,
-  ops.I32RemS : GasFastestStep,
-  ops.I32RemU : GasFastestStep,
-  ops.I32And : GasFastestStep,
-  ops.I32Or : GasFastestStep,
-  ops.I32Xor : GasFastestStep,
-  ops.I32Shl : GasFastestStep,
-  ops.I32ShrS : GasFastestStep,
-  ops.I32ShrU : GasFastestStep,
-  ops.I32Rotl : GasFastestStep,
-  ops.I32Rotr : GasFastestStep,
-  ops.I64Clz : GasQuickStep,
-  ops.I64Ctz : GasQuickStep,
-  ops.I64Popcnt : GasQuickStep,
-  ops.I64Add : GasFastestStep,
-  ops.I64Sub : GasFastestStep,
-  ops.I64Mul : GasFastestStep,
-  ops.I64DivS : GasFastestStep,
-  ops.I64DivU : GasFastestStep,
-  ops.I64RemS : GasFastestStep,
-  ops.I64RemU : GasFastestStep,
-  ops.I64And : GasFastestStep,
-  ops.I64Or : GasFastestStep,
-  ops.I64Xor : GasFastestStep,
-  ops.I64Shl : GasFastestStep,
-  ops.I64ShrS : GasFastestStep,
-  ops.I64ShrU : GasFastestStep,
-  ops.I64Rotl : GasFastestStep,
-  ops.I64Rotr : GasFastestStep,
-  ops.I32Eqz : GasFastestStep,
-  ops.I32Eq : GasFastestStep,
-  ops.I32Ne : GasFastestStep,
-  ops.I32LtS : GasFastestStep,
-  ops.I32LtU : GasFastestStep,
-  ops.I32GtS : GasFastestStep,
-  ops.I32GtU : GasFastestStep,
-  ops.I32LeS : GasFastestStep,
-  ops.I32LeU : GasFastestStep,
-  ops.I32GeS : GasFastestStep,
-  ops.I32GeU : GasFastestStep,
-  ops.I64Eqz : GasFastestStep,
-  ops.I64Eq : GasFastestStep,
-  ops.I64Ne : GasFastestStep,
-  ops.I64LtS : GasFastestStep,
-  ops.I64LtU : GasFastestStep,
-  ops.I64GtS : GasFastestStep,
-  ops.I64GtU : GasFastestStep,
-  ops.I64LeS : GasFastestStep,
-  ops.I64LeU : GasFastestStep,
-  ops.I64GeS : GasFastestStep,
-  ops.I64GeU : GasFastestStep,
-  ops.I32Const : GasFastestStep,
-  ops.I64Const : GasFastestStep,
-  ops.I32WrapI64 : GasFastestStep,
-  ops.I64ExtendSI32 : GasFastestStep,
-  ops.I64ExtendUI32 : GasFastestStep,
-  ops.I32Load : GasFastestStep,
-  ops.I64Load : GasFastestStep,
-  ops.I32Load8s : GasFastestStep,
-  ops.I32Load8u : GasFastestStep,
-  ops.I32Load16s : GasFastestStep,
-  ops.I32Load16u : GasFastestStep,
-  ops.I64Load8s : GasFastestStep,
-  ops.I64Load8u : GasFastestStep,
-  ops.I64Load16s : GasFastestStep,
-  ops.I64Load16u : GasFastestStep,
-  ops.I64Load32s : GasFastestStep,
-  ops.I64Load32u : GasFastestStep,
-  ops.I32Store : GasFastestStep,
-  ops.I64Store : GasFastestStep,
-  ops.I32Store8 : GasFastestStep,
-  ops.I32Store16 : GasFastestStep,
-  ops.I64Store8 : GasFastestStep,
-  ops.I64Store16 : GasFastestStep,
-  ops.I64Store32 : GasFastestStep,
-  ops.CurrentMemory : GasFastestStep,
-  ops.GrowMemory : GasFastestStep,
-  ops.Drop : GasFastestStep,
-  ops.Select : GasFastestStep,
-  ops.GetLocal : GasFastestStep,
-  ops.SetLocal : GasFastestStep,
-  ops.TeeLocal : GasFastestStep,
-  ops.GetGlobal : GasFastestStep,
-  ops.SetGlobal : GasFastestStep,
-  ops.Unreachable : GasFastestStep,
-  ops.Nop : GasFastestStep,
-  ops.Block : GasFastestStep,
-  ops.Loop : GasFastestStep,
-  ops.If : GasFastestStep,
-  ops.Else : GasFastestStep,
-  ops.End : GasFastestStep,
-  ops.Br : GasFastestStep,
-  ops.BrIf : GasFastestStep,
-  ops.BrTable : GasFastestStep,
-  ops.Return : GasFastestStep,
-  ops.Call : GasFastestStep,
-  ops.CallIndirect : GasFastestStep,
-  ops.WagonNativeExec : GasFastestStep,
-}
-
-var CompileGasTable = map[byte]uint64{
-  compile.OpJmp : GasQuickStep,
-  compile.OpJmpZ : GasQuickStep,
-  compile.OpJmpNz : GasQuickStep,
-  compile.OpDiscard : GasQuickStep,
-  compile.OpDiscardPreserveTop : GasQuickStep,
+	SpendGas(gas *big.Int) bool
+	// GasLeft returns the amount of gas that can still be spent.
+	GasLeft() uint64
+	// Refund gives back gas that was previously spent. Refunds never
+	// exceed the gas spent so far.
+	Refund(gas uint64)
+	// SubMetric returns a metric that spends from this one, but never
+	// more than limit in total. It is meant to cap the gas available to
+	// a nested invocation. NewSubMetric implements it for any GasMetric.
+	SubMetric(limit uint64) GasMetric
+}
+
+// Uint64GasMetric is implemented by GasMetrics that can spend gas without
+// going through a big.Int. The VM uses it in preference to SpendGas.
+type Uint64GasMetric interface {
+	SpendGasUint64(gas uint64) bool
+}
+
+// Meter is a GasMetric with a fixed gas limit.
+type Meter struct {
+	limit, used uint64
+}
+
+// NewMeter returns a Meter allowing up to limit gas to be spent.
+func NewMeter(limit uint64) *Meter {
+	return &Meter{limit: limit}
+}
+
+// Used returns the amount of gas spent so far.
+func (m *Meter) Used() uint64 {
+	return m.used
+}
+
+func (m *Meter) SpendGas(gas *big.Int) bool {
+	if !gas.IsUint64() {
+		return false
+	}
+	return m.SpendGasUint64(gas.Uint64())
+}
+
+func (m *Meter) SpendGasUint64(gas uint64) bool {
+	if gas > m.GasLeft() {
+		return false
+	}
+	m.used += gas
+	return true
+}
+
+func (m *Meter) GasLeft() uint64 {
+	return m.limit - m.used
+}
+
+func (m *Meter) Refund(gas uint64) {
+	if gas > m.used {
+		gas = m.used
+	}
+	m.used -= gas
+}
+
+func (m *Meter) SubMetric(limit uint64) GasMetric {
+	return NewSubMetric(m, limit)
+}
+
+// subMetric spends gas from its parent, up to a limit of its own.
+type subMetric struct {
+	parent GasMetric
+	Meter
+}
+
+// NewSubMetric returns a GasMetric that spends gas from parent, but never
+// more than limit in total. Gas refunded to it is refunded to parent.
+func NewSubMetric(parent GasMetric, limit uint64) GasMetric {
+	return &subMetric{parent: parent, Meter: Meter{limit: limit}}
+}
+
+func (m *subMetric) SpendGas(gas *big.Int) bool {
+	if !gas.IsUint64() {
+		return false
+	}
+	return m.SpendGasUint64(gas.Uint64())
+}
+
+func (m *subMetric) SpendGasUint64(gas uint64) bool {
+	if gas > m.Meter.GasLeft() {
+		return false
+	}
+	var ok bool
+	if p, isUint64 := m.parent.(Uint64GasMetric); isUint64 {
+		ok = p.SpendGasUint64(gas)
+	} else {
+		ok = m.parent.SpendGas(new(big.Int).SetUint64(gas))
+	}
+	if ok {
+		m.used += gas
+	}
+	return ok
+}
+
+func (m *subMetric) GasLeft() uint64 {
+	left := m.Meter.GasLeft()
+	if p := m.parent.GasLeft(); p < left {
+		return p
+	}
+	return left
+}
+
+func (m *subMetric) Refund(gas uint64) {
+	if gas > m.used {
+		gas = m.used
+	}
+	m.used -= gas
+	m.parent.Refund(gas)
+}
+
+func (m *subMetric) SubMetric(limit uint64) GasMetric {
+	return NewSubMetric(m, limit)
 }
@@ -0,0 +1,62 @@
+package gas
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestMeter(t *testing.T) {
+	m := NewMeter(100)
+	if !m.SpendGas(big.NewInt(60)) {
+		t.Fatal("could not spend 60 gas out of 100")
+	}
+	if m.SpendGasUint64(41) {
+		t.Fatal("spent 41 gas with 40 left")
+	}
+	if m.Used() != 60 || m.GasLeft() != 40 {
+		t.Fatalf("used %d, left %d; want 60, 40", m.Used(), m.GasLeft())
+	}
+	m.Refund(1000)
+	if m.Used() != 0 || m.GasLeft() != 100 {
+		t.Fatalf("refund: used %d, left %d; want 0, 100", m.Used(), m.GasLeft())
+	}
+}
+
+func TestSubMetric(t *testing.T) {
+	parent := NewMeter(100)
+	parent.SpendGasUint64(50)
+
+	sub := parent.SubMetric(30)
+	if sub.GasLeft() != 30 {
+		t.Fatalf("sub metric has %d gas left, want 30", sub.GasLeft())
+	}
+	if !sub.SpendGas(big.NewInt(20)) {
+		t.Fatal("could not spend 20 gas out of 30")
+	}
+	if sub.SpendGas(big.NewInt(11)) {
+		t.Fatal("spent beyond the sub metric's limit")
+	}
+	if parent.Used() != 70 {
+		t.Fatalf("parent used %d gas, want 70", parent.Used())
+	}
+
+	sub.Refund(15)
+	if parent.Used() != 55 || sub.GasLeft() != 25 {
+		t.Fatalf("refund: parent used %d, sub left %d; want 55, 25", parent.Used(), sub.GasLeft())
+	}
+	// Refunds never exceed what the sub metric spent.
+	sub.Refund(100)
+	if parent.Used() != 50 {
+		t.Fatalf("parent used %d gas, want 50", parent.Used())
+	}
+
+	// A sub metric never has more gas left than its parent.
+	parent.SpendGasUint64(45)
+	if sub.GasLeft() != 5 {
+		t.Fatalf("sub metric has %d gas left, want 5", sub.GasLeft())
+	}
+	nested := sub.SubMetric(100)
+	if nested.GasLeft() != 5 || nested.SpendGas(big.NewInt(6)) {
+		t.Fatal("nested sub metric exceeded its parent's gas")
+	}
+}
@@ -0,0 +1,313 @@
+package gas
+
+import ops "github.com/Ankr-network/wagon/wasm/operators"
+
+// GasSchedule prices the execution of a VM. A VM consults its schedule
+// for every instruction it executes, so different VMs in the same process
+// can run under different prices.
+type GasSchedule interface {
+	// ScheduleVersion identifies the set of prices.
+	ScheduleVersion() uint32
+	// Cost returns the price of op as it appears in compiled bytecode,
+	// where it is either a wasm opcode or, if IsCompiledOp reports so, a
+	// pseudo opcode such as OpJmp, and whether op is priced at all.
+	Cost(op byte) (uint64, bool)
+	// GrowMemoryCost returns the price of growing the linear memory by
+	// the given number of pages.
+	GrowMemoryCost(pages uint32) uint64
+	// CallCost returns the price of pushing a wasm call frame.
+	CallCost() uint64
+	// HostCallCost returns the price of invoking a host function.
+	HostCallCost() uint64
+}
+
+// The pseudo opcodes emitted by the compiler in place of structured
+// control flow, as they are passed to GasSchedule.Cost and priced by
+// Schedule.CompiledOps. Their values are those of wasm opcodes, which
+// never appear in compiled bytecode, and are kept in sync with the
+// compiler by the tests of the package.
+const (
+	// OpJmp unconditionally jumps, for br and the end of if blocks.
+	OpJmp byte = 0x0c
+	// OpJmpZ jumps if the value at the top of the stack is zero, for if.
+	OpJmpZ byte = 0x03
+	// OpJmpNz jumps if the value at the top of the stack is not zero, for
+	// br_if.
+	OpJmpNz byte = 0x0d
+	// OpDiscard discards values from the stack when leaving a block.
+	OpDiscard byte = 0x0b
+	// OpDiscardPreserveTop discards values from the stack, preserving the
+	// value at its top.
+	OpDiscardPreserveTop byte = 0x05
+	// OpDiscardPreserve discards values from the stack, preserving a
+	// number of values at its top.
+	OpDiscardPreserve byte = 0x02
+)
+
+// Schedule is a GasSchedule backed by price tables. Every opcode a VM
+// executes must be priced by the schedule it runs under; modules using an
+// opcode the schedule does not price are rejected when the VM is created.
+type Schedule struct {
+	// Version identifies the schedule, so that prices can change
+	// without altering the cost of transactions run under older versions.
+	Version uint32
+
+	// Ops holds the cost of each WebAssembly opcode.
+	Ops map[byte]uint64
+	// CompiledOps holds the cost of the pseudo opcodes emitted by the
+	// compiler in place of structured control flow, keyed by OpJmp,
+	// OpJmpZ, OpJmpNz, OpDiscard, OpDiscardPreserveTop and
+	// OpDiscardPreserve.
+	CompiledOps map[byte]uint64
+
+	GrowMemoryPerPage uint64 // charged for every page added by grow_memory
+	CallPerFrame      uint64 // charged for every wasm call frame pushed by call/call_indirect
+	HostCallPerCall   uint64 // charged for every host function invocation
+}
+
+// ScheduleV1 returns a new copy of the version 1 gas schedule, which the
+// caller is free to modify.
+func ScheduleV1() *Schedule {
+	return &Schedule{
+		Version:           1,
+		Ops:               v1OpsGasTable(),
+		CompiledOps:       v1CompileGasTable(),
+		GrowMemoryPerPage: GasMemoryPage,
+		CallPerFrame:      GasCallFrame,
+		HostCallPerCall:   GasHostCall,
+	}
+}
+
+// IsCompiledOp reports whether op, as it appears in compiled bytecode, is
+// one of the pseudo opcodes priced by CompiledOps, such as OpJmp.
+func IsCompiledOp(op byte) bool {
+	switch op {
+	case OpJmp, OpJmpZ, OpJmpNz, OpDiscard, OpDiscardPreserveTop, OpDiscardPreserve:
+		return true
+	}
+	return false
+}
+
+// ScheduleVersion implements GasSchedule.
+func (s *Schedule) ScheduleVersion() uint32 {
+	return s.Version
+}
+
+// Cost implements GasSchedule.
+func (s *Schedule) Cost(op byte) (uint64, bool) {
+	if IsCompiledOp(op) {
+		cost, ok := s.CompiledOps[op]
+		return cost, ok
+	}
+	cost, ok := s.Ops[op]
+	return cost, ok
+}
+
+// GrowMemoryCost implements GasSchedule.
+func (s *Schedule) GrowMemoryCost(pages uint32) uint64 {
+	return uint64(pages) * s.GrowMemoryPerPage
+}
+
+// CallCost implements GasSchedule.
+func (s *Schedule) CallCost() uint64 {
+	return s.CallPerFrame
+}
+
+// HostCallCost implements GasSchedule.
+func (s *Schedule) HostCallCost() uint64 {
+	return s.HostCallPerCall
+}
+
+func v1OpsGasTable() map[byte]uint64 {
+	return map[byte]uint64{
+		ops.I32Clz:    GasQuickStep,
+		ops.I32Ctz:    GasQuickStep,
+		ops.I32Popcnt: GasQuickStep,
+		ops.I32Add:    GasFastestStep,
+		ops.I32Sub:    GasFastestStep,
+		ops.I32Mul:    GasFastestStep,
+		ops.I32DivS:   GasFastestStep,
+		ops.I32DivU:   GasFastestStep,
+		ops.I32RemS:   GasFastestStep,
+		ops.I32RemU:   GasFastestStep,
+		ops.I32And:    GasFastestStep,
+		ops.I32Or:     GasFastestStep,
+		ops.I32Xor:    GasFastestStep,
+		ops.I32Shl:    GasFastestStep,
+		ops.I32ShrS:   GasFastestStep,
+		ops.I32ShrU:   GasFastestStep,
+		ops.I32Rotl:   GasFastestStep,
+		ops.I32Rotr:   GasFastestStep,
+		ops.I64Clz:    GasQuickStep,
+		ops.I64Ctz:    GasQuickStep,
+		ops.I64Popcnt: GasQuickStep,
+		ops.I64Add:    GasFastestStep,
+		ops.I64Sub:    GasFastestStep,
+		ops.I64Mul:    GasFastestStep,
+		ops.I64DivS:   GasFastestStep,
+		ops.I64DivU:   GasFastestStep,
+		ops.I64RemS:   GasFastestStep,
+		ops.I64RemU:   GasFastestStep,
+		ops.I64And:    GasFastestStep,
+		ops.I64Or:     GasFastestStep,
+		ops.I64Xor:    GasFastestStep,
+		ops.I64Shl:    GasFastestStep,
+		ops.I64ShrS:   GasFastestStep,
+		ops.I64ShrU:   GasFastestStep,
+		ops.I64Rotl:   GasFastestStep,
+		ops.I64Rotr:   GasFastestStep,
+		ops.I32Eqz:    GasFastestStep,
+		ops.I32Eq:     GasFastestStep,
+		ops.I32Ne:     GasFastestStep,
+		ops.I32LtS:    GasFastestStep,
+		ops.I32LtU:    GasFastestStep,
+		ops.I32GtS:    GasFastestStep,
+		ops.I32GtU:    GasFastestStep,
+		ops.I32LeS:    GasFastestStep,
+		ops.I32LeU:    GasFastestStep,
+		ops.I32GeS:    GasFastestStep,
+		ops.I32GeU:    GasFastestStep,
+		ops.I64Eqz:    GasFastestStep,
+		ops.I64Eq:     GasFastestStep,
+		ops.I64Ne:     GasFastestStep,
+		ops.I64LtS:    GasFastestStep,
+		ops.I64LtU:    GasFastestStep,
+		ops.I64GtS:    GasFastestStep,
+		ops.I64GtU:    GasFastestStep,
+		ops.I64LeS:    GasFastestStep,
+		ops.I64LeU:    GasFastestStep,
+		ops.I64GeS:    GasFastestStep,
+		ops.I64GeU:    GasFastestStep,
+
+		ops.F32Abs:      GasFastStep,
+		ops.F32Neg:      GasFastStep,
+		ops.F32Ceil:     GasFastStep,
+		ops.F32Floor:    GasFastStep,
+		ops.F32Trunc:    GasFastStep,
+		ops.F32Nearest:  GasFastStep,
+		ops.F32Sqrt:     GasMidStep,
+		ops.F32Add:      GasFastStep,
+		ops.F32Sub:      GasFastStep,
+		ops.F32Mul:      GasFastStep,
+		ops.F32Div:      GasMidStep,
+		ops.F32Min:      GasFastStep,
+		ops.F32Max:      GasFastStep,
+		ops.F32Copysign: GasFastStep,
+		ops.F64Abs:      GasFastStep,
+		ops.F64Neg:      GasFastStep,
+		ops.F64Ceil:     GasFastStep,
+		ops.F64Floor:    GasFastStep,
+		ops.F64Trunc:    GasFastStep,
+		ops.F64Nearest:  GasFastStep,
+		ops.F64Sqrt:     GasMidStep,
+		ops.F64Add:      GasFastStep,
+		ops.F64Sub:      GasFastStep,
+		ops.F64Mul:      GasFastStep,
+		ops.F64Div:      GasMidStep,
+		ops.F64Min:      GasFastStep,
+		ops.F64Max:      GasFastStep,
+		ops.F64Copysign: GasFastStep,
+		ops.F32Eq:       GasFastStep,
+		ops.F32Ne:       GasFastStep,
+		ops.F32Lt:       GasFastStep,
+		ops.F32Gt:       GasFastStep,
+		ops.F32Le:       GasFastStep,
+		ops.F32Ge:       GasFastStep,
+		ops.F64Eq:       GasFastStep,
+		ops.F64Ne:       GasFastStep,
+		ops.F64Lt:       GasFastStep,
+		ops.F64Gt:       GasFastStep,
+		ops.F64Le:       GasFastStep,
+		ops.F64Ge:       GasFastStep,
+
+		ops.I32Const: GasFastestStep,
+		ops.I64Const: GasFastestStep,
+		ops.F32Const: GasFastestStep,
+		ops.F64Const: GasFastestStep,
+
+		ops.I32WrapI64:     GasFastestStep,
+		ops.I64ExtendSI32:  GasFastestStep,
+		ops.I64ExtendUI32:  GasFastestStep,
+		ops.I32TruncSF32:   GasFastStep,
+		ops.I32TruncUF32:   GasFastStep,
+		ops.I32TruncSF64:   GasFastStep,
+		ops.I32TruncUF64:   GasFastStep,
+		ops.I64TruncSF32:   GasFastStep,
+		ops.I64TruncUF32:   GasFastStep,
+		ops.I64TruncSF64:   GasFastStep,
+		ops.I64TruncUF64:   GasFastStep,
+		ops.F32ConvertSI32: GasFastStep,
+		ops.F32ConvertUI32: GasFastStep,
+		ops.F32ConvertSI64: GasFastStep,
+		ops.F32ConvertUI64: GasFastStep,
+		ops.F32DemoteF64:   GasFastStep,
+		ops.F64ConvertSI32: GasFastStep,
+		ops.F64ConvertUI32: GasFastStep,
+		ops.F64ConvertSI64: GasFastStep,
+		ops.F64ConvertUI64: GasFastStep,
+		ops.F64PromoteF32:  GasFastStep,
+
+		ops.I32ReinterpretF32: GasQuickStep,
+		ops.I64ReinterpretF64: GasQuickStep,
+		ops.F32ReinterpretI32: GasQuickStep,
+		ops.F64ReinterpretI64: GasQuickStep,
+
+		ops.I32Load:       GasFastestStep,
+		ops.I64Load:       GasFastestStep,
+		ops.F32Load:       GasFastestStep,
+		ops.F64Load:       GasFastestStep,
+		ops.I32Load8s:     GasFastestStep,
+		ops.I32Load8u:     GasFastestStep,
+		ops.I32Load16s:    GasFastestStep,
+		ops.I32Load16u:    GasFastestStep,
+		ops.I64Load8s:     GasFastestStep,
+		ops.I64Load8u:     GasFastestStep,
+		ops.I64Load16s:    GasFastestStep,
+		ops.I64Load16u:    GasFastestStep,
+		ops.I64Load32s:    GasFastestStep,
+		ops.I64Load32u:    GasFastestStep,
+		ops.I32Store:      GasFastestStep,
+		ops.I64Store:      GasFastestStep,
+		ops.F32Store:      GasFastestStep,
+		ops.F64Store:      GasFastestStep,
+		ops.I32Store8:     GasFastestStep,
+		ops.I32Store16:    GasFastestStep,
+		ops.I64Store8:     GasFastestStep,
+		ops.I64Store16:    GasFastestStep,
+		ops.I64Store32:    GasFastestStep,
+		ops.CurrentMemory: GasFastestStep,
+		ops.GrowMemory:    GasFastestStep,
+
+		ops.Drop:         GasFastestStep,
+		ops.Select:       GasFastestStep,
+		ops.GetLocal:     GasFastestStep,
+		ops.SetLocal:     GasFastestStep,
+		ops.TeeLocal:     GasFastestStep,
+		ops.GetGlobal:    GasFastestStep,
+		ops.SetGlobal:    GasFastestStep,
+		ops.Unreachable:  GasFastestStep,
+		ops.Nop:          GasFastestStep,
+		ops.Block:        GasFastestStep,
+		ops.Loop:         GasFastestStep,
+		ops.If:           GasFastestStep,
+		ops.Else:         GasFastestStep,
+		ops.End:          GasFastestStep,
+		ops.Br:           GasFastestStep,
+		ops.BrIf:         GasFastestStep,
+		ops.BrTable:      GasFastestStep,
+		ops.Return:       GasFastestStep,
+		ops.Call:         GasFastestStep,
+		ops.CallIndirect: GasFastestStep,
+	}
+}
+
+func v1CompileGasTable() map[byte]uint64 {
+	return map[byte]uint64{
+		OpJmp:                GasQuickStep,
+		OpJmpZ:               GasQuickStep,
+		OpJmpNz:              GasQuickStep,
+		OpDiscard:            GasQuickStep,
+		OpDiscardPreserveTop: GasQuickStep,
+		OpDiscardPreserve:    GasQuickStep,
+	}
+}
@@ -0,0 +1,72 @@
+package gas
+
+import (
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/internal/compile"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+func TestScheduleV1PricesEveryOpcode(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		op, err := ops.New(byte(i))
+		if err != nil {
+			continue
+		}
+		if _, ok := ScheduleV1().Ops[op.Code]; !ok {
+			t.Errorf("opcode %s (%#x) is not priced", op.Name, op.Code)
+		}
+	}
+
+	for _, op := range []byte{ops.F32Add, ops.F64Div, ops.F64ReinterpretI64, ops.I32TruncSF64, ops.F32Load} {
+		if cost, _ := ScheduleV1().Cost(op); cost == 0 {
+			t.Errorf("floating point opcode %#x is free", op)
+		}
+	}
+}
+
+func TestScheduleCost(t *testing.T) {
+	s := &Schedule{
+		Ops:         map[byte]uint64{ops.Br: 7, ops.I32Add: 1},
+		CompiledOps: map[byte]uint64{},
+	}
+
+	// OpJmp shares its value with br, but must be priced
+	// through CompiledOps.
+	if _, ok := s.Cost(ops.Br); ok {
+		t.Error("compiled jump priced through Ops")
+	}
+	if cost, ok := s.Cost(ops.I32Add); !ok || cost != 1 {
+		t.Errorf("Cost(i32.add) = %d, %v; want 1, true", cost, ok)
+	}
+	if _, ok := s.Cost(ops.I64Add); ok {
+		t.Error("Cost(i64.add) reported as priced")
+	}
+}
+
+func TestCompiledOps(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		op, inner byte
+	}{
+		{"OpJmp", OpJmp, compile.OpJmp},
+		{"OpJmpZ", OpJmpZ, compile.OpJmpZ},
+		{"OpJmpNz", OpJmpNz, compile.OpJmpNz},
+		{"OpDiscard", OpDiscard, compile.OpDiscard},
+		{"OpDiscardPreserveTop", OpDiscardPreserveTop, compile.OpDiscardPreserveTop},
+		{"OpDiscardPreserve", OpDiscardPreserve, compile.OpDiscardPreserve},
+	} {
+		if tc.op != tc.inner {
+			t.Errorf("%s = %#x, but the compiler emits %#x", tc.name, tc.op, tc.inner)
+		}
+		if !IsCompiledOp(tc.op) {
+			t.Errorf("IsCompiledOp(%s) = false", tc.name)
+		}
+		if _, ok := ScheduleV1().CompiledOps[tc.op]; !ok {
+			t.Errorf("%s is not priced by ScheduleV1", tc.name)
+		}
+	}
+	if n := len(ScheduleV1().CompiledOps); n != 6 {
+		t.Errorf("ScheduleV1 prices %d compiled opcodes, want 6", n)
+	}
+}
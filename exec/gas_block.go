@@ -0,0 +1,196 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/exec/internal/compile"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+// Gas is charged once per basic block, on entry, rather than once per
+// instruction. To keep the result identical to per-instruction metering,
+// a block ends after any instruction that may transfer control, trap, or
+// charge dynamic gas (calls and grow_memory): the instructions of a block
+// are then either all executed, or the block is left because its last
+// instruction trapped, at which point per-instruction metering would have
+// charged exactly the same amount.
+// When the whole block cannot be paid for, its instructions are charged
+// one by one, and the VM traps once it reaches the first instruction it
+// could not pay for.
+// Instructions replaced by native code are charged as if they had been
+// interpreted. Native units never span more than one block, and only
+// their last instruction may have effects outside the call frame, so
+// the VM traps on entry to a native unit it cannot fully pay for. The
+// trap still reports the first instruction that could not be paid for,
+// so that it does not depend on whether native code is enabled.
+
+// gasInst is the cost of a single instruction.
+type gasInst struct {
+	start  int64 // offset of the instruction in the bytecode
+	trapAt int64 // offset at which to trap if the instruction cannot be paid for
+	cost   uint64
+}
+
+// gasBlock is a run of instructions whose cost is charged at once.
+type gasBlock struct {
+	cost  uint64    // total cost of the block
+	end   int64     // offset of the first instruction after the block
+	insts []gasInst // the instructions of the block, in order
+}
+
+// endsGasBlock maps the opcodes of compiled bytecode that terminate a
+// basic block.
+var endsGasBlock [256]bool
+
+func init() {
+	for _, op := range []byte{
+		compile.OpJmp, compile.OpJmpZ, compile.OpJmpNz, ops.BrTable, ops.Return,
+		ops.Call, ops.CallIndirect, ops.GrowMemory, ops.Unreachable,
+
+		ops.I32Load, ops.I64Load, ops.F32Load, ops.F64Load,
+		ops.I32Load8s, ops.I32Load8u, ops.I32Load16s, ops.I32Load16u,
+		ops.I64Load8s, ops.I64Load8u, ops.I64Load16s, ops.I64Load16u, ops.I64Load32s, ops.I64Load32u,
+		ops.I32Store, ops.I64Store, ops.F32Store, ops.F64Store,
+		ops.I32Store8, ops.I32Store16, ops.I64Store8, ops.I64Store16, ops.I64Store32,
+
+		ops.I32DivS, ops.I32DivU, ops.I32RemS, ops.I32RemU,
+		ops.I64DivS, ops.I64DivU, ops.I64RemS, ops.I64RemU,
+		ops.I32TruncSF32, ops.I32TruncUF32, ops.I32TruncSF64, ops.I32TruncUF64,
+		ops.I64TruncSF32, ops.I64TruncUF32, ops.I64TruncSF64, ops.I64TruncUF64,
+	} {
+		endsGasBlock[op] = true
+	}
+}
+
+// buildGasBlocks splits the bytecode of a compiled function into gas
+// blocks, keyed by the offset of their first instruction. It must be
+// called after native compilation, so that native units are known.
+func buildGasBlocks(schedule gas.GasSchedule, fnIndex int, fn compiledFunction) (map[int64]gasBlock, error) {
+	insts := make([]gasInst, 0, len(fn.codeMeta.Instructions)+1)
+	leaders := make(map[int64]bool, len(fn.codeMeta.InboundTargets)+1)
+	leaders[0] = true
+	for target := range fn.codeMeta.InboundTargets {
+		leaders[target] = true
+	}
+
+	addInst := func(op byte, start, trapAt int64) error {
+		cost, ok := schedule.Cost(op)
+		if !ok {
+			return UnpricedOpcodeError{FuncIndex: fnIndex, Op: op, Version: schedule.ScheduleVersion()}
+		}
+		insts = append(insts, gasInst{start: start, trapAt: trapAt, cost: cost})
+		return nil
+	}
+
+	native := make(map[int64]int64, len(fn.asm)) // native units, start to end
+	for _, block := range fn.asm {
+		native[int64(block.startPC)] = int64(block.resumePC)
+	}
+
+	var nativeStart, nativeEnd int64
+	for _, inst := range fn.codeMeta.Instructions {
+		start := int64(inst.Start)
+		if end, ok := native[start]; ok {
+			nativeStart, nativeEnd = start, end
+		}
+		trapAt := start
+		if start < nativeEnd {
+			trapAt = nativeStart
+		}
+		if err := addInst(inst.Op, start, trapAt); err != nil {
+			return nil, err
+		}
+		if endsGasBlock[inst.Op] {
+			leaders[start+int64(inst.Size)] = true
+		}
+	}
+	// Compile terminates every function with a nop, which has no metadata.
+	end := int64(len(fn.code) - 1)
+	if err := addInst(ops.Nop, end, end); err != nil {
+		return nil, err
+	}
+
+	blocks := make(map[int64]gasBlock)
+	for i := 0; i < len(insts); {
+		j := i + 1
+		for j < len(insts) && !leaders[insts[j].start] {
+			j++
+		}
+		block := gasBlock{insts: insts[i:j:j], end: int64(len(fn.code))}
+		if j < len(insts) {
+			block.end = insts[j].start
+		}
+		for _, inst := range block.insts {
+			block.cost += inst.cost
+		}
+		blocks[insts[i].start] = block
+		i = j
+	}
+	return blocks, nil
+}
+
+// chargeGasBlock charges the gas for the block starting at pc. It returns
+// the offset at which the next block starts, and the first instruction
+// that could not be paid for, or nil if the whole block was.
+func (vm *VM) chargeGasBlock(blocks map[int64]gasBlock, pc int64) (end int64, unpaid *gasInst) {
+	block, ok := blocks[pc]
+	if !ok {
+		panic(fmt.Sprintf("exec: no gas block starts at pc %d of function %d", pc, vm.ctx.curFunc))
+	}
+	if vm.trySpendGas(block.cost) {
+		return block.end, nil
+	}
+	for i := range block.insts {
+		inst := &block.insts[i]
+		if !vm.trySpendGas(inst.cost) {
+			if inst.trapAt == pc {
+				vm.outOfGasAt(inst)
+			}
+			return inst.trapAt, inst
+		}
+	}
+	return block.end, nil
+}
+
+// schedule returns the gas schedule of the VM, or the default schedule
+// if the VM was built without one.
+func (vm *VM) schedule() gas.GasSchedule {
+	if vm.gasSchedule == nil {
+		return defaultGasSchedule
+	}
+	return vm.gasSchedule
+}
+
+// trySpendGas charges cost units of gas to the VM's gas metric, and
+// reports whether there was enough gas left to do so.
+func (vm *VM) trySpendGas(cost uint64) bool {
+	metric := vm.vmContext.gasMetric
+	if m, ok := metric.(gas.Uint64GasMetric); ok {
+		return m.SpendGasUint64(cost)
+	}
+	return metric.SpendGas(new(big.Int).SetUint64(cost))
+}
+
+// spendGas charges cost units of gas to the VM's gas metric, trapping
+// the VM if there is not enough gas left.
+func (vm *VM) spendGas(cost uint64) {
+	if !vm.trySpendGas(cost) {
+		vm.outOfGas()
+	}
+}
+
+func (vm *VM) outOfGas() {
+	vm.trap(TrapOutOfGas, ErrOutOfGas)
+}
+
+// outOfGasAt traps the VM on reaching inst, the first instruction of a
+// gas block that could not be paid for.
+func (vm *VM) outOfGasAt(inst *gasInst) {
+	vm.trapAt(TrapOutOfGas, ErrOutOfGas, inst.start)
+}
@@ -0,0 +1,304 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+// newTestModule returns a module holding a single function, exported
+// as "main", with the given signature, local variables and body.
+func newTestModule(sig wasm.FunctionSig, locals []wasm.LocalEntry, code []byte) *wasm.Module {
+	m := wasm.NewModule()
+	m.Start = nil
+	m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+	m.Function = &wasm.SectionFunctions{Types: []uint32{0}}
+	body := wasm.FunctionBody{Module: m, Locals: locals, Code: code}
+	m.Code = &wasm.SectionCode{Bodies: []wasm.FunctionBody{body}}
+	m.FunctionIndexSpace = []wasm.Function{{Sig: &m.Types.Entries[0], Body: &m.Code.Bodies[0], Name: "main"}}
+	m.Export = &wasm.SectionExports{
+		Entries: map[string]wasm.ExportEntry{
+			"main": {FieldStr: "main", Kind: wasm.ExternalFunction, Index: 0},
+		},
+	}
+	return m
+}
+
+func newTestVM(t *testing.T, m *wasm.Module, metric gas.GasMetric, opts ...VMOption) *VM {
+	t.Helper()
+	vm, err := NewVM("contract", "owner", "caller", metric, nil, m, opts...)
+	if err != nil {
+		t.Fatalf("NewVM: %v", err)
+	}
+	return vm
+}
+
+// addCode computes 1.5 + 2.5 in f64 and truncates the result to i32.
+var addCode = []byte{
+	ops.F64Const, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f,
+	ops.F64Const, 0, 0, 0, 0, 0, 0, 0x04, 0x40,
+	ops.F64Add,
+	ops.I32TruncSF64,
+}
+
+var i32Result = wasm.FunctionSig{Form: 0, ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32}}
+
+func TestGasFloatOpsAreCharged(t *testing.T) {
+	metric := gas.NewMeter(1 << 20)
+	vm := newTestVM(t, newTestModule(i32Result, nil, addCode), metric)
+
+	res, err := vm.ExecCode(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.(int32) != 4 {
+		t.Fatalf("got %v, want 4", res)
+	}
+
+	s := gas.ScheduleV1()
+	want := 2*s.Ops[ops.F64Const] + s.Ops[ops.F64Add] + s.Ops[ops.I32TruncSF64] + s.Ops[ops.Nop]
+	if metric.Used() != want {
+		t.Fatalf("used %d gas, want %d", metric.Used(), want)
+	}
+}
+
+func TestGasUnpricedOpcodeRejected(t *testing.T) {
+	s := gas.ScheduleV1()
+	s.Version = 99
+	delete(s.Ops, ops.F64Add)
+
+	_, err := NewVM("contract", "owner", "caller", gas.NewMeter(0), nil, newTestModule(i32Result, nil, addCode), WithGasSchedule(s))
+	want := UnpricedOpcodeError{FuncIndex: 0, Op: ops.F64Add, Version: 99}
+	if err != want {
+		t.Fatalf("NewVM error = %v, want %v", err, want)
+	}
+}
+
+func TestGasScheduleOption(t *testing.T) {
+	s := gas.ScheduleV1()
+	for op := range s.Ops {
+		s.Ops[op] = 1
+	}
+	for op := range s.CompiledOps {
+		s.CompiledOps[op] = 1
+	}
+
+	metric := gas.NewMeter(1 << 20)
+	vm := newTestVM(t, newTestModule(i32Result, nil, addCode), metric, WithGasSchedule(s))
+	if _, err := vm.ExecCode(0, ""); err != nil {
+		t.Fatal(err)
+	}
+	// f64.const, f64.const, f64.add, i32.trunc_s/f64 and the trailing nop.
+	if metric.Used() != 5 {
+		t.Fatalf("used %d gas, want 5", metric.Used())
+	}
+
+	// The default schedule must not be affected.
+	metric = gas.NewMeter(1 << 20)
+	vm = newTestVM(t, newTestModule(i32Result, nil, addCode), metric)
+	if _, err := vm.ExecCode(0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if metric.Used() == 5 {
+		t.Fatal("default schedule was modified")
+	}
+}
+
+// countdownCode decrements its argument until it reaches zero:
+//
+//	loop
+//	  get_local 0
+//	  i32.const 1
+//	  i32.sub
+//	  tee_local 0
+//	  br_if 0
+//	end
+//	get_local 0
+var countdownCode = []byte{
+	ops.Loop, 0x40,
+	ops.GetLocal, 0,
+	ops.I32Const, 1,
+	ops.I32Sub,
+	ops.TeeLocal, 0,
+	ops.BrIf, 0,
+	ops.End,
+	ops.GetLocal, 0,
+}
+
+var i32ToI32 = wasm.FunctionSig{
+	Form:        0,
+	ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32},
+	ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32},
+}
+
+func TestGasBlockMeteringMatchesPerInstruction(t *testing.T) {
+	// The cost of every instruction executed by countdown(3), in order,
+	// as charged by per-instruction metering.
+	var trace []uint64
+	for i := 0; i < 3; i++ {
+		trace = append(trace, gas.GasFastestStep, gas.GasFastestStep, gas.GasFastestStep, gas.GasFastestStep, gas.GasQuickStep)
+	}
+	trace = append(trace, gas.GasFastestStep, gas.GasFastestStep)
+
+	var total uint64
+	for _, cost := range trace {
+		total += cost
+	}
+
+	vm := newTestVM(t, newTestModule(i32ToI32, nil, countdownCode), gas.NewMeter(0))
+	vm.RecoverPanic = true
+	for limit := uint64(0); limit <= total+1; limit++ {
+		// Per-instruction metering spends gas until the first
+		// instruction it cannot pay for.
+		var want uint64
+		for _, cost := range trace {
+			if want+cost > limit {
+				break
+			}
+			want += cost
+		}
+
+		metric := gas.NewMeter(limit)
+		vm.vmContext.SetGasMetric(metric)
+		_, err := vm.ExecCode(0, "", 3)
+		if (err != nil) != (limit < total) {
+			t.Fatalf("limit=%d: unexpected error %v", limit, err)
+		}
+		if metric.Used() != want {
+			t.Fatalf("limit=%d: used %d gas, want %d", limit, metric.Used(), want)
+		}
+	}
+}
+
+// countingMeter counts the calls to SpendGas.
+type countingMeter struct {
+	*gas.Meter
+	bigCalls int
+}
+
+func (m *countingMeter) SpendGas(g *big.Int) bool {
+	m.bigCalls++
+	return m.Meter.SpendGas(g)
+}
+
+func TestGasUint64FastPath(t *testing.T) {
+	metric := &countingMeter{Meter: gas.NewMeter(1 << 20)}
+	vm := newTestVM(t, newTestModule(i32ToI32, nil, countdownCode), metric)
+	res, err := vm.ExecCode(0, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.(int32) != 0 {
+		t.Fatalf("got %v, want 0", res)
+	}
+	if metric.bigCalls != 0 {
+		t.Fatalf("SpendGas called %d times, want 0", metric.bigCalls)
+	}
+	if want := 10*(4*gas.GasFastestStep+gas.GasQuickStep) + 2*gas.GasFastestStep; metric.Used() != want {
+		t.Fatalf("used %d gas, want %d", metric.Used(), want)
+	}
+}
+
+// arithCode computes ((x + 1) * 3) - x + 7 on its i64 argument x, using a
+// local variable for the intermediate result.
+var arithCode = []byte{
+	ops.GetLocal, 0,
+	ops.I64Const, 1,
+	ops.I64Add,
+	ops.I64Const, 3,
+	ops.I64Mul,
+	ops.SetLocal, 1,
+	ops.GetLocal, 1,
+	ops.GetLocal, 0,
+	ops.I64Sub,
+	ops.I64Const, 7,
+	ops.I64Add,
+}
+
+var i64ToI64 = wasm.FunctionSig{
+	Form:        0,
+	ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64},
+	ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+}
+
+func TestGasNativeMatchesInterpreter(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	locals := []wasm.LocalEntry{{Count: 1, Type: wasm.ValueTypeI64}}
+	interp := newTestVM(t, newTestModule(i64ToI64, locals, arithCode), gas.NewMeter(0))
+	native := newTestVM(t, newTestModule(i64ToI64, locals, arithCode), gas.NewMeter(0), EnableAOT(true))
+	if native.CompileStats().NumCompiledBlocks == 0 {
+		t.Fatal("no code was compiled to native")
+	}
+	interp.RecoverPanic = true
+	native.RecoverPanic = true
+
+	total := uint64(1 << 20)
+	for limit := uint64(0); limit <= total; limit++ {
+		interpMetric, nativeMetric := gas.NewMeter(limit), gas.NewMeter(limit)
+		interp.vmContext.SetGasMetric(interpMetric)
+		native.vmContext.SetGasMetric(nativeMetric)
+		want, wantErr := interp.ExecCode(0, "", 5)
+		got, gotErr := native.ExecCode(0, "", 5)
+		if (gotErr != nil) != (wantErr != nil) || got != want {
+			t.Fatalf("limit=%d: native returned (%v, %v), interpreter (%v, %v)", limit, got, gotErr, want, wantErr)
+		}
+		if nativeMetric.Used() != interpMetric.Used() {
+			t.Fatalf("limit=%d: native used %d gas, interpreter %d", limit, nativeMetric.Used(), interpMetric.Used())
+		}
+		if wantErr != nil {
+			var wantTrap, gotTrap *Trap
+			if !errors.As(wantErr, &wantTrap) || !errors.As(gotErr, &gotTrap) {
+				t.Fatalf("limit=%d: native returned %v, interpreter %v, want traps", limit, gotErr, wantErr)
+			}
+			if gotTrap.PC != wantTrap.PC {
+				t.Fatalf("limit=%d: native trapped at pc %d, interpreter at pc %d", limit, gotTrap.PC, wantTrap.PC)
+			}
+		}
+		if wantErr == nil {
+			if want.(int64) != 20 {
+				t.Fatalf("got %v, want 20", want)
+			}
+			total = interpMetric.Used()
+		}
+	}
+}
+
+func TestProcessGas(t *testing.T) {
+	metric := gas.NewMeter(1 << 20)
+	vm := newTestVM(t, newTestModule(i32ToI32, nil, countdownCode), metric)
+	proc := NewProcess(vm)
+	cost := 10*(4*gas.GasFastestStep+gas.GasQuickStep) + 2*gas.GasFastestStep
+
+	restore := proc.LimitGas(cost - 1)
+	vm.RecoverPanic = true
+	if _, err := vm.ExecCode(0, "", 10); err == nil {
+		t.Fatal("execution was not limited")
+	}
+	restore()
+	if proc.GasMetric() != metric {
+		t.Fatal("gas limit was not lifted")
+	}
+
+	used := metric.Used()
+	if _, err := vm.ExecCode(0, "", 10); err != nil {
+		t.Fatal(err)
+	}
+	if metric.Used()-used != cost {
+		t.Fatalf("used %d gas, want %d", metric.Used()-used, cost)
+	}
+
+	proc.RefundGas(cost)
+	if got, want := proc.GasLeft(), uint64(1<<20)-used; got != want {
+		t.Fatalf("%d gas left after refund, want %d", got, want)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	// ErrHeapExhausted is returned by FreeListHeap.Malloc when no free
+	// block is large enough for the allocation.
+	ErrHeapExhausted = errors.New("exec: heap exhausted")
+	// ErrInvalidFree is returned by FreeListHeap.Free when the offset
+	// was not returned by Malloc, or was already freed.
+	ErrInvalidFree = errors.New("exec: free of unallocated heap offset")
+)
+
+// heapAlign is the alignment of every allocation, in bytes.
+const heapAlign = 8
+
+// heapSpan is a range of the heap, in bytes.
+type heapSpan struct {
+	offset, size uint64
+}
+
+// within reports whether the span lies in a heap of size bytes.
+func (s heapSpan) within(size uint64) bool {
+	return s.offset <= size && s.size <= size-s.offset
+}
+
+// FreeListHeap is the default wasm.HeapMemory of VMs. It hands out the
+// heap of the linear memory, as laid out by the VM's MemoryLayout, from a
+// list of free blocks, using the first block large enough for each
+// allocation, and merges adjacent blocks as they are freed. Offsets are
+// relative to the start of the heap.
+type FreeListHeap struct {
+	size uint64
+	free []heapSpan        // free blocks, sorted by offset and never adjacent
+	used map[uint64]uint64 // size of the allocated blocks, by offset
+}
+
+// NewFreeListHeap returns an empty FreeListHeap. It must be initialized
+// with Init before use.
+func NewFreeListHeap() *FreeListHeap {
+	return &FreeListHeap{used: make(map[uint64]uint64)}
+}
+
+// Init resets the heap to a single free block of totalSize bytes.
+func (h *FreeListHeap) Init(totalSize uint) {
+	h.size = uint64(totalSize)
+	h.free = h.free[:0]
+	if totalSize > 0 {
+		h.free = append(h.free, heapSpan{offset: 0, size: h.size})
+	}
+	h.used = make(map[uint64]uint64)
+}
+
+// Malloc allocates size bytes, and returns their offset.
+func (h *FreeListHeap) Malloc(size uint) (uint64, error) {
+	n := (uint64(size) + heapAlign - 1) &^ (heapAlign - 1)
+	if n == 0 {
+		n = heapAlign
+	}
+	for i, span := range h.free {
+		if span.size < n {
+			continue
+		}
+		if span.size == n {
+			h.free = append(h.free[:i], h.free[i+1:]...)
+		} else {
+			h.free[i] = heapSpan{offset: span.offset + n, size: span.size - n}
+		}
+		h.used[span.offset] = n
+		return span.offset, nil
+	}
+	return 0, ErrHeapExhausted
+}
+
+// Free releases the block allocated at offset.
+func (h *FreeListHeap) Free(offset uint64) error {
+	size, ok := h.used[offset]
+	if !ok {
+		return ErrInvalidFree
+	}
+	delete(h.used, offset)
+
+	i := sort.Search(len(h.free), func(i int) bool { return h.free[i].offset > offset })
+	span := heapSpan{offset: offset, size: size}
+	if i > 0 && h.free[i-1].offset+h.free[i-1].size == offset {
+		i--
+		span = heapSpan{offset: h.free[i].offset, size: h.free[i].size + size}
+		h.free = append(h.free[:i], h.free[i+1:]...)
+	}
+	if i < len(h.free) && span.offset+span.size == h.free[i].offset {
+		span.size += h.free[i].size
+		h.free[i] = span
+		return nil
+	}
+	h.free = append(h.free, heapSpan{})
+	copy(h.free[i+1:], h.free[i:])
+	h.free[i] = span
+	return nil
+}
+
+// GrowMemory adds size bytes at the end of the heap.
+func (h *FreeListHeap) GrowMemory(size uint) error {
+	if size == 0 {
+		return nil
+	}
+	if last := len(h.free) - 1; last >= 0 && h.free[last].offset+h.free[last].size == h.size {
+		h.free[last].size += uint64(size)
+	} else {
+		h.free = append(h.free, heapSpan{offset: h.size, size: uint64(size)})
+	}
+	h.size += uint64(size)
+	return nil
+}
+
+// HeapStats describes the occupation of a FreeListHeap.
+type HeapStats struct {
+	Size        uint64 // total size of the heap, in bytes
+	Allocated   uint64 // bytes allocated, including alignment padding
+	Allocations int    // number of live allocations
+	FreeBlocks  int    // number of free blocks
+	LargestFree uint64 // size of the largest free block
+}
+
+// Free returns the number of free bytes.
+func (s HeapStats) Free() uint64 {
+	return s.Size - s.Allocated
+}
+
+// Fragmentation returns the share of free memory that lies outside the
+// largest free block: 0 when the free memory is contiguous, approaching 1
+// as it is split into many small blocks.
+func (s HeapStats) Fragmentation() float64 {
+	if s.Free() == 0 {
+		return 0
+	}
+	return float64(s.Free()-s.LargestFree) / float64(s.Free())
+}
+
+// Stats returns statistics about the occupation of the heap.
+func (h *FreeListHeap) Stats() HeapStats {
+	stats := HeapStats{
+		Size:        h.size,
+		Allocations: len(h.used),
+		FreeBlocks:  len(h.free),
+	}
+	for _, size := range h.used {
+		stats.Allocated += size
+	}
+	for _, span := range h.free {
+		if span.size > stats.LargestFree {
+			stats.LargestFree = span.size
+		}
+	}
+	return stats
+}
+
+// MarshalBinary encodes the state of the heap, so that it can be saved
+// in a snapshot of the VM.
+func (h *FreeListHeap) MarshalBinary() ([]byte, error) {
+	var w snapshotWriter
+	w.uvarint(h.size)
+	w.uvarint(uint64(len(h.free)))
+	for _, span := range h.free {
+		w.uvarint(span.offset)
+		w.uvarint(span.size)
+	}
+	used := make([]uint64, 0, len(h.used))
+	for offset := range h.used {
+		used = append(used, offset)
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i] < used[j] })
+	w.uvarint(uint64(len(used)))
+	for _, offset := range used {
+		w.uvarint(offset)
+		w.uvarint(h.used[offset])
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary restores a state of the heap encoded by MarshalBinary.
+// States whose free or allocated blocks lie beyond the end of the heap are
+// rejected with ErrInvalidSnapshot.
+func (h *FreeListHeap) UnmarshalBinary(data []byte) error {
+	r := snapshotReader{buf: data}
+	size := r.uvarint()
+	free := make([]heapSpan, r.count())
+	for i := range free {
+		free[i] = heapSpan{offset: r.uvarint(), size: r.uvarint()}
+		if !free[i].within(size) || (i > 0 && free[i].offset <= free[i-1].offset+free[i-1].size) {
+			return ErrInvalidSnapshot
+		}
+	}
+	n := r.count()
+	used := make(map[uint64]uint64, n)
+	for i := 0; i < n; i++ {
+		span := heapSpan{offset: r.uvarint(), size: r.uvarint()}
+		if !span.within(size) {
+			return ErrInvalidSnapshot
+		}
+		used[span.offset] = span.size
+	}
+	if err := r.end(); err != nil {
+		return err
+	}
+	h.size, h.free, h.used = size, free, used
+	return nil
+}
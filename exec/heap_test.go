@@ -0,0 +1,92 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+)
+
+func TestFreeListHeap(t *testing.T) {
+	h := NewFreeListHeap()
+	h.Init(64)
+
+	a, err := h.Malloc(10) // rounded up to 16
+	if err != nil || a != 0 {
+		t.Fatalf("Malloc(10) = (%d, %v), want (0, nil)", a, err)
+	}
+	b, _ := h.Malloc(8)
+	c, _ := h.Malloc(8)
+	if b != 16 || c != 24 {
+		t.Fatalf("allocations at %d and %d, want 16 and 24", b, c)
+	}
+	if _, err := h.Malloc(33); err != ErrHeapExhausted {
+		t.Fatalf("Malloc(33) error = %v, want %v", err, ErrHeapExhausted)
+	}
+
+	if err := h.Free(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Free(b); err != ErrInvalidFree {
+		t.Fatalf("double Free error = %v, want %v", err, ErrInvalidFree)
+	}
+	stats := h.Stats()
+	if stats.Allocated != 24 || stats.FreeBlocks != 2 || stats.LargestFree != 32 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if got, want := stats.Fragmentation(), 0.2; got != want {
+		t.Fatalf("fragmentation = %v, want %v", got, want)
+	}
+
+	// Freed blocks are reused first, and merged with their neighbours.
+	if d, _ := h.Malloc(4); d != b {
+		t.Fatalf("Malloc(4) = %d, want %d", d, b)
+	}
+	for _, off := range []uint64{a, c, b} {
+		if err := h.Free(off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := h.Stats(); stats.FreeBlocks != 1 || stats.LargestFree != 64 || stats.Fragmentation() != 0 {
+		t.Fatalf("stats after freeing everything = %+v", stats)
+	}
+
+	// Growing extends the last free block.
+	if _, err := h.Malloc(64); err != nil {
+		t.Fatal(err)
+	}
+	h.GrowMemory(32)
+	if e, err := h.Malloc(32); err != nil || e != 64 {
+		t.Fatalf("Malloc(32) after growing = (%d, %v), want (64, nil)", e, err)
+	}
+	if stats := h.Stats(); stats.Size != 96 || stats.Free() != 0 {
+		t.Fatalf("stats after growing = %+v", stats)
+	}
+}
+
+func TestNewVMHeapIsPerVM(t *testing.T) {
+	m := newTestModule(i32Result, nil, addCode)
+	m.Memory = &wasm.SectionMemories{Entries: []wasm.Memory{{Limits: wasm.ResizableLimits{Initial: 1}}}}
+	m.LinearMemoryIndexSpace = [][]byte{nil}
+	exportHeapBase(m, 1024)
+
+	a := newTestVM(t, m, gas.NewMeter(1<<20))
+	b := newTestVM(t, m, gas.NewMeter(1<<20))
+	if m.HeapMem != nil {
+		t.Fatal("NewVM set the HeapMem of the module")
+	}
+	if a.heap == b.heap {
+		t.Fatal("VMs of the same module share their heap")
+	}
+	pa, err := a.SetBytes([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pb, err := b.SetBytes([]byte("b")); err != nil || pb != pa {
+		t.Errorf("SetBytes on the second VM = (%d, %v), want (%d, nil)", pb, err, pa)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/Ankr-network/wagon/wasm"
+	"github.com/Ankr-network/wagon/wasm/leb128"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+var (
+	processType = reflect.TypeOf((*Process)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// HostFunc is the form of host functions called without reflection. args
+// holds the raw arguments of the function, as they are stored on the
+// stack of the VM, and is only valid until the function returns. The
+// function returns its raw results, or an error trapping the VM.
+type HostFunc func(p *Process, args []uint64) ([]uint64, error)
+
+// InvalidHostFuncError is returned by (*HostModule).Module when a Go
+// function cannot be called from WebAssembly.
+type InvalidHostFuncError struct {
+	Module string
+	Name   string
+	Type   reflect.Type
+	Reason string
+}
+
+func (e InvalidHostFuncError) Error() string {
+	return fmt.Sprintf("exec: host function %s.%s of type %v: %s", e.Module, e.Name, e.Type, e.Reason)
+}
+
+// UnknownHostModuleError is returned by the resolvers of host modules
+// when no module is registered under the requested name.
+type UnknownHostModuleError string
+
+func (e UnknownHostModuleError) Error() string {
+	return fmt.Sprintf("exec: no host module named %q", string(e))
+}
+
+// HostModule builds a module of functions, globals, memories and tables
+// provided by the host, which WebAssembly modules can import.
+//
+// Its methods return the builder, so that definitions can be chained:
+//
+//	env := exec.NewHostModule("env").
+//		Func("log", func(p *exec.Process, msg string) { ... }).
+//		Global("answer", int32(42))
+//	m, err := wasm.ReadModule(r, env.Resolve)
+//
+// Definitions are checked as they are added. The first error found is
+// returned when the module is resolved.
+type HostModule struct {
+	name string
+	m    *wasm.Module
+	err  error
+}
+
+// NewHostModule returns an empty host module, imported under name.
+func NewHostModule(name string) *HostModule {
+	m := wasm.NewModule()
+	m.Name = name
+	m.Start = nil
+	m.Export.Entries = make(map[string]wasm.ExportEntry)
+	m.LinearMemoryIndexSpace = make([][]byte, 1)
+	return &HostModule{name: name, m: m}
+}
+
+// Name returns the name the host module is imported under.
+func (h *HostModule) Name() string {
+	return h.name
+}
+
+// Func exports the Go function fn under name. The first parameter of fn
+// must be a *Process. Its other parameters and its results are mapped to
+// WebAssembly types as follows: int32, uint32 and bool to i32, int64 and
+// uint64 to i64, float32 to f32, and float64 to f64. []byte and string
+// parameters are passed as a pointer to the linear memory followed by a
+// length, both i32, and hold a copy of the bytes they refer to. fn may
+// return an error as its last result, which traps the VM when it is not
+// nil, and is not passed to the module.
+//
+// Functions of the most common signatures, such as
+// func(*Process, int32) int32, are called without reflection.
+func (h *HostModule) Func(name string, fn interface{}) *HostModule {
+	v := reflect.ValueOf(fn)
+	if !v.IsValid() || (v.Kind() == reflect.Func && v.IsNil()) {
+		return h.fail(InvalidHostFuncError{Module: h.name, Name: name, Reason: "nil function"})
+	}
+	sig, reason := hostFuncSig(v.Type())
+	if reason != "" {
+		return h.fail(InvalidHostFuncError{Module: h.name, Name: name, Type: v.Type(), Reason: reason})
+	}
+
+	index := uint32(len(h.m.FunctionIndexSpace))
+	h.m.Types.Entries = append(h.m.Types.Entries, *sig)
+	h.m.FunctionIndexSpace = append(h.m.FunctionIndexSpace, wasm.Function{
+		Sig:  sig,
+		Body: &wasm.FunctionBody{}, // the function is run from Host
+		Host: v,
+		Name: name,
+	})
+	return h.export(name, wasm.ExternalFunction, index)
+}
+
+// RawFunc exports the HostFunc fn under name, with the signature sig.
+// Calls to fn do not go through reflection.
+func (h *HostModule) RawFunc(name string, sig wasm.FunctionSig, fn HostFunc) *HostModule {
+	if fn == nil {
+		return h.fail(InvalidHostFuncError{Module: h.name, Name: name, Reason: "nil function"})
+	}
+
+	index := uint32(len(h.m.FunctionIndexSpace))
+	h.m.Types.Entries = append(h.m.Types.Entries, sig)
+	h.m.FunctionIndexSpace = append(h.m.FunctionIndexSpace, wasm.Function{
+		Sig:  &sig,
+		Body: &wasm.FunctionBody{}, // the function is run from Host
+		Host: reflect.ValueOf(fn),
+		Name: name,
+	})
+	return h.export(name, wasm.ExternalFunction, index)
+}
+
+// Global exports an immutable global under name, holding val, which must
+// be an int32, int64, float32 or float64.
+func (h *HostModule) Global(name string, val interface{}) *HostModule {
+	var (
+		typ  wasm.ValueType
+		init []byte
+	)
+	switch v := val.(type) {
+	case int32:
+		typ = wasm.ValueTypeI32
+		init = leb128.AppendSleb128([]byte{ops.I32Const}, int64(v))
+	case int64:
+		typ = wasm.ValueTypeI64
+		init = leb128.AppendSleb128([]byte{ops.I64Const}, v)
+	case float32:
+		typ = wasm.ValueTypeF32
+		init = []byte{ops.F32Const, 0, 0, 0, 0}
+		endianess.PutUint32(init[1:], math.Float32bits(v))
+	case float64:
+		typ = wasm.ValueTypeF64
+		init = []byte{ops.F64Const, 0, 0, 0, 0, 0, 0, 0, 0}
+		endianess.PutUint64(init[1:], math.Float64bits(v))
+	default:
+		return h.fail(fmt.Errorf("exec: host global %s.%s has unsupported type %T", h.name, name, val))
+	}
+
+	index := uint32(len(h.m.GlobalIndexSpace))
+	h.m.GlobalIndexSpace = append(h.m.GlobalIndexSpace, wasm.GlobalEntry{
+		Type: wasm.GlobalVar{Type: typ},
+		Init: append(init, ops.End),
+	})
+	return h.export(name, wasm.ExternalGlobal, index)
+}
+
+// Memory exports a linear memory under name, sized according to limits.
+// A host module holds at most one memory.
+func (h *HostModule) Memory(name string, limits wasm.ResizableLimits) *HostModule {
+	if len(h.m.Memory.Entries) != 0 {
+		return h.fail(ErrMultipleLinearMemories)
+	}
+	h.m.Memory.Entries = append(h.m.Memory.Entries, wasm.Memory{Limits: limits})
+	h.m.LinearMemoryIndexSpace[0] = make([]byte, uint64(limits.Initial)*wasmPageSize)
+	return h.export(name, wasm.ExternalMemory, 0)
+}
+
+// Table exports a table of functions under name, sized according to
+// limits. A host module holds at most one table.
+func (h *HostModule) Table(name string, limits wasm.ResizableLimits) *HostModule {
+	if len(h.m.Table.Entries) != 0 {
+		return h.fail(fmt.Errorf("exec: host module %s has more than one table", h.name))
+	}
+	h.m.Table.Entries = append(h.m.Table.Entries, wasm.Table{ElementType: wasm.ElemTypeAnyFunc, Limits: limits})
+	h.m.TableIndexSpace = [][]uint32{make([]uint32, limits.Initial)}
+	return h.export(name, wasm.ExternalTable, 0)
+}
+
+// Module returns the module built so far, or the first error found while
+// building it.
+func (h *HostModule) Module() (*wasm.Module, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+	return h.m, nil
+}
+
+// Resolve is a wasm.ResolveFunc returning the host module when name is
+// its own name.
+func (h *HostModule) Resolve(name string) (*wasm.Module, error) {
+	if name != h.name {
+		return nil, UnknownHostModuleError(name)
+	}
+	return h.Module()
+}
+
+// HostResolver returns a wasm.ResolveFunc resolving imports to the given
+// host modules, according to their names.
+func HostResolver(modules ...*HostModule) wasm.ResolveFunc {
+	return func(name string) (*wasm.Module, error) {
+		for _, h := range modules {
+			if h.name == name {
+				return h.Module()
+			}
+		}
+		return nil, UnknownHostModuleError(name)
+	}
+}
+
+func (h *HostModule) export(name string, kind wasm.External, index uint32) *HostModule {
+	if _, ok := h.m.Export.Entries[name]; ok {
+		return h.fail(wasm.DuplicateExportError(name))
+	}
+	h.m.Export.Entries[name] = wasm.ExportEntry{FieldStr: name, Kind: kind, Index: index}
+	return h
+}
+
+func (h *HostModule) fail(err error) *HostModule {
+	if h.err == nil {
+		h.err = err
+	}
+	return h
+}
+
+// hostFuncSig returns the signature of WebAssembly functions calling a
+// Go function of type t, or the reason why t cannot be called.
+func hostFuncSig(t reflect.Type) (*wasm.FunctionSig, string) {
+	if t.Kind() != reflect.Func {
+		return nil, "not a function"
+	}
+	if t.IsVariadic() {
+		return nil, "variadic functions are not supported"
+	}
+	if t.NumIn() == 0 || t.In(0) != processType {
+		return nil, "the first parameter must be a *exec.Process"
+	}
+
+	sig := &wasm.FunctionSig{Form: wasm.TypeFunc}
+	for i := 1; i < t.NumIn(); i++ {
+		in := t.In(i)
+		if isHostBytes(in) {
+			sig.ParamTypes = append(sig.ParamTypes, wasm.ValueTypeI32, wasm.ValueTypeI32)
+			continue
+		}
+		typ, ok := hostValueType(in)
+		if !ok {
+			return nil, fmt.Sprintf("unsupported type %v for parameter %d", in, i)
+		}
+		sig.ParamTypes = append(sig.ParamTypes, typ)
+	}
+	numOut := t.NumOut()
+	if numOut > 0 && t.Out(numOut-1) == errorType {
+		numOut--
+	}
+	for i := 0; i < numOut; i++ {
+		typ, ok := hostValueType(t.Out(i))
+		if !ok {
+			return nil, fmt.Sprintf("unsupported type %v for result %d", t.Out(i), i)
+		}
+		sig.ReturnTypes = append(sig.ReturnTypes, typ)
+	}
+	return sig, ""
+}
+
+// hostValueType returns the WebAssembly type of the values of Go type t.
+func hostValueType(t reflect.Type) (wasm.ValueType, bool) {
+	switch t.Kind() {
+	case reflect.Int32, reflect.Uint32, reflect.Bool:
+		return wasm.ValueTypeI32, true
+	case reflect.Int64, reflect.Uint64:
+		return wasm.ValueTypeI64, true
+	case reflect.Float32:
+		return wasm.ValueTypeF32, true
+	case reflect.Float64:
+		return wasm.ValueTypeF64, true
+	}
+	return 0, false
+}
+
+// isHostBytes reports whether values of Go type t are passed to host
+// functions as a pointer and a length.
+func isHostBytes(t reflect.Type) bool {
+	return t.Kind() == reflect.String || (t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8)
+}
+
+// hostBytes returns a copy of the n bytes of linear memory at ptr, for
+// a []byte or string parameter of a host function.
+func (vm *VM) hostBytes(ptr, n uint32) []byte {
+	b, err := vm.readBytes(uint64(ptr), uint64(n))
+	if err != nil {
+		vm.trap(TrapOutOfBoundsMemoryAccess, err)
+	}
+	return b
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import "reflect"
+
+// asHostFunc returns the host function fn as a HostFunc, if it is one or
+// if it has one of the signatures adapted below, and nil otherwise.
+//
+// Adapters write their result in place of their first argument when they
+// have one, so that calls do not allocate.
+func asHostFunc(fn reflect.Value) HostFunc {
+	if !fn.CanInterface() {
+		return nil
+	}
+	switch f := fn.Interface().(type) {
+	case HostFunc:
+		return f
+	case func(*Process, []uint64) ([]uint64, error):
+		return f
+
+	case func(*Process):
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			f(p)
+			return nil, nil
+		}
+	case func(*Process) int32:
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			return []uint64{uint64(uint32(f(p)))}, nil
+		}
+	case func(*Process) int64:
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			return []uint64{uint64(f(p))}, nil
+		}
+
+	case func(*Process, int32):
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			f(p, int32(args[0]))
+			return nil, nil
+		}
+	case func(*Process, int32) int32:
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			args[0] = uint64(uint32(f(p, int32(args[0]))))
+			return args[:1], nil
+		}
+	case func(*Process, int32) int64:
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			args[0] = uint64(f(p, int32(args[0])))
+			return args[:1], nil
+		}
+	case func(*Process, int64):
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			f(p, int64(args[0]))
+			return nil, nil
+		}
+	case func(*Process, int64) int64:
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			args[0] = uint64(f(p, int64(args[0])))
+			return args[:1], nil
+		}
+
+	case func(*Process, int32, int32):
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			f(p, int32(args[0]), int32(args[1]))
+			return nil, nil
+		}
+	case func(*Process, int32, int32) int32:
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			args[0] = uint64(uint32(f(p, int32(args[0]), int32(args[1]))))
+			return args[:1], nil
+		}
+	case func(*Process, int32, int32, int32):
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			f(p, int32(args[0]), int32(args[1]), int32(args[2]))
+			return nil, nil
+		}
+	case func(*Process, int32, int32, int32) int32:
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			args[0] = uint64(uint32(f(p, int32(args[0]), int32(args[1]), int32(args[2]))))
+			return args[:1], nil
+		}
+	case func(*Process, int32, int32, int32, int32) int32:
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			args[0] = uint64(uint32(f(p, int32(args[0]), int32(args[1]), int32(args[2]), int32(args[3]))))
+			return args[:1], nil
+		}
+
+	case func(*Process) error:
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			return nil, f(p)
+		}
+	case func(*Process, int32) (int32, error):
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			r, err := f(p, int32(args[0]))
+			args[0] = uint64(uint32(r))
+			return args[:1], err
+		}
+	case func(*Process, int32, int32) (int32, error):
+		return func(p *Process, args []uint64) ([]uint64, error) {
+			r, err := f(p, int32(args[0]), int32(args[1]))
+			args[0] = uint64(uint32(r))
+			return args[:1], err
+		}
+	}
+	return nil
+}
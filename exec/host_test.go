@@ -0,0 +1,299 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+func wasmName(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+
+func wasmSection(id wasm.SectionID, count byte, entries ...[]byte) []byte {
+	payload := append([]byte{count}, bytes.Join(entries, nil)...)
+	return append([]byte{byte(id), byte(len(payload))}, payload...)
+}
+
+func wasmImport(field string, desc ...byte) []byte {
+	return append(append(wasmName("env"), wasmName(field)...), desc...)
+}
+
+var wasmHeader = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+// importingModule is the binary encoding of a module importing add, log,
+// answer and memory from env, and exporting main, which returns
+// add(answer, 2) after logging the two bytes of its data segment.
+var importingModule = func() []byte {
+	body := []byte{
+		0, // no locals
+		ops.GetGlobal, 0,
+		ops.I32Const, 2,
+		ops.Call, 0,
+		ops.I32Const, 0,
+		ops.I32Const, 2,
+		ops.Call, 1,
+		ops.End,
+	}
+	return bytes.Join([][]byte{
+		wasmHeader,
+		wasmSection(wasm.SectionIDType, 3,
+			[]byte{0x60, 2, 0x7f, 0x7f, 1, 0x7f},
+			[]byte{0x60, 2, 0x7f, 0x7f, 0},
+			[]byte{0x60, 0, 1, 0x7f},
+		),
+		wasmSection(wasm.SectionIDImport, 4,
+			wasmImport("add", byte(wasm.ExternalFunction), 0),
+			wasmImport("log", byte(wasm.ExternalFunction), 1),
+			wasmImport("answer", byte(wasm.ExternalGlobal), 0x7f, 0),
+			wasmImport("memory", byte(wasm.ExternalMemory), 0, 1),
+		),
+		wasmSection(wasm.SectionIDFunction, 1, []byte{2}),
+		wasmSection(wasm.SectionIDExport, 1, append(wasmName("main"), byte(wasm.ExternalFunction), 2)),
+		wasmSection(wasm.SectionIDCode, 1, append([]byte{byte(len(body))}, body...)),
+		wasmSection(wasm.SectionIDData, 1, []byte{0, ops.I32Const, 0, ops.End, 2, 'h', 'i'}),
+	}, nil)
+}()
+
+// newForwardingVM returns a VM running a module that imports the function
+// field of h, and exports it as main through a function forwarding its
+// arguments.
+func newForwardingVM(t *testing.T, h *HostModule, field string, opts ...VMOption) *VM {
+	t.Helper()
+	hm, err := h.Module()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := hm.GetFunction(int(hm.Export.Entries[field].Index)).Sig
+	typ := new(bytes.Buffer)
+	if err := sig.MarshalWASM(typ); err != nil {
+		t.Fatal(err)
+	}
+	body := []byte{0}
+	for i := range sig.ParamTypes {
+		body = append(body, ops.GetLocal, byte(i))
+	}
+	body = append(body, ops.Call, 0, ops.End)
+
+	raw := bytes.Join([][]byte{
+		wasmHeader,
+		wasmSection(wasm.SectionIDType, 1, typ.Bytes()),
+		wasmSection(wasm.SectionIDImport, 1, wasmImport(field, byte(wasm.ExternalFunction), 0)),
+		wasmSection(wasm.SectionIDFunction, 1, []byte{0}),
+		wasmSection(wasm.SectionIDExport, 1, append(wasmName("main"), byte(wasm.ExternalFunction), 1)),
+		wasmSection(wasm.SectionIDCode, 1, append([]byte{byte(len(body))}, body...)),
+	}, nil)
+	m, err := wasm.ReadModule(bytes.NewReader(raw), h.Resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestVM(t, m, gas.NewMeter(1<<30), opts...)
+}
+
+func TestHostModule(t *testing.T) {
+	var logged []string
+	env := NewHostModule("env").
+		Func("add", func(p *Process, a, b int32) int32 { return a + b }).
+		Func("log", func(p *Process, msg string) { logged = append(logged, msg) }).
+		Global("answer", int32(40)).
+		Memory("memory", wasm.ResizableLimits{Initial: 1})
+
+	m, err := wasm.ReadModule(bytes.NewReader(importingModule), HostResolver(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := newTestVM(t, m, gas.NewMeter(1<<30), WithMemoryLayout(StandardLayout))
+	if len(vm.Memory()) != wasmPageSize {
+		t.Errorf("imported memory has %d bytes, want %d", len(vm.Memory()), wasmPageSize)
+	}
+	res, err := vm.Call("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0] != int32(42) {
+		t.Errorf("main() = %v, want [42]", res)
+	}
+	if len(logged) != 1 || logged[0] != "hi" {
+		t.Errorf("logged %q, want [hi]", logged)
+	}
+
+	if _, err := wasm.ReadModule(bytes.NewReader(importingModule), NewHostModule("other").Resolve); err != UnknownHostModuleError("env") {
+		t.Errorf("resolving env from another module: error = %v", err)
+	}
+}
+
+func TestHostModuleSignatures(t *testing.T) {
+	h := NewHostModule("env").Func("f", func(p *Process, b bool, s []byte, f float32, x uint64) (float64, bool) { return 0, b })
+	m, err := h.Module()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := m.FunctionIndexSpace[0].Sig
+	want := wasm.FunctionSig{
+		Form:        wasm.TypeFunc,
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32, wasm.ValueTypeI32, wasm.ValueTypeF32, wasm.ValueTypeI64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeF64, wasm.ValueTypeI32},
+	}
+	if sig.String() != want.String() {
+		t.Errorf("signature = %v, want %v", sig, want)
+	}
+
+	for _, fn := range []interface{}{
+		nil,
+		42,
+		func(a int32) int32 { return a },
+		func(p *Process, a int) {},
+		func(p *Process) string { return "" },
+		func(p *Process, a ...int32) {},
+	} {
+		if _, err := NewHostModule("env").Func("f", fn).Module(); err == nil {
+			t.Errorf("registering %T: no error", fn)
+		} else if _, ok := err.(InvalidHostFuncError); !ok {
+			t.Errorf("registering %T: error = %v", fn, err)
+		}
+	}
+
+	if _, err := NewHostModule("env").Global("g", int32(1)).Global("g", 2.0).Module(); err != wasm.DuplicateExportError("g") {
+		t.Errorf("duplicate export: error = %v", err)
+	}
+	if _, err := NewHostModule("env").Global("g", "s").Module(); err == nil {
+		t.Errorf("string global: no error")
+	}
+}
+
+func TestHostFunc(t *testing.T) {
+	errDivideByZero := errors.New("divide by zero")
+	div := func(p *Process, args []uint64) ([]uint64, error) {
+		if int32(args[1]) == 0 {
+			return nil, errDivideByZero
+		}
+		return []uint64{uint64(uint32(int32(args[0]) / int32(args[1])))}, nil
+	}
+	h := NewHostModule("env").
+		RawFunc("div", wasm.FunctionSig{
+			Form:        wasm.TypeFunc,
+			ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32},
+			ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32},
+		}, div).
+		Func("sub", func(p *Process, a, b int32) int32 { return a - b }).
+		Func("neg", func(p *Process, a int32, b bool) int32 { return -a })
+
+	for _, tc := range []struct {
+		field   string
+		args    []interface{}
+		want    int32
+		reflect bool
+	}{
+		{"div", []interface{}{int32(-7), int32(2)}, -3, false},
+		{"sub", []interface{}{int32(2), int32(5)}, -3, false},
+		{"neg", []interface{}{int32(3), int32(1)}, -3, true},
+	} {
+		vm := newForwardingVM(t, h, tc.field)
+		if _, ok := vm.funcs[0].(goFunction); ok != tc.reflect {
+			t.Errorf("%s is called through reflection: %v, want %v", tc.field, ok, tc.reflect)
+		}
+		res, err := vm.Call("main", tc.args...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.field, err)
+		}
+		if len(res) != 1 || res[0] != tc.want {
+			t.Errorf("%s%v = %v, want [%d]", tc.field, tc.args, res, tc.want)
+		}
+	}
+
+	// Host functions are skipped by native compilation.
+	vm := newForwardingVM(t, h, "sub", EnableAOT(true))
+	vm.CompileStats()
+	if res, err := vm.Call("main", int32(2), int32(5)); err != nil || res[0] != int32(-3) {
+		t.Errorf("sub(2, 5) with AOT = %v, %v, want [-3]", res, err)
+	}
+
+	vm = newForwardingVM(t, h, "div")
+	_, err := vm.Call("main", int32(1), int32(0))
+	if trap, ok := err.(*Trap); !ok || trap.Kind != TrapHostFunction || !errors.Is(err, errDivideByZero) {
+		t.Errorf("dividing by zero: error = %v, want a host function trap", err)
+	}
+}
+
+func TestHostErrors(t *testing.T) {
+	errDenied := errors.New("access denied")
+	h := NewHostModule("env").
+		Func("adapted", func(p *Process, a int32) (int32, error) { return 0, errDenied }).
+		Func("reflected", func(p *Process, a int64) (int64, error) { return 0, errDenied }).
+		Func("ok", func(p *Process, a int64) (int64, error) { return a + 1, nil }).
+		Func("terminate", func(p *Process, a int32) int32 {
+			if a != 0 {
+				p.Terminate()
+			}
+			return a
+		})
+
+	for _, field := range []string{"adapted", "reflected"} {
+		_, err := newForwardingVM(t, h, field).ExecCode(1, "", 1)
+		var hostErr *HostError
+		if !errors.As(err, &hostErr) || hostErr.Name != field || !errors.Is(err, errDenied) {
+			t.Errorf("%s: error = %v, want a host error", field, err)
+		}
+		if trap, ok := err.(*Trap); !ok || trap.Kind != TrapHostFunction {
+			t.Errorf("%s: error = %v, want a host function trap", field, err)
+		}
+	}
+
+	res, err := newForwardingVM(t, h, "ok").ExecCode(1, "", 1)
+	if err != nil || res != int64(2) {
+		t.Errorf("ok(1) = %v, %v, want 2", res, err)
+	}
+
+	vm := newForwardingVM(t, h, "terminate")
+	res, err = vm.ExecCode(1, "", 1)
+	if trap, ok := err.(*Trap); !ok || trap.Kind != TrapTerminated || res != nil {
+		t.Errorf("terminate(1) = %v, %v, want a termination trap", res, err)
+	}
+	if res, err := vm.ExecCode(1, "", 0); err != nil || res != int32(0) {
+		t.Errorf("terminate(0) after a termination = %v, %v, want 0", res, err)
+	}
+	vm.Restart()
+	if _, err := vm.ExecCode(1, "", 1); !errors.Is(err, ErrTerminated) {
+		t.Errorf("terminate(1) after restart: error = %v, want %v", err, ErrTerminated)
+	}
+	vm.Close()
+	if _, err := vm.ExecCode(1, "", 1); err == nil {
+		t.Errorf("ExecCode on a closed VM succeeded")
+	}
+}
+
+func TestHostReentry(t *testing.T) {
+	// main(n) calls reenter(n), which runs main(n-1) on the same VM and
+	// returns its result plus one.
+	h := NewHostModule("env").
+		Func("reenter", func(p *Process, a int32) (int32, error) {
+			if a == 0 {
+				return 0, nil
+			}
+			res, err := p.VM().ExecCode(1, "", uint64(a-1))
+			if err != nil {
+				return 0, err
+			}
+			return res.(int32) + 1, nil
+		})
+
+	vm := newForwardingVM(t, h, "reenter", WithMaxCallDepth(4))
+	if res, err := vm.ExecCode(1, "", 3); err != nil || res != int32(3) {
+		t.Fatalf("main(3) = %v, %v, want 3", res, err)
+	}
+	if _, err := vm.ExecCode(1, "", 10); !errors.Is(err, ErrCallStackExhausted) {
+		t.Fatalf("main(10): error = %v, want %v", err, ErrCallStackExhausted)
+	}
+	if vm.callDepth != 0 || vm.executing {
+		t.Errorf("after a trap in a nested execution: call depth = %d, executing = %v", vm.callDepth, vm.executing)
+	}
+	if res, err := vm.ExecCode(1, "", 4); err != nil || res != int32(4) {
+		t.Errorf("main(4) after a trap = %v, %v, want 4", res, err)
+	}
+}
@@ -40,6 +40,41 @@ func (a *MMapAllocator) Close() error {
 	return nil
 }
 
+// AllocatorMark is a state of an MMapAllocator, returned by Mark.
+type AllocatorMark struct {
+	blocks              int
+	consumed, remaining uint32
+}
+
+// Mark returns the current state of the allocator, which Release returns
+// it to.
+func (a *MMapAllocator) Mark() AllocatorMark {
+	m := AllocatorMark{blocks: len(a.blocks)}
+	if a.last != nil {
+		m.consumed, m.remaining = a.last.consumed, a.last.remaining
+	}
+	return m
+}
+
+// Release frees the code allocated since Mark returned m. The units
+// holding it must not be invoked afterwards.
+func (a *MMapAllocator) Release(m AllocatorMark) error {
+	for len(a.blocks) > m.blocks {
+		last := len(a.blocks) - 1
+		if err := a.blocks[last].mem.Unmap(); err != nil {
+			return err
+		}
+		a.blocks[last] = nil
+		a.blocks = a.blocks[:last]
+	}
+	a.last = nil
+	if m.blocks > 0 {
+		a.last = a.blocks[m.blocks-1]
+		a.last.consumed, a.last.remaining = m.consumed, m.remaining
+	}
+	return nil
+}
+
 // AllocateExec allocates a block of executable memory with the given code contained.
 func (a *MMapAllocator) AllocateExec(asm []byte) (NativeCodeUnit, error) {
 	consumed := uint32(len(asm)+allocationAlignment) & ^uint32(allocationAlignment)
@@ -54,3 +54,35 @@ func TestMMapAllocator(t *testing.T) {
 		t.Errorf("a.last.remaining = %d, want %d", a.last.remaining, want)
 	}
 }
+
+func TestMMapAllocatorRelease(t *testing.T) {
+	a := &MMapAllocator{}
+	defer a.Close()
+
+	if _, err := a.AllocateExec([]byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	m := a.Mark()
+	if _, err := a.AllocateExec([]byte{4, 3, 2, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AllocateExec(make([]byte, 36*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Release(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.blocks) != 1 || a.last != a.blocks[0] {
+		t.Fatalf("%d blocks after Release, want 1", len(a.blocks))
+	}
+	if want := uint32(128); a.last.consumed != want {
+		t.Errorf("a.last.consumed = %d, want %d", a.last.consumed, want)
+	}
+
+	if err := a.Release(AllocatorMark{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.blocks) != 0 || a.last != nil {
+		t.Errorf("%d blocks after releasing everything, want 0", len(a.blocks))
+	}
+}
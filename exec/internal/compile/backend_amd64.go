@@ -56,6 +56,10 @@ type AMD64Backend struct {
 	s *scanner
 
 	EmitBoundsChecks bool
+	// CanonicalizeNaNs makes floating-point arithmetic replace the NaNs
+	// it produces by the canonical NaN, so that the result does not
+	// depend on the NaN propagation rules of the processor.
+	CanonicalizeNaNs bool
 }
 
 // currentInstruction describes the instruction currently being emitted.
@@ -377,17 +381,48 @@ func (b *AMD64Backend) emitFusedConstStore(builder *asm.Builder, code []byte, ne
 	return nil
 }
 
+// emitEffectiveAddress pops the base address of a memory access from the
+// stack, and computes the effective address of the access into r9. The
+// effective address is the 33-bit sum of the 32-bit base address and the
+// 32-bit offset, so it can neither wrap nor be negative.
+func (b *AMD64Backend) emitEffectiveAddress(builder *asm.Builder, ci currentInstruction, offset uint64) {
+	b.emitSymbolicPopToReg(builder, ci, x86.REG_R9)
+	// movlqzx r9, r9 (i32 values may be sign-extended on the stack)
+	prog := builder.NewProg()
+	prog.As = x86.AMOVLQZX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_R9
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_R9
+	builder.AddInstruction(prog)
+	// movq rcx, $(offset)
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_CX
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = int64(uint32(offset))
+	builder.AddInstruction(prog)
+	// addq r9, rcx
+	prog = builder.NewProg()
+	prog.As = x86.AADDQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_R9
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_CX
+	builder.AddInstruction(prog)
+}
+
 func (b *AMD64Backend) emitWasmMemoryLoad(builder *asm.Builder, ci currentInstruction, outReg int16, base uint64) error {
 	// movq rdi, 0xffffffffffffffff (reset poison register)
 	// xorq r8,  r8
-	// <load offset> --> r9
-	// addq    r9, $(base)
+	// <effective address> --> r9
 	// movq   rcx, r9
 	// addq   rcx, $(movSize)
 	// movq   rbx, [rsi+8]
 	// cmp    rcx, rbx
-	// cmovlt rdi, r8 (poison the mask if bounds check fails)
-	// jge    boundsGood
+	// cmovcs rdi, r8 (poison the mask if bounds check fails)
+	// jcc    boundsGood
 	// <emitExit()>
 	// boundsGood:
 	// movq   rbx, [rsi]
@@ -413,16 +448,7 @@ func (b *AMD64Backend) emitWasmMemoryLoad(builder *asm.Builder, ci currentInstru
 	prog.From.Type = obj.TYPE_REG
 	prog.From.Reg = x86.REG_R8
 	builder.AddInstruction(prog)
-	// Load offset from stack.
-	b.emitSymbolicPopToReg(builder, ci, x86.REG_R9)
-	// addq r9, $(base)
-	prog = builder.NewProg()
-	prog.As = x86.AADDQ
-	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_R9
-	prog.From.Type = obj.TYPE_CONST
-	prog.From.Offset = int64(base)
-	builder.AddInstruction(prog)
+	b.emitEffectiveAddress(builder, ci, base)
 	// movq rcx, r9
 	prog = builder.NewProg()
 	prog.As = x86.AMOVQ
@@ -456,18 +482,18 @@ func (b *AMD64Backend) emitWasmMemoryLoad(builder *asm.Builder, ci currentInstru
 	prog.To.Type = obj.TYPE_REG
 	prog.To.Reg = x86.REG_CX
 	builder.AddInstruction(prog)
-	// cmovlt rdi, r8
+	// cmovcs rdi, r8
 	prog = builder.NewProg()
-	prog.As = x86.ACMOVQLT
+	prog.As = x86.ACMOVQCS
 	prog.From.Type = obj.TYPE_REG
 	prog.From.Reg = x86.REG_R8
 	prog.To.Type = obj.TYPE_REG
 	prog.To.Reg = x86.REG_DI
 	builder.AddInstruction(prog)
 
-	// ja boundsGood
+	// jcc boundsGood (unsigned rbx >= rcx)
 	jmp := builder.NewProg()
-	jmp.As = x86.AJGE
+	jmp.As = x86.AJCC
 	jmp.To.Type = obj.TYPE_BRANCH
 	builder.AddInstruction(jmp)
 	b.emitExit(builder, CompletionBadBounds|makeExitIndex(ci.idx), false)
@@ -521,13 +547,12 @@ func maxuint64() uint64 {
 }
 
 func (b *AMD64Backend) emitWasmMemoryStore(builder *asm.Builder, ci currentInstruction, base uint64, inReg int16) error {
-	// <load offset> --> r9
-	// addq    r9, $(base)
+	// <effective address> --> r9
 	// movq   rcx, r9
 	// addq   rcx, $(movSize)
 	// movq   rbx, [rsi+8]
 	// cmp    rcx, rbx
-	// jge    boundsGood
+	// jcc    boundsGood
 	// <emitExit()>
 	// boundsGood:
 	// movq   rbx, [rsi]
@@ -535,18 +560,9 @@ func (b *AMD64Backend) emitWasmMemoryStore(builder *asm.Builder, ci currentInstr
 	// movq   [rbx], rdx
 	movSize, movOp := b.paramsForMemoryOp(ci.inst.Op)
 
-	// Load offset from stack.
-	b.emitSymbolicPopToReg(builder, ci, x86.REG_R9)
-	// addq r9, $(base)
-	prog := builder.NewProg()
-	prog.As = x86.AADDQ
-	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_R9
-	prog.From.Type = obj.TYPE_CONST
-	prog.From.Offset = int64(base)
-	builder.AddInstruction(prog)
+	b.emitEffectiveAddress(builder, ci, base)
 	// movq rcx, r9
-	prog = builder.NewProg()
+	prog := builder.NewProg()
 	prog.As = x86.AMOVQ
 	prog.To.Type = obj.TYPE_REG
 	prog.To.Reg = x86.REG_CX
@@ -579,9 +595,9 @@ func (b *AMD64Backend) emitWasmMemoryStore(builder *asm.Builder, ci currentInstr
 	prog.To.Reg = x86.REG_CX
 	builder.AddInstruction(prog)
 
-	// ja boundsGood
+	// jcc boundsGood (unsigned rbx >= rcx)
 	jmp := builder.NewProg()
-	jmp.As = x86.AJGE
+	jmp.As = x86.AJCC
 	jmp.To.Type = obj.TYPE_BRANCH
 	builder.AddInstruction(jmp)
 	b.emitExit(builder, CompletionBadBounds|makeExitIndex(ci.idx), false)
@@ -617,9 +633,91 @@ func (b *AMD64Backend) emitWasmMemoryStore(builder *asm.Builder, ci currentInstr
 	prog.To.Type = obj.TYPE_MEM
 	prog.To.Reg = x86.REG_BX
 	builder.AddInstruction(prog)
+
+	b.emitMarkDirty(builder)
 	return nil
 }
 
+// emitMarkDirty marks the chunks of memory written by a store as dirty,
+// if the caller tracks them. It expects the effective address of the
+// store in r9, and the address of its end in rcx.
+func (b *AMD64Backend) emitMarkDirty(builder *asm.Builder) {
+	// movq   rbx, [rsp+48]
+	// testq  rbx, rbx
+	// jeq    done
+	// movq   rbx, [rbx]
+	// shrq   r9, $(DirtyChunkShift)
+	// movb   [rbx+r9], $1
+	// subq   rcx, $1
+	// shrq   rcx, $(DirtyChunkShift)
+	// movb   [rbx+rcx], $1
+	// done:
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_BX
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = x86.REG_SP
+	prog.From.Offset = 48
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.ATESTQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_BX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_BX
+	builder.AddInstruction(prog)
+
+	jmp := builder.NewProg()
+	jmp.As = x86.AJEQ
+	jmp.To.Type = obj.TYPE_BRANCH
+	builder.AddInstruction(jmp)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_BX
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = x86.REG_BX
+	builder.AddInstruction(prog)
+
+	for _, reg := range []int16{x86.REG_R9, x86.REG_CX} {
+		if reg == x86.REG_CX {
+			prog = builder.NewProg()
+			prog.As = x86.ASUBQ
+			prog.To.Type = obj.TYPE_REG
+			prog.To.Reg = reg
+			prog.From.Type = obj.TYPE_CONST
+			prog.From.Offset = 1
+			builder.AddInstruction(prog)
+		}
+		prog = builder.NewProg()
+		prog.As = x86.ASHRQ
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = reg
+		prog.From.Type = obj.TYPE_CONST
+		prog.From.Offset = DirtyChunkShift
+		builder.AddInstruction(prog)
+
+		prog = builder.NewProg()
+		prog.As = x86.AMOVB
+		prog.To.Type = obj.TYPE_MEM
+		prog.To.Reg = x86.REG_BX
+		prog.To.Index = reg
+		prog.To.Scale = 1
+		prog.From.Type = obj.TYPE_CONST
+		prog.From.Offset = 1
+		builder.AddInstruction(prog)
+	}
+
+	// done:
+	prog = builder.NewProg()
+	prog.As = obj.ANOP // branch target - assembler will optimize out.
+	jmp.Pcond = prog
+	builder.AddInstruction(prog)
+}
+
 func (b *AMD64Backend) emitWasmLocalsLoad(builder *asm.Builder, ci currentInstruction, reg int16, index uint64) {
 	// movq rbx, $(index)
 	// loadLocalsFirstElem (symbolic)
@@ -854,10 +952,68 @@ func (b *AMD64Backend) emitBinaryFloat(builder *asm.Builder, ci currentInstructi
 	}
 	builder.AddInstruction(prog)
 
+	if b.CanonicalizeNaNs {
+		b.emitCanonicalizeNaN(builder, ci)
+	}
 	b.emitSymbolicPushFromReg(builder, ci, x86.REG_X0)
 	return nil
 }
 
+// emitCanonicalizeNaN replaces the result of a float operation in xmm0
+// by the canonical NaN if it is a NaN.
+func (b *AMD64Backend) emitCanonicalizeNaN(builder *asm.Builder, ci currentInstruction) {
+	// ucomisd/ucomiss xmm0, xmm0
+	// jpc     done
+	// movq    rax, $(CanonicalNaN)
+	// movq    xmm0, rax
+	// done:
+	var f64 bool
+	switch ci.inst.Op {
+	case ops.F64Add, ops.F64Sub, ops.F64Div, ops.F64Mul, ops.F64Min, ops.F64Max:
+		f64 = true
+	}
+	prog := builder.NewProg()
+	prog.As = x86.AUCOMISS
+	if f64 {
+		prog.As = x86.AUCOMISD
+	}
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_X0
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_X0
+	builder.AddInstruction(prog)
+
+	// Only NaNs compare unordered to themselves, setting the parity flag.
+	jmp := builder.NewProg()
+	jmp.As = x86.AJPC
+	jmp.To.Type = obj.TYPE_BRANCH
+	builder.AddInstruction(jmp)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = int64(CanonicalNaN32)
+	if f64 {
+		prog.From.Offset = int64(CanonicalNaN64)
+	}
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_X0
+	builder.AddInstruction(prog)
+
+	done := builder.NewProg()
+	done.As = obj.ANOP
+	jmp.Pcond = done
+	builder.AddInstruction(done)
+}
+
 func (b *AMD64Backend) emitComparisonFloat(builder *asm.Builder, ci currentInstruction) error {
 	// xor rax, rax
 	// XOR is used as that is the fastest way to zero a register,
@@ -1064,7 +1220,110 @@ func (b *AMD64Backend) emitDivide(builder *asm.Builder, ci currentInstruction) {
 	b.emitSymbolicPopToReg(builder, ci, x86.REG_R9)
 	b.emitSymbolicPopToReg(builder, ci, x86.REG_AX)
 
+	var test, cmp obj.As
+	var minInt int64
+	switch ci.inst.Op {
+	case ops.I64DivU, ops.I64RemU, ops.I64DivS, ops.I64RemS:
+		test, cmp, minInt = x86.ATESTQ, x86.ACMPQ, math.MinInt64
+	case ops.I32DivU, ops.I32RemU, ops.I32DivS, ops.I32RemS:
+		test, cmp, minInt = x86.ATESTL, x86.ACMPL, math.MinInt32
+	default:
+		panic(fmt.Sprintf("cannot handle op: %x", ci.inst.Op))
+	}
+
+	// test r9, r9
 	prog := builder.NewProg()
+	prog.As = test
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_R9
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_R9
+	builder.AddInstruction(prog)
+	// jne divisorGood
+	jmp := builder.NewProg()
+	jmp.As = x86.AJNE
+	jmp.To.Type = obj.TYPE_BRANCH
+	builder.AddInstruction(jmp)
+	b.emitExit(builder, CompletionDivideByZero|makeExitIndex(ci.idx), false)
+
+	// divisorGood:
+	prog = builder.NewProg()
+	prog.As = obj.ANOP // branch target - assembler will optimize out.
+	jmp.Pcond = prog
+	builder.AddInstruction(prog)
+
+	// Signed division of the most negative integer by -1 overflows, and
+	// faults on x86 for both the quotient and the remainder. The
+	// remainder is defined as 0, so the division is skipped.
+	var skipDiv *obj.Prog
+	switch ci.inst.Op {
+	case ops.I64DivS, ops.I32DivS, ops.I64RemS, ops.I32RemS:
+		// cmp r9, -1
+		prog = builder.NewProg()
+		prog.As = cmp
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_R9
+		prog.To.Type = obj.TYPE_CONST
+		prog.To.Offset = -1
+		builder.AddInstruction(prog)
+		// jne doDiv
+		jmp = builder.NewProg()
+		jmp.As = x86.AJNE
+		jmp.To.Type = obj.TYPE_BRANCH
+		builder.AddInstruction(jmp)
+
+		if ci.inst.Op == ops.I64RemS || ci.inst.Op == ops.I32RemS {
+			// xor rdx, rdx
+			prog = builder.NewProg()
+			prog.As = x86.AXORQ
+			prog.From.Type = obj.TYPE_REG
+			prog.From.Reg = x86.REG_DX
+			prog.To.Type = obj.TYPE_REG
+			prog.To.Reg = x86.REG_DX
+			builder.AddInstruction(prog)
+			// jmp skipDiv
+			skipDiv = builder.NewProg()
+			skipDiv.As = obj.AJMP
+			skipDiv.To.Type = obj.TYPE_BRANCH
+			builder.AddInstruction(skipDiv)
+		} else {
+			// mov rcx, minInt
+			prog = builder.NewProg()
+			prog.As = x86.AMOVQ
+			prog.From.Type = obj.TYPE_CONST
+			prog.From.Offset = minInt
+			prog.To.Type = obj.TYPE_REG
+			prog.To.Reg = x86.REG_CX
+			builder.AddInstruction(prog)
+			// cmp rax, rcx
+			prog = builder.NewProg()
+			prog.As = cmp
+			prog.From.Type = obj.TYPE_REG
+			prog.From.Reg = x86.REG_AX
+			prog.To.Type = obj.TYPE_REG
+			prog.To.Reg = x86.REG_CX
+			builder.AddInstruction(prog)
+			// jne doDiv
+			noOverflow := builder.NewProg()
+			noOverflow.As = x86.AJNE
+			noOverflow.To.Type = obj.TYPE_BRANCH
+			builder.AddInstruction(noOverflow)
+			b.emitExit(builder, CompletionIntegerOverflow|makeExitIndex(ci.idx), false)
+
+			prog = builder.NewProg()
+			prog.As = obj.ANOP // branch target - assembler will optimize out.
+			noOverflow.Pcond = prog
+			builder.AddInstruction(prog)
+		}
+
+		// doDiv:
+		prog = builder.NewProg()
+		prog.As = obj.ANOP // branch target - assembler will optimize out.
+		jmp.Pcond = prog
+		builder.AddInstruction(prog)
+	}
+
+	prog = builder.NewProg()
 	prog.As = x86.AXORQ
 	prog.From.Type = obj.TYPE_REG
 	prog.From.Reg = x86.REG_DX
@@ -1088,13 +1347,19 @@ func (b *AMD64Backend) emitDivide(builder *asm.Builder, ci currentInstruction) {
 		ext.As = x86.ACDQ
 		builder.AddInstruction(ext)
 		prog.As = x86.AIDIVL
-	default:
-		panic(fmt.Sprintf("cannot handle op: %x", ci.inst.Op))
 	}
 	prog.From.Type = obj.TYPE_REG
 	prog.From.Reg = x86.REG_R9
 	builder.AddInstruction(prog)
 
+	if skipDiv != nil {
+		// skipDiv:
+		prog = builder.NewProg()
+		prog.As = obj.ANOP // branch target - assembler will optimize out.
+		skipDiv.Pcond = prog
+		builder.AddInstruction(prog)
+	}
+
 	switch ci.inst.Op {
 	case ops.I64DivU, ops.I32DivU, ops.I64DivS, ops.I32DivS:
 		b.emitSymbolicPushFromReg(builder, ci, x86.REG_AX)
@@ -1252,7 +1517,7 @@ func (b *AMD64Backend) exitInstructions(builder *asm.Builder, status CompletionS
 	retValue.From.Offset = int64(status)
 	retValue.To.Type = obj.TYPE_MEM
 	retValue.To.Reg = x86.REG_SP
-	retValue.To.Offset = 48 // Return value - above jitcall()'s arguments
+	retValue.To.Offset = 56 // Return value - above jitcall()'s arguments
 	ret := builder.NewProg()
 	ret.As = obj.ARET
 	return retValue, ret
@@ -43,7 +43,7 @@ func TestAMD64JitCall(t *testing.T) {
 
 	fakeStack := make([]uint64, 0, 5)
 	fakeLocals := make([]uint64, 0, 0)
-	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 
 	if got, want := len(fakeStack), 0; got != want {
 		t.Errorf("fakeStack.Len = %d, want %d", got, want)
@@ -93,7 +93,7 @@ func TestAMD64StackPush(t *testing.T) {
 
 	fakeStack := make([]uint64, 3, 5)
 	fakeLocals := make([]uint64, 0, 10)
-	if exitSignal := nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil); exitSignal.CompletionStatus() != CompletionOK {
+	if exitSignal := nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil); exitSignal.CompletionStatus() != CompletionOK {
 		t.Fatalf("native execution returned non-ok completion status: %v", exitSignal.CompletionStatus())
 	}
 
@@ -140,7 +140,7 @@ func TestAMD64StackPop(t *testing.T) {
 	fakeStack := make([]uint64, 2, 5)
 	fakeStack[1] = 1337
 	fakeLocals := make([]uint64, 0, 0)
-	if exitSignal := nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil); exitSignal.CompletionStatus() != CompletionOK {
+	if exitSignal := nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil); exitSignal.CompletionStatus() != CompletionOK {
 		t.Fatalf("native execution returned non-ok completion status: %v", exitSignal.CompletionStatus())
 	}
 
@@ -176,7 +176,7 @@ func TestAMD64ExitSignal(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	result := nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+	result := nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 	if result.CompletionStatus() != CompletionOK {
 		t.Errorf("Execution returned non-OK completion status: %v", result.CompletionStatus())
 	}
@@ -201,7 +201,7 @@ func TestAMD64ExitSignal(t *testing.T) {
 	if nativeBlock, err = allocator.AllocateExec(out); err != nil {
 		t.Fatal(err)
 	}
-	result = nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+	result = nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 	if result.CompletionStatus() != CompletionBadBounds {
 		t.Errorf("Execution returned non-BadBounds completion status: %v", result.CompletionStatus())
 	}
@@ -226,7 +226,7 @@ func TestAMD64ExitSignal(t *testing.T) {
 	if nativeBlock, err = allocator.AllocateExec(out); err != nil {
 		t.Fatal(err)
 	}
-	result = nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+	result = nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 	if result.CompletionStatus() != CompletionBadBounds {
 		t.Errorf("Execution returned non-BadBounds completion status: %v", result.CompletionStatus())
 	}
@@ -266,7 +266,7 @@ func TestAMD64LocalsGet(t *testing.T) {
 	fakeLocals := make([]uint64, 2, 2)
 	fakeLocals[0] = 1335
 	fakeLocals[1] = 2
-	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 
 	if got, want := len(fakeStack), 1; got != want {
 		t.Errorf("fakeStack.Len = %d, want %d", got, want)
@@ -308,7 +308,7 @@ func TestAMD64LocalsSet(t *testing.T) {
 	fakeLocals := make([]uint64, 5, 5)
 	fakeLocals[0] = 1335
 	fakeLocals[1] = 2
-	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 
 	if got, want := len(fakeStack), 0; got != want {
 		t.Errorf("fakeStack.Len = %d, want %d", got, want)
@@ -348,7 +348,7 @@ func TestAMD64GlobalsGet(t *testing.T) {
 	fakeStack := make([]uint64, 0, 5)
 	fakeGlobals := make([]uint64, 2, 2)
 	fakeGlobals[0] = 1335
-	nativeBlock.Invoke(&fakeStack, nil, &fakeGlobals, nil)
+	nativeBlock.Invoke(&fakeStack, nil, &fakeGlobals, nil, nil)
 
 	if got, want := len(fakeStack), 1; got != want {
 		t.Errorf("fakeStack.Len = %d, want %d", got, want)
@@ -390,7 +390,7 @@ func TestAMD64GlobalsSet(t *testing.T) {
 	fakeGlobals := make([]uint64, 5, 5)
 	fakeGlobals[0] = 1335
 	fakeGlobals[1] = 2
-	nativeBlock.Invoke(&fakeStack, nil, &fakeGlobals, nil)
+	nativeBlock.Invoke(&fakeStack, nil, &fakeGlobals, nil, nil)
 
 	if got, want := len(fakeStack), 0; got != want {
 		t.Errorf("fakeStack.Len = %d, want %d", got, want)
@@ -434,7 +434,7 @@ func TestAMD64Select(t *testing.T) {
 	fakeStack[0] = 11
 	fakeStack[1] = 2
 	fakeStack[2] = 0
-	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 
 	if got, want := len(fakeStack), 1; got != want {
 		t.Errorf("fakeStack.Len = %d, want %d", got, want)
@@ -509,7 +509,7 @@ func TestAMD64MemoryLoad(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			result := nativeBlock.Invoke(&tc.stack, nil, nil, &tc.mem)
+			result := nativeBlock.Invoke(&tc.stack, nil, nil, &tc.mem, nil)
 			if !tc.oob {
 				if result.CompletionStatus() != CompletionOK {
 					t.Fatalf("Execution returned non-ok completion status: %v", result.CompletionStatus())
@@ -538,6 +538,9 @@ func TestAMD64MemoryStore(t *testing.T) {
 		stack     []uint64
 		expectMem []byte
 		oob       bool
+
+		dirty       []byte
+		expectDirty []byte
 	}{
 		{
 			name:      "i64 within bounds",
@@ -560,6 +563,14 @@ func TestAMD64MemoryStore(t *testing.T) {
 			stack:     []uint64{3, 1335},
 			expectMem: []byte{0, 0, 0, 55, 5, 0, 0},
 		},
+		{
+			name:        "i64 marks the chunks it spans",
+			op:          ops.I64Store,
+			mem:         make([]byte, 3<<DirtyChunkShift),
+			stack:       []uint64{2<<DirtyChunkShift - 4, 1},
+			dirty:       []byte{0, 0, 0},
+			expectDirty: []byte{0, 1, 1},
+		},
 		{
 			name:  "i32 out of bounds",
 			op:    ops.I32Store,
@@ -596,15 +607,22 @@ func TestAMD64MemoryStore(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			result := nativeBlock.Invoke(&tc.stack, nil, nil, &tc.mem)
+			var dirty *[]byte
+			if tc.dirty != nil {
+				dirty = &tc.dirty
+			}
+			result := nativeBlock.Invoke(&tc.stack, nil, nil, &tc.mem, dirty)
 			if !tc.oob {
 				if result.CompletionStatus() != CompletionOK {
 					t.Fatalf("Execution returned non-ok completion status: %v", result.CompletionStatus())
 				}
 
-				if got, want := tc.mem, tc.expectMem; !bytes.Equal(got, want) {
+				if got, want := tc.mem, tc.expectMem; want != nil && !bytes.Equal(got, want) {
 					t.Errorf("mem] = %v, want %v", got, want)
 				}
+				if got, want := tc.dirty, tc.expectDirty; !bytes.Equal(got, want) {
+					t.Errorf("dirty = %v, want %v", got, want)
+				}
 			} else {
 				if result.CompletionStatus() != CompletionBadBounds {
 					t.Errorf("Execution returned non-bounds completion status: %v", result.CompletionStatus())
@@ -718,7 +736,7 @@ func TestAMD64FusedConstStore(t *testing.T) {
 			fakeLocals := make([]uint64, 1)
 			fakeGlobals := make([]uint64, 1)
 			fakeMem := make([]byte, 10)
-			result := nativeBlock.Invoke(&tc.stack, &fakeLocals, &fakeGlobals, &fakeMem)
+			result := nativeBlock.Invoke(&tc.stack, &fakeLocals, &fakeGlobals, &fakeMem, nil)
 			if result.CompletionStatus() != CompletionOK {
 				t.Fatalf("Execution returned non-ok completion status: %v", result.CompletionStatus())
 			}
@@ -855,7 +873,7 @@ func TestAMD64RHSConstOptimizedBinOp(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			result := nativeBlock.Invoke(&tc.stack, nil, nil, nil)
+			result := nativeBlock.Invoke(&tc.stack, nil, nil, nil, nil)
 			if result.CompletionStatus() != CompletionOK {
 				t.Fatalf("Execution returned non-ok completion status: %v", result.CompletionStatus())
 			}
@@ -971,7 +989,7 @@ func TestAMD64OperationsI64(t *testing.T) {
 
 			fakeStack := make([]uint64, 0, 5)
 			fakeLocals := make([]uint64, 0, 0)
-			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 
 			if got, want := len(fakeStack), 1; got != want {
 				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
@@ -992,6 +1010,7 @@ func TestDivOps(t *testing.T) {
 		Op     byte
 		Args   []uint64
 		Result uint64
+		Status CompletionStatus
 	}{
 		{
 			Name:   "I64-unsigned-divide-1",
@@ -1065,6 +1084,48 @@ func TestDivOps(t *testing.T) {
 			Args:   []uint64{u32ConstNegated(8), u32ConstNegated(6)},
 			Result: u32ConstNegated(2),
 		},
+		{
+			Name:   "I64-unsigned-divide-by-zero",
+			Op:     ops.I64DivU,
+			Args:   []uint64{7, 0},
+			Status: CompletionDivideByZero,
+		},
+		{
+			Name:   "I32-unsigned-divide-by-zero",
+			Op:     ops.I32DivU,
+			Args:   []uint64{7, 1 << 32},
+			Status: CompletionDivideByZero,
+		},
+		{
+			Name:   "I64-signed-remainder-by-zero",
+			Op:     ops.I64RemS,
+			Args:   []uint64{7, 0},
+			Status: CompletionDivideByZero,
+		},
+		{
+			Name:   "I64-signed-divide-overflow",
+			Op:     ops.I64DivS,
+			Args:   []uint64{1 << 63, -u64Const(1)},
+			Status: CompletionIntegerOverflow,
+		},
+		{
+			Name:   "I32-signed-divide-overflow",
+			Op:     ops.I32DivS,
+			Args:   []uint64{1 << 31, u32ConstNegated(1)},
+			Status: CompletionIntegerOverflow,
+		},
+		{
+			Name:   "I64-signed-remainder-overflow",
+			Op:     ops.I64RemS,
+			Args:   []uint64{1 << 63, -u64Const(1)},
+			Result: 0,
+		},
+		{
+			Name:   "I32-signed-remainder-overflow",
+			Op:     ops.I32RemS,
+			Args:   []uint64{1 << 31, u32ConstNegated(1)},
+			Result: 0,
+		},
 	}
 
 	allocator := &MMapAllocator{}
@@ -1093,7 +1154,13 @@ func TestDivOps(t *testing.T) {
 
 			fakeStack := make([]uint64, 0, 5)
 			fakeLocals := make([]uint64, 0, 0)
-			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+			exit := nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
+			if got, want := exit.CompletionStatus(), tc.Status; got != want {
+				t.Fatalf("completion status = %v, want %v", got, want)
+			}
+			if tc.Status != CompletionOK {
+				return
+			}
 
 			if got, want := len(fakeStack), 1; got != want {
 				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
@@ -1245,7 +1312,7 @@ func TestComparisonOps64(t *testing.T) {
 
 			fakeStack := make([]uint64, 0, 5)
 			fakeLocals := make([]uint64, 0, 0)
-			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 
 			if got, want := len(fakeStack), 1; got != want {
 				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
@@ -1450,7 +1517,7 @@ func TestAMD64OperationsI32(t *testing.T) {
 
 			fakeStack := make([]uint64, 0, 5)
 			fakeLocals := make([]uint64, 0, 0)
-			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 
 			if got, want := len(fakeStack), 1; got != want {
 				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
@@ -1670,7 +1737,7 @@ func TestAMD64OperationsF64(t *testing.T) {
 
 			fakeStack := make([]uint64, 0, 5)
 			fakeLocals := make([]uint64, 0, 0)
-			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 
 			if got, want := len(fakeStack), 1; got != want {
 				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
@@ -1682,6 +1749,101 @@ func TestAMD64OperationsF64(t *testing.T) {
 	}
 }
 
+func TestAMD64CanonicalNaN(t *testing.T) {
+	if !supportedOS(runtime.GOOS) {
+		t.SkipNow()
+	}
+	payload32 := uint64(math.Float32bits(float32(math.NaN())) | 0x80000123)
+	payload64 := math.Float64bits(math.NaN()) | 0x8000000000000123
+	testCases := []struct {
+		Name   string
+		Op     byte
+		Args   []uint64
+		Result uint64
+	}{
+		{
+			Name:   "f64-zero-div-zero",
+			Op:     ops.F64Div,
+			Args:   []uint64{math.Float64bits(0), math.Float64bits(0)},
+			Result: CanonicalNaN64,
+		},
+		{
+			Name:   "f64-nan-payload",
+			Op:     ops.F64Add,
+			Args:   []uint64{payload64, math.Float64bits(1)},
+			Result: CanonicalNaN64,
+		},
+		{
+			Name:   "f64-min-nan",
+			Op:     ops.F64Min,
+			Args:   []uint64{math.Float64bits(1), payload64},
+			Result: CanonicalNaN64,
+		},
+		{
+			Name:   "f64-not-nan",
+			Op:     ops.F64Mul,
+			Args:   []uint64{math.Float64bits(3), math.Float64bits(-2)},
+			Result: math.Float64bits(-6),
+		},
+		{
+			Name:   "f32-zero-div-zero",
+			Op:     ops.F32Div,
+			Args:   []uint64{uint64(math.Float32bits(0)), uint64(math.Float32bits(0))},
+			Result: uint64(CanonicalNaN32),
+		},
+		{
+			Name:   "f32-nan-payload",
+			Op:     ops.F32Sub,
+			Args:   []uint64{payload32, uint64(math.Float32bits(1))},
+			Result: uint64(CanonicalNaN32),
+		},
+		{
+			Name:   "f32-not-nan",
+			Op:     ops.F32Add,
+			Args:   []uint64{uint64(math.Float32bits(1.5)), uint64(math.Float32bits(2))},
+			Result: uint64(math.Float32bits(3.5)),
+		},
+	}
+
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+	b := &AMD64Backend{CanonicalizeNaNs: true}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			builder, err := asm.NewBuilder("amd64", 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b.emitPreamble(builder)
+			for _, arg := range tc.Args {
+				b.emitPushImmediate(builder, currentInstruction{}, arg)
+			}
+
+			b.emitBinaryFloat(builder, currentInstruction{inst: InstructionMetadata{Op: tc.Op}})
+			b.emitPostamble(builder)
+			b.lowerAMD64(builder)
+			out := builder.Assemble()
+
+			nativeBlock, err := allocator.AllocateExec(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fakeStack := make([]uint64, 0, 5)
+			fakeLocals := make([]uint64, 0, 0)
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
+
+			if got, want := len(fakeStack), 1; got != want {
+				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
+			}
+			if got, want := fakeStack[0], tc.Result; got != want {
+				t.Errorf("fakeStack[0] = %#x, want %#x", got, want)
+			}
+		})
+	}
+}
+
 func TestComparisonOpsFloat(t *testing.T) {
 	if !supportedOS(runtime.GOOS) {
 		t.SkipNow()
@@ -1920,7 +2082,7 @@ func TestComparisonOpsFloat(t *testing.T) {
 
 			fakeStack := make([]uint64, 0, 5)
 			fakeLocals := make([]uint64, 0, 0)
-			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 
 			if got, want := len(fakeStack), 1; got != want {
 				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
@@ -2020,7 +2182,7 @@ func TestAMD64IntToFloat(t *testing.T) {
 
 			fakeStack := make([]uint64, 0, 5)
 			fakeLocals := make([]uint64, 0, 0)
-			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil)
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil, nil, nil)
 
 			if got, want := len(fakeStack), 1; got != want {
 				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
@@ -54,10 +54,10 @@ import (
 // Instead of creating a new stack every time we enter a control structure,
 // we record the current stack height on encountering a control operator.
 // After we leave the sequence, the stack height is restored using the discard
-// operator. A block with a signature will push a value of that type on the parent
+// operator. A block with a signature will push values of those types on the parent
 // stack (that is, the stack of the parent block where this block started). The
-// OpDiscardPreserveTop operator allows us to preserve this value while
-// discarding the remaining ones.
+// OpDiscardPreserveTop and OpDiscardPreserve operators allow us to preserve
+// these values while discarding the remaining ones.
 
 // Branches are rewritten as
 //     <jmp> <addr>
@@ -70,14 +70,18 @@ var (
 	// OpJmpZ jumps to the given address if the value at the top of the stack is zero.
 	OpJmpZ byte = 0x03
 	// OpJmpNz jumps to the given address if the value at the top of the
-	// stack is not zero. It also discards elements and optionally preserves
-	// the topmost value on the stack
+	// stack is not zero. It also discards elements while preserving a
+	// given number of values at the top of the stack.
 	OpJmpNz byte = 0x0d
 	// OpDiscard discards a given number of elements from the execution stack.
 	OpDiscard byte = 0x0b
 	// OpDiscardPreserveTop discards a given number of elements from the
 	// execution stack, while preserving the value on the top of the stack.
 	OpDiscardPreserveTop byte = 0x05
+	// OpDiscardPreserve discards a given number of elements from the
+	// execution stack, while preserving a given number of values at the
+	// top of the stack.
+	OpDiscardPreserve byte = 0x02
 )
 
 const (
@@ -88,19 +92,23 @@ const (
 	// conditional if branch.
 	// Byte 0     - represents the opcode.
 	// Byte 1-8   - represents the branch address.
-	// Byte 9     - 1 if the top of stack should be preserved, 0 otherwise.
-	// Byte 10-18 - number of stack positions to discard.
-	ifBranchLen = 18
+	// Byte 9-16  - number of values at the top of the stack to preserve.
+	// Byte 17-24 - number of stack positions to discard.
+	ifBranchLen = 25
+	// discardPreserveLen represents the number of bytes consumed by a wire
+	// representation of OpDiscardPreserve: the opcode, the number of values
+	// to preserve and the number of stack positions to discard.
+	discardPreserveLen = 17
 )
 
 // Target is the "target" of a br_table instruction.
 // Unlike other control instructions, br_table does jumps and discarding all
 // by itself.
 type Target struct {
-	Addr        int64 // The absolute address of the target
-	Discard     int64 // The number of elements to discard
-	PreserveTop bool  // Whether the top of the stack is to be preserved
-	Return      bool  // Whether to return in order to take this branch/target
+	Addr     int64 // The absolute address of the target
+	Discard  int64 // The number of elements to discard
+	Preserve int64 // The number of values at the top of the stack to preserve
+	Return   bool  // Whether to return in order to take this branch/target
 }
 
 // BranchTable is the structure pointed to by a rewritten br_table instruction.
@@ -176,6 +184,24 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 		})
 	}
 
+	// Helper closure - emits the instruction unwinding the stack as
+	// described by info.
+	emitDiscard := func(info *disasm.StackInfo) {
+		switch info.Preserve {
+		case 0:
+			emitMetadata(OpDiscard, buffer.Len(), instAndInt64Len)
+			buffer.WriteByte(OpDiscard)
+		case 1:
+			emitMetadata(OpDiscardPreserveTop, buffer.Len(), instAndInt64Len)
+			buffer.WriteByte(OpDiscardPreserveTop)
+		default:
+			emitMetadata(OpDiscardPreserve, buffer.Len(), discardPreserveLen)
+			buffer.WriteByte(OpDiscardPreserve)
+			binary.Write(buffer, binary.LittleEndian, int64(info.Preserve))
+		}
+		binary.Write(buffer, binary.LittleEndian, info.StackTopDiff)
+	}
+
 	blocks[-1] = &block{}
 	for _, instr := range disassembly {
 		if instr.Unreachable {
@@ -220,14 +246,7 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 			ifInstr := disassembly[instr.Block.ElseIfIndex] // the corresponding `if` instruction for this else
 			if ifInstr.NewStack != nil && ifInstr.NewStack.StackTopDiff != 0 {
 				// add code for jumping out of a taken if branch
-				op := OpDiscard
-				if ifInstr.NewStack.PreserveTop {
-					op = OpDiscardPreserveTop
-				}
-
-				emitMetadata(op, buffer.Len(), instAndInt64Len)
-				buffer.WriteByte(op)
-				binary.Write(buffer, binary.LittleEndian, ifInstr.NewStack.StackTopDiff)
+				emitDiscard(ifInstr.NewStack)
 			}
 			emitMetadata(OpJmp, buffer.Len(), instAndInt64Len)
 			buffer.WriteByte(OpJmp)
@@ -249,17 +268,9 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 
 			if instr.NewStack.StackTopDiff != 0 {
 				// when exiting a block, discard elements to
-				// restore stack height.
-				op := OpDiscard
-				if instr.NewStack.PreserveTop {
-					// this is true when the block has a
-					// signature, and therefore pushes
-					// a value on to the stack
-					op = OpDiscardPreserveTop
-				}
-				emitMetadata(op, buffer.Len(), instAndInt64Len)
-				buffer.WriteByte(op)
-				binary.Write(buffer, binary.LittleEndian, instr.NewStack.StackTopDiff)
+				// restore stack height, preserving the values
+				// the block pushes on to the stack, if any.
+				emitDiscard(instr.NewStack)
 			}
 
 			if !block.loopBlock { // is a normal block
@@ -284,13 +295,7 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 			continue
 		case ops.Br:
 			if instr.NewStack != nil && instr.NewStack.StackTopDiff != 0 {
-				op := OpDiscard
-				if instr.NewStack.PreserveTop {
-					op = OpDiscardPreserveTop
-				}
-				emitMetadata(op, buffer.Len(), instAndInt64Len)
-				buffer.WriteByte(op)
-				binary.Write(buffer, binary.LittleEndian, instr.NewStack.StackTopDiff)
+				emitDiscard(instr.NewStack)
 			}
 			emitMetadata(OpJmp, buffer.Len(), instAndInt64Len)
 			buffer.WriteByte(OpJmp)
@@ -309,14 +314,14 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 			// write the jump address
 			binary.Write(buffer, binary.LittleEndian, int64(0))
 
-			var stackTopDiff int64
-			// write whether we need to preserve the top
-			if instr.NewStack == nil || !instr.NewStack.PreserveTop || instr.NewStack.StackTopDiff == 0 {
-				buffer.WriteByte(byte(0))
-			} else {
+			var preserve, stackTopDiff int64
+			if instr.NewStack != nil && instr.NewStack.Preserve != 0 && instr.NewStack.StackTopDiff != 0 {
+				preserve = int64(instr.NewStack.Preserve)
 				stackTopDiff = instr.NewStack.StackTopDiff
-				buffer.WriteByte(byte(1))
 			}
+			// write the number of values at the top of the stack we
+			// need to preserve
+			binary.Write(buffer, binary.LittleEndian, preserve)
 			// write the number of elements on the stack we need to discard
 			binary.Write(buffer, binary.LittleEndian, stackTopDiff)
 			continue
@@ -336,14 +341,14 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 
 				branchTable.Targets[i].Return = branch.IsReturn
 				branchTable.Targets[i].Discard = branch.StackTopDiff
-				branchTable.Targets[i].PreserveTop = branch.PreserveTop
+				branchTable.Targets[i].Preserve = int64(branch.Preserve)
 			}
 			defaultLabel := int64(instr.Immediates[len(instr.Immediates)-1].(uint32))
 			branchTable.DefaultTarget.Addr = defaultLabel
 			defaultBranch := instr.Branches[targetCount]
 			branchTable.DefaultTarget.Return = defaultBranch.IsReturn
 			branchTable.DefaultTarget.Discard = defaultBranch.StackTopDiff
-			branchTable.DefaultTarget.PreserveTop = defaultBranch.PreserveTop
+			branchTable.DefaultTarget.Preserve = int64(defaultBranch.Preserve)
 			branchTables = append(branchTables, branchTable)
 			for _, block := range blocks {
 				block.branchTables = append(block.branchTables, branchTable)
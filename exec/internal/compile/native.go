@@ -10,9 +10,22 @@ import (
 	"os/exec"
 )
 
-// NativeCodeUnit represents compiled native code.
+// DirtyChunkShift is the log2 of the size of the chunks of memory tracked
+// by the dirty slice passed to native code: one byte per chunk, set to 1
+// when the chunk is written.
+const DirtyChunkShift = 12
+
+// Bit patterns of the canonical NaNs, which are positive quiet NaNs with
+// no payload, as defined by the WebAssembly spec.
+const (
+	CanonicalNaN32 uint32 = 0x7fc00000
+	CanonicalNaN64 uint64 = 0x7ff8000000000000
+)
+
+// NativeCodeUnit represents compiled native code. dirty may be nil if
+// writes to mem are not tracked; otherwise it must cover all of mem.
 type NativeCodeUnit interface {
-	Invoke(stack, locals, globals *[]uint64, mem *[]byte) JITExitSignal
+	Invoke(stack, locals, globals *[]uint64, mem, dirty *[]byte) JITExitSignal
 }
 
 func debugPrintAsm(asm []byte) {
@@ -31,6 +44,8 @@ const (
 	CompletionBadBounds
 	CompletionUnreachable
 	CompletionFatalInternalError
+	CompletionDivideByZero
+	CompletionIntegerOverflow
 )
 
 func makeExitIndex(idx int) CompletionStatus {
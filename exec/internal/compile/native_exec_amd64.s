@@ -7,8 +7,8 @@
 #include "funcdata.h"
 #include "textflag.h"
 
-// jitcall(*asm, *stackSlice, *localSlice, *globalSlice, *memSlice) uint64
-TEXT ·jitcall(SB),NOSPLIT|NOFRAME,$0-48
+// jitcall(*asm, *stackSlice, *localSlice, *globalSlice, *memSlice, *dirtySlice) uint64
+TEXT ·jitcall(SB),NOSPLIT|NOFRAME,$0-56
         GO_ARGS
         MOVQ asm+0(FP),      AX  // Load the address of the assembly section.
         MOVQ stack+8(FP),    R10 // Load the address of the stack.
@@ -57,6 +57,121 @@ type Metrics struct {
 	FloatOps   int
 }
 
+// addInstruction accounts for an instruction with the given opcode.
+func (m *Metrics) addInstruction(op byte) {
+	// TODO: Add to this table as backends support more opcodes.
+	switch op {
+	case ops.I64Load, ops.I32Load, ops.F64Load, ops.F32Load:
+		fakeBE := &AMD64Backend{}
+		memSize, _ := fakeBE.paramsForMemoryOp(op)
+		m.MemoryReads += memSize
+		m.StackWrites++
+	case ops.I64Store, ops.I32Store, ops.F64Store, ops.F32Store:
+		fakeBE := &AMD64Backend{}
+		memSize, _ := fakeBE.paramsForMemoryOp(op)
+		m.MemoryWrites += memSize
+		m.StackReads += 2
+	case ops.I64Const, ops.I32Const, ops.GetLocal, ops.GetGlobal:
+		m.IntegerOps++
+		m.StackWrites++
+	case ops.F64Const, ops.F32Const:
+		m.FloatOps++
+		m.StackWrites++
+	case ops.SetLocal, ops.SetGlobal:
+		m.IntegerOps++
+		m.StackReads++
+	case ops.I64Eqz:
+		m.IntegerOps++
+		m.StackReads++
+		m.StackWrites++
+
+	case ops.I64Eq, ops.I64Ne, ops.I64LtU, ops.I64GtU, ops.I64LeU, ops.I64GeU,
+		ops.I64Shl, ops.I64ShrU, ops.I64ShrS,
+		ops.I64DivU, ops.I32DivU, ops.I64RemU, ops.I32RemU, ops.I64DivS, ops.I32DivS, ops.I64RemS, ops.I32RemS,
+		ops.I64Add, ops.I32Add, ops.I64Sub, ops.I32Sub, ops.I64Mul, ops.I32Mul,
+		ops.I64And, ops.I32And, ops.I64Or, ops.I32Or, ops.I64Xor, ops.I32Xor:
+		m.IntegerOps++
+		m.StackReads += 2
+		m.StackWrites++
+
+	case ops.F64Add, ops.F32Add, ops.F64Sub, ops.F32Sub, ops.F64Div, ops.F32Div, ops.F64Mul, ops.F32Mul,
+		ops.F64Min, ops.F32Min, ops.F64Max, ops.F32Max,
+		ops.F64Eq, ops.F64Ne, ops.F64Lt, ops.F64Gt, ops.F64Le, ops.F64Ge,
+		ops.F32Eq, ops.F32Ne, ops.F32Lt, ops.F32Gt, ops.F32Le, ops.F32Ge:
+		m.FloatOps++
+		m.StackReads += 2
+		m.StackWrites++
+
+	case ops.F64ConvertUI64, ops.F64ConvertSI64, ops.F32ConvertUI64, ops.F32ConvertSI64,
+		ops.F64ConvertUI32, ops.F64ConvertSI32, ops.F32ConvertUI32, ops.F32ConvertSI32:
+		m.FloatOps++
+		m.StackReads++
+		m.StackWrites++
+
+	case ops.Drop:
+		m.StackReads++
+	case ops.Select:
+		m.StackReads += 3
+		m.StackWrites++
+
+	case ops.F64ReinterpretI64, ops.F32ReinterpretI32, ops.I64ReinterpretF64, ops.I32ReinterpretF32:
+		m.FloatOps++
+		m.IntegerOps++
+	}
+	m.AllOps++
+}
+
+// Split splits the candidate after every instruction for which splitAfter
+// returns true, so that such instructions only ever appear last in the
+// returned candidates. Without metadata, the candidate is left whole.
+func (s CompilationCandidate) Split(meta *BytecodeMetadata, splitAfter func(op byte) bool) []CompilationCandidate {
+	if meta == nil {
+		return []CompilationCandidate{s}
+	}
+	var out []CompilationCandidate
+	cur := CompilationCandidate{Start: s.Start, StartInstruction: s.StartInstruction}
+	for i := s.StartInstruction; i < s.EndInstruction; i++ {
+		inst := meta.Instructions[i]
+		cur.Metrics.addInstruction(inst.Op)
+		cur.EndInstruction = i + 1
+		cur.End = uint(inst.Start) + uint(inst.Size)
+		if splitAfter(inst.Op) && i+1 < s.EndInstruction {
+			out = append(out, cur)
+			next := meta.Instructions[i+1]
+			cur = CompilationCandidate{Start: uint(next.Start), StartInstruction: i + 1}
+		}
+	}
+	return append(out, cur)
+}
+
+// Exclude removes the instructions for which exclude returns true from
+// the candidate, and returns the runs of instructions left around them.
+func (s CompilationCandidate) Exclude(meta *BytecodeMetadata, exclude func(op byte) bool) []CompilationCandidate {
+	var out []CompilationCandidate
+	var cur CompilationCandidate
+	for i := s.StartInstruction; i < s.EndInstruction; i++ {
+		inst := meta.Instructions[i]
+		if exclude(inst.Op) {
+			if cur.Metrics.AllOps > 0 {
+				out = append(out, cur)
+			}
+			cur = CompilationCandidate{}
+			continue
+		}
+		if cur.Metrics.AllOps == 0 {
+			cur.Start = uint(inst.Start)
+			cur.StartInstruction = i
+		}
+		cur.Metrics.addInstruction(inst.Op)
+		cur.EndInstruction = i + 1
+		cur.End = uint(inst.Start) + uint(inst.Size)
+	}
+	if cur.Metrics.AllOps > 0 {
+		out = append(out, cur)
+	}
+	return out
+}
+
 // ScanFunc scans the given function information, emitting selections of
 // bytecode which could be compiled into function code.
 func (s *scanner) ScanFunc(bytecode []byte, meta *BytecodeMetadata) ([]CompilationCandidate, error) {
@@ -89,66 +204,7 @@ func (s *scanner) ScanFunc(bytecode []byte, meta *BytecodeMetadata) ([]Compilati
 		inProgress.EndInstruction = i + 1
 		inProgress.End = uint(inst.Start) + uint(inst.Size)
 
-		// TODO: Add to this table as backends support more opcodes.
-		switch inst.Op {
-		case ops.I64Load, ops.I32Load, ops.F64Load, ops.F32Load:
-			fakeBE := &AMD64Backend{}
-			memSize, _ := fakeBE.paramsForMemoryOp(inst.Op)
-			inProgress.Metrics.MemoryReads += memSize
-			inProgress.Metrics.StackWrites++
-		case ops.I64Store, ops.I32Store, ops.F64Store, ops.F32Store:
-			fakeBE := &AMD64Backend{}
-			memSize, _ := fakeBE.paramsForMemoryOp(inst.Op)
-			inProgress.Metrics.MemoryWrites += memSize
-			inProgress.Metrics.StackReads += 2
-		case ops.I64Const, ops.I32Const, ops.GetLocal, ops.GetGlobal:
-			inProgress.Metrics.IntegerOps++
-			inProgress.Metrics.StackWrites++
-		case ops.F64Const, ops.F32Const:
-			inProgress.Metrics.FloatOps++
-			inProgress.Metrics.StackWrites++
-		case ops.SetLocal, ops.SetGlobal:
-			inProgress.Metrics.IntegerOps++
-			inProgress.Metrics.StackReads++
-		case ops.I64Eqz:
-			inProgress.Metrics.IntegerOps++
-			inProgress.Metrics.StackReads++
-			inProgress.Metrics.StackWrites++
-
-		case ops.I64Eq, ops.I64Ne, ops.I64LtU, ops.I64GtU, ops.I64LeU, ops.I64GeU,
-			ops.I64Shl, ops.I64ShrU, ops.I64ShrS,
-			ops.I64DivU, ops.I32DivU, ops.I64RemU, ops.I32RemU, ops.I64DivS, ops.I32DivS, ops.I64RemS, ops.I32RemS,
-			ops.I64Add, ops.I32Add, ops.I64Sub, ops.I32Sub, ops.I64Mul, ops.I32Mul,
-			ops.I64And, ops.I32And, ops.I64Or, ops.I32Or, ops.I64Xor, ops.I32Xor:
-			inProgress.Metrics.IntegerOps++
-			inProgress.Metrics.StackReads += 2
-			inProgress.Metrics.StackWrites++
-
-		case ops.F64Add, ops.F32Add, ops.F64Sub, ops.F32Sub, ops.F64Div, ops.F32Div, ops.F64Mul, ops.F32Mul,
-			ops.F64Min, ops.F32Min, ops.F64Max, ops.F32Max,
-			ops.F64Eq, ops.F64Ne, ops.F64Lt, ops.F64Gt, ops.F64Le, ops.F64Ge,
-			ops.F32Eq, ops.F32Ne, ops.F32Lt, ops.F32Gt, ops.F32Le, ops.F32Ge:
-			inProgress.Metrics.FloatOps++
-			inProgress.Metrics.StackReads += 2
-			inProgress.Metrics.StackWrites++
-
-		case ops.F64ConvertUI64, ops.F64ConvertSI64, ops.F32ConvertUI64, ops.F32ConvertSI64,
-			ops.F64ConvertUI32, ops.F64ConvertSI32, ops.F32ConvertUI32, ops.F32ConvertSI32:
-			inProgress.Metrics.FloatOps++
-			inProgress.Metrics.StackReads++
-			inProgress.Metrics.StackWrites++
-
-		case ops.Drop:
-			inProgress.Metrics.StackReads++
-		case ops.Select:
-			inProgress.Metrics.StackReads += 3
-			inProgress.Metrics.StackWrites++
-
-		case ops.F64ReinterpretI64, ops.F32ReinterpretI32, ops.I64ReinterpretF64, ops.I32ReinterpretF32:
-			inProgress.Metrics.FloatOps++
-			inProgress.Metrics.IntegerOps++
-		}
-		inProgress.Metrics.AllOps++
+		inProgress.Metrics.addInstruction(inst.Op)
 	}
 
 	// End of instructions - emit the inProgress candidate if
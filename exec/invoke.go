@@ -0,0 +1,363 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/Ankr-network/wagon/wasm"
+)
+
+var (
+	// ErrNoLinearMemory is returned by (*VM).Call when a []byte, string or
+	// CString argument is passed to a module without a linear memory.
+	ErrNoLinearMemory = errors.New("exec: module has no linear memory")
+	// ErrNoResult is returned by (*VM).CallBytes when the function does not
+	// return a value to decode.
+	ErrNoResult = errors.New("exec: function returns no value")
+)
+
+// UnknownExportError is returned when a module does not export anything
+// under the given name.
+type UnknownExportError string
+
+func (e UnknownExportError) Error() string {
+	return fmt.Sprintf("exec: no export named %q", string(e))
+}
+
+// NotAFunctionError is returned by (*VM).ExportedFunction when the module
+// exports something other than a function under the given name.
+type NotAFunctionError struct {
+	Name string
+	Kind wasm.External
+}
+
+func (e NotAFunctionError) Error() string {
+	return fmt.Sprintf("exec: export %q is a %v, not a function", e.Name, e.Kind)
+}
+
+// ArityError is returned when a function is called with arguments that do
+// not match the number of its parameters. It wraps ErrInvalidArgumentCount.
+type ArityError struct {
+	Name   string // name of the function
+	Params int    // number of parameters of the function
+	Args   int    // number of parameters the arguments amount to
+}
+
+func (e ArityError) Error() string {
+	return fmt.Sprintf("exec: function %q takes %d parameters, got %d", e.Name, e.Params, e.Args)
+}
+
+func (e ArityError) Unwrap() error {
+	return ErrInvalidArgumentCount
+}
+
+// ArgumentTypeError is returned by (*VM).Call when an argument cannot be
+// passed as the parameter of the type expected by the function.
+type ArgumentTypeError struct {
+	Index int            // index of the argument
+	Want  wasm.ValueType // type of the parameter
+	Arg   interface{}
+}
+
+func (e ArgumentTypeError) Error() string {
+	return fmt.Sprintf("exec: cannot pass argument %d of type %T as %v", e.Index, e.Arg, e.Want)
+}
+
+// CString is an argument to (*VM).Call that is copied into the linear
+// memory with a terminating NUL byte, and passed as a single pointer.
+type CString string
+
+// BytesEncoding describes how a function returns a sequence of bytes
+// stored in the linear memory, to be decoded by (*VM).CallBytes.
+type BytesEncoding int
+
+const (
+	// LengthPrefixed results point to a 32-bit little-endian length,
+	// immediately followed by that many bytes.
+	LengthPrefixed BytesEncoding = iota
+	// PointerLength results are either a pointer to the bytes followed by
+	// their length, or i64 values, whose low 32 bits hold a pointer to the
+	// bytes, and whose high 32 bits hold their length.
+	PointerLength
+	// NulTerminated results point to bytes terminated by a NUL byte,
+	// which is not part of the result.
+	NulTerminated
+)
+
+// ExportedFunction is a function exported by the module of a VM.
+type ExportedFunction struct {
+	Name  string
+	Index int64 // index of the function in the function index space
+	Sig   *wasm.FunctionSig
+
+	vm *VM
+}
+
+// ExportedFunction returns the function exported by the module under name.
+func (vm *VM) ExportedFunction(name string) (*ExportedFunction, error) {
+	if vm.module.Export == nil {
+		return nil, UnknownExportError(name)
+	}
+	entry, ok := vm.module.Export.Entries[name]
+	if !ok {
+		return nil, UnknownExportError(name)
+	}
+	if entry.Kind != wasm.ExternalFunction {
+		return nil, NotAFunctionError{Name: name, Kind: entry.Kind}
+	}
+	fn := vm.module.GetFunction(int(entry.Index))
+	if fn == nil {
+		return nil, InvalidFunctionIndexError(entry.Index)
+	}
+	return &ExportedFunction{Name: name, Index: int64(entry.Index), Sig: fn.Sig, vm: vm}, nil
+}
+
+// ExportedFunctions returns the functions exported by the module, sorted
+// by name.
+func (vm *VM) ExportedFunctions() []*ExportedFunction {
+	if vm.module.Export == nil {
+		return nil
+	}
+	var fns []*ExportedFunction
+	for name, entry := range vm.module.Export.Entries {
+		if entry.Kind != wasm.ExternalFunction {
+			continue
+		}
+		if fn, err := vm.ExportedFunction(name); err == nil {
+			fns = append(fns, fn)
+		}
+	}
+	sort.Slice(fns, func(i, j int) bool { return fns[i].Name < fns[j].Name })
+	return fns
+}
+
+// Exec executes the function with raw arguments, as (*VM).ExecCode does.
+func (f *ExportedFunction) Exec(args ...uint64) (interface{}, error) {
+	if len(args) != len(f.Sig.ParamTypes) {
+		return nil, ArityError{Name: f.Name, Params: len(f.Sig.ParamTypes), Args: len(args)}
+	}
+	return f.vm.ExecCode(f.Index, "", args...)
+}
+
+// Call executes the function exported by the module under name.
+//
+// Arguments are converted to the parameters of the function as follows:
+// int32 and uint32 are passed as i32, int64 and uint64 as i64, float32
+// as f32 and float64 as f64. []byte and string arguments are copied into
+// the linear memory through the heap of the VM, and passed as two
+// integer parameters: a pointer to the data, then its length. CString
+// arguments are copied with a terminating NUL byte, and passed as a
+// single pointer. Memory allocated for arguments is freed once the
+// function returns.
+//
+// All the results of the function are returned, as int32, int64, float32
+// or float64 values, according to its return types.
+func (vm *VM) Call(name string, args ...interface{}) ([]interface{}, error) {
+	f, err := vm.ExportedFunction(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Call(args...)
+}
+
+// CallBytes executes the function exported by the module under name, as
+// Call does, and returns the bytes its result refers to in the linear
+// memory, decoded according to enc.
+func (vm *VM) CallBytes(name string, enc BytesEncoding, args ...interface{}) ([]byte, error) {
+	f, err := vm.ExportedFunction(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.CallBytes(enc, args...)
+}
+
+// Call executes the function with typed arguments, as (*VM).Call does.
+func (f *ExportedFunction) Call(args ...interface{}) ([]interface{}, error) {
+	res, err := f.callTyped(args)
+	if err != nil {
+		return nil, err
+	}
+	rtrns := make([]interface{}, len(res))
+	for i, t := range f.Sig.ReturnTypes {
+		if rtrns[i], err = f.vm.decodeResult(t, res[i], ""); err != nil {
+			return nil, err
+		}
+	}
+	return rtrns, nil
+}
+
+// CallBytes executes the function with typed arguments, and decodes its
+// result, as (*VM).CallBytes does.
+func (f *ExportedFunction) CallBytes(enc BytesEncoding, args ...interface{}) ([]byte, error) {
+	vm := f.vm
+	res, err := f.callTyped(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) == 0 {
+		return nil, ErrNoResult
+	}
+	var ptr uint64
+	switch t := f.Sig.ReturnTypes[0]; t {
+	case wasm.ValueTypeI32:
+		ptr = uint64(uint32(res[0]))
+	case wasm.ValueTypeI64:
+		ptr = res[0]
+	default:
+		return nil, fmt.Errorf("exec: cannot decode a %v result as bytes", t)
+	}
+
+	switch enc {
+	case LengthPrefixed:
+		prefix, err := vm.memoryRange(ptr, 4)
+		if err != nil {
+			return nil, err
+		}
+		return vm.readBytes(ptr+4, uint64(endianess.Uint32(prefix)))
+	case PointerLength:
+		if len(res) > 1 {
+			return vm.readBytes(ptr, uint64(uint32(res[1])))
+		}
+		return vm.readBytes(ptr&math.MaxUint32, ptr>>32)
+	case NulTerminated:
+		if ptr >= uint64(len(vm.memory)) {
+			return nil, ErrOutOfBoundsMemoryAccess
+		}
+		n := bytes.IndexByte(vm.memory[ptr:], 0)
+		if n < 0 {
+			return nil, ErrOutOfBoundsMemoryAccess
+		}
+		return vm.readBytes(ptr, uint64(n))
+	default:
+		return nil, fmt.Errorf("exec: invalid bytes encoding %d", enc)
+	}
+}
+
+// callTyped converts args to the parameters of the function, executes it,
+// and returns its raw results.
+func (f *ExportedFunction) callTyped(args []interface{}) ([]uint64, error) {
+	vm := f.vm
+	params := f.Sig.ParamTypes
+	n := 0
+	for _, arg := range args {
+		switch arg.(type) {
+		case []byte, string:
+			n += 2
+		default:
+			n++
+		}
+	}
+	if n != len(params) {
+		return nil, ArityError{Name: f.Name, Params: len(params), Args: n}
+	}
+
+	var allocs []uint64
+	defer func() {
+		for _, ptr := range allocs {
+			vm.heap.Free(ptr - vm.heapStart)
+		}
+	}()
+	alloc := func(b []byte) (uint64, error) {
+		if vm.heap == nil || len(vm.memory) == 0 {
+			return 0, ErrNoLinearMemory
+		}
+		ptr, err := vm.SetBytes(b)
+		if err != nil {
+			return 0, err
+		}
+		allocs = append(allocs, ptr)
+		return ptr, nil
+	}
+
+	raw := make([]uint64, 0, len(params))
+	for i, arg := range args {
+		want := params[len(raw)]
+		isInt := want == wasm.ValueTypeI32 || want == wasm.ValueTypeI64
+		switch v := arg.(type) {
+		case int32:
+			if want == wasm.ValueTypeI32 {
+				raw = append(raw, uint64(uint32(v)))
+				continue
+			}
+		case uint32:
+			if want == wasm.ValueTypeI32 {
+				raw = append(raw, uint64(v))
+				continue
+			}
+		case int64:
+			if want == wasm.ValueTypeI64 {
+				raw = append(raw, uint64(v))
+				continue
+			}
+		case uint64:
+			if want == wasm.ValueTypeI64 {
+				raw = append(raw, v)
+				continue
+			}
+		case float32:
+			if want == wasm.ValueTypeF32 {
+				raw = append(raw, uint64(math.Float32bits(v)))
+				continue
+			}
+		case float64:
+			if want == wasm.ValueTypeF64 {
+				raw = append(raw, math.Float64bits(v))
+				continue
+			}
+		case CString:
+			if isInt {
+				ptr, err := alloc([]byte(v))
+				if err != nil {
+					return nil, err
+				}
+				raw = append(raw, ptr)
+				continue
+			}
+		case []byte, string:
+			if isInt {
+				var b []byte
+				if s, ok := v.(string); ok {
+					b = []byte(s)
+				} else {
+					b = v.([]byte)
+				}
+				if params[len(raw)+1] != want {
+					return nil, ArgumentTypeError{Index: i, Want: params[len(raw)+1], Arg: arg}
+				}
+				ptr, err := alloc(b)
+				if err != nil {
+					return nil, err
+				}
+				raw = append(raw, ptr, uint64(len(b)))
+				continue
+			}
+		}
+		return nil, ArgumentTypeError{Index: i, Want: want, Arg: arg}
+	}
+	return vm.execFunc(f.Index, raw)
+}
+
+// memoryRange returns the n bytes of linear memory at ptr.
+func (vm *VM) memoryRange(ptr, n uint64) ([]byte, error) {
+	if ptr > uint64(len(vm.memory)) || n > uint64(len(vm.memory))-ptr {
+		return nil, ErrOutOfBoundsMemoryAccess
+	}
+	return vm.memory[ptr : ptr+n], nil
+}
+
+// readBytes returns a copy of the n bytes of linear memory at ptr.
+func (vm *VM) readBytes(ptr, n uint64) ([]byte, error) {
+	b, err := vm.memoryRange(ptr, n)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), b...), nil
+}
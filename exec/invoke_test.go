@@ -0,0 +1,210 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+// newMemoryVM returns a VM running code, whose module has a linear memory
+// of one page initialized with data, and a heap starting at 1024.
+func newMemoryVM(t *testing.T, sig wasm.FunctionSig, code []byte, data []byte) *VM {
+	m := newTestModule(sig, nil, code)
+	m.Memory = &wasm.SectionMemories{Entries: []wasm.Memory{{Limits: wasm.ResizableLimits{Initial: 1}}}}
+	m.LinearMemoryIndexSpace = [][]byte{data}
+	exportHeapBase(m, 1024)
+	return newTestVM(t, m, gas.NewMeter(1<<30), WithMemoryLayout(StandardLayout))
+}
+
+func TestCall(t *testing.T) {
+	sig := wasm.FunctionSig{
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI64, wasm.ValueTypeF32, wasm.ValueTypeF64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeF64},
+	}
+	code := []byte{
+		ops.GetLocal, 0, ops.F64ConvertSI32,
+		ops.GetLocal, 1, ops.F64ConvertSI64,
+		ops.F64Add,
+		ops.GetLocal, 2, ops.F64PromoteF32,
+		ops.F64Add,
+		ops.GetLocal, 3,
+		ops.F64Add,
+	}
+	vm := newTestVM(t, newTestModule(sig, nil, code), gas.NewMeter(1<<30))
+
+	res, err := vm.Call("main", int32(-1), int64(2), float32(0.5), 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0] != 1.75 {
+		t.Fatalf("got %v, want [1.75]", res)
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []interface{}
+		want error
+	}{
+		{"main", []interface{}{int32(1), int64(2), float32(3)}, ArityError{Name: "main", Params: 4, Args: 3}},
+		{"main", []interface{}{int32(1), int64(2), float32(3), 4.0, 5.0}, ArityError{Name: "main", Params: 4, Args: 5}},
+		{"main", []interface{}{int32(1), "s", float32(3), 4.0}, ArityError{Name: "main", Params: 4, Args: 5}},
+		{"main", []interface{}{int64(1), int64(2), float32(3), 4.0}, ArgumentTypeError{Index: 0, Want: wasm.ValueTypeI32, Arg: int64(1)}},
+		{"main", []interface{}{int32(1), int64(2), 3.0, 4.0}, ArgumentTypeError{Index: 2, Want: wasm.ValueTypeF32, Arg: 3.0}},
+		{"main", []interface{}{int32(1), "s", 4.0}, ArgumentTypeError{Index: 1, Want: wasm.ValueTypeF32, Arg: "s"}},
+		{"nope", nil, UnknownExportError("nope")},
+	} {
+		if _, err := vm.Call(tc.name, tc.args...); err != tc.want {
+			t.Errorf("Call(%q, %v) error = %v, want %v", tc.name, tc.args, err, tc.want)
+		}
+	}
+}
+
+func TestCallBytes(t *testing.T) {
+	// echo returns its pointer and length arguments packed into an i64.
+	echo := []byte{
+		ops.GetLocal, 0, ops.I64ExtendUI32,
+		ops.GetLocal, 1, ops.I64ExtendUI32,
+		ops.I64Const, 32,
+		ops.I64Shl,
+		ops.I64Or,
+	}
+	sig := wasm.FunctionSig{
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+	}
+	vm := newMemoryVM(t, sig, echo, nil)
+	for _, arg := range []interface{}{"hello", []byte{1, 0, 2}, ""} {
+		got, err := vm.CallBytes("main", PointerLength, arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%s", arg); string(got) != want {
+			t.Errorf("PointerLength result = %q, want %q", got, want)
+		}
+	}
+	if stats := vm.heap.(*FreeListHeap).Stats(); stats.Allocations != 0 {
+		t.Errorf("%d argument allocations were not freed", stats.Allocations)
+	}
+
+	// ident returns its pointer argument.
+	vm = newMemoryVM(t, i32ToI32, []byte{ops.GetLocal, 0}, nil)
+	got, err := vm.CallBytes("main", NulTerminated, CString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("NulTerminated result = %q, want %q", got, "hello")
+	}
+	if _, err := vm.CallBytes("main", NulTerminated, uint32(wasmPageSize)); err != ErrOutOfBoundsMemoryAccess {
+		t.Errorf("out of bounds NulTerminated result: error = %v, want %v", err, ErrOutOfBoundsMemoryAccess)
+	}
+
+	vm = newMemoryVM(t, i32ToI32, []byte{ops.GetLocal, 0}, []byte{3, 0, 0, 0, 'a', 'b', 'c', 0xff, 0xff, 0, 0})
+	got, err = vm.CallBytes("main", LengthPrefixed, int32(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abc" {
+		t.Errorf("LengthPrefixed result = %q, want %q", got, "abc")
+	}
+	if _, err := vm.CallBytes("main", LengthPrefixed, int32(7)); err != ErrOutOfBoundsMemoryAccess {
+		t.Errorf("out of bounds LengthPrefixed result: error = %v, want %v", err, ErrOutOfBoundsMemoryAccess)
+	}
+
+	vm = newTestVM(t, newTestModule(i32ToI32, nil, []byte{ops.GetLocal, 0}), gas.NewMeter(1<<30))
+	if _, err := vm.CallBytes("main", NulTerminated, CString("hello")); err != ErrNoLinearMemory {
+		t.Errorf("CString argument without memory: error = %v, want %v", err, ErrNoLinearMemory)
+	}
+}
+
+func TestExportedFunction(t *testing.T) {
+	m := newTestModule(i32ToI32, nil, []byte{ops.GetLocal, 0, ops.I32Const, 1, ops.I32Add})
+	m.Export.Entries["inc"] = wasm.ExportEntry{FieldStr: "inc", Kind: wasm.ExternalFunction, Index: 0}
+	m.Export.Entries["mem"] = wasm.ExportEntry{FieldStr: "mem", Kind: wasm.ExternalMemory, Index: 0}
+	vm := newTestVM(t, m, gas.NewMeter(1<<30))
+
+	f, err := vm.ExportedFunction("inc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Index != 0 || f.Sig != m.FunctionIndexSpace[0].Sig {
+		t.Fatalf("ExportedFunction resolved index %d, sig %v", f.Index, f.Sig)
+	}
+	res, err := f.Exec(41)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != int32(42) {
+		t.Fatalf("Exec(41) = %v, want 42", res)
+	}
+	if _, err := f.Exec(); err != (ArityError{Name: "inc", Params: 1, Args: 0}) {
+		t.Errorf("Exec() error = %v", err)
+	}
+	if _, err := f.Call(int32(1), int32(2)); !errors.Is(err, ErrInvalidArgumentCount) {
+		t.Errorf("Call with 2 arguments: error = %v, want %v", err, ErrInvalidArgumentCount)
+	}
+
+	if _, err := vm.ExportedFunction("mem"); err != (NotAFunctionError{Name: "mem", Kind: wasm.ExternalMemory}) {
+		t.Errorf("ExportedFunction(mem) error = %v", err)
+	}
+	if _, err := vm.ExportedFunction("nope"); err != UnknownExportError("nope") {
+		t.Errorf("ExportedFunction(nope) error = %v", err)
+	}
+
+	var names []string
+	for _, f := range vm.ExportedFunctions() {
+		names = append(names, f.Name)
+		if len(f.Sig.ParamTypes) != 1 || f.Sig.ParamTypes[0] != wasm.ValueTypeI32 {
+			t.Errorf("%s has signature %v", f.Name, f.Sig)
+		}
+	}
+	if fmt.Sprint(names) != "[inc main]" {
+		t.Errorf("ExportedFunctions() = %v, want [inc main]", names)
+	}
+}
+
+func TestMultiValue(t *testing.T) {
+	// pair (i32) -> (i32, i32) is used both by the function and, through
+	// its type index, by the block, which takes the argument as a
+	// parameter and branches out with the two values on top of its stack,
+	// discarding the one below them.
+	pair := wasm.FunctionSig{
+		Form:        wasm.TypeFunc,
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32},
+	}
+	code := []byte{
+		ops.GetLocal, 0,
+		ops.Block, 0,
+		ops.I32Const, 1,
+		ops.I32Add,
+		ops.GetLocal, 0,
+		ops.I32Const, 9,
+		ops.Br, 0,
+		ops.End,
+	}
+	vm := newTestVM(t, newTestModule(pair, nil, code), gas.NewMeter(1<<30))
+
+	res, err := vm.ExecCode(0, "", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res) != "[5 9]" {
+		t.Fatalf("ExecCode = %v, want [5 9]", res)
+	}
+	rtrns, err := vm.Call("main", int32(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rtrns) != 2 || rtrns[0] != int32(5) || rtrns[1] != int32(9) {
+		t.Fatalf("Call = %v, want [5 9]", rtrns)
+	}
+}
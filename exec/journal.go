@@ -0,0 +1,188 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"encoding"
+	"errors"
+)
+
+// journalPageSize is the granularity, in bytes, at which journaled VMs
+// record writes to the linear memory.
+const journalPageSize = 4096
+
+var (
+	// ErrNotJournaled is returned by the transaction methods of VMs
+	// created without EnableJournal.
+	ErrNotJournaled = errors.New("exec: the VM is not journaled")
+	// ErrUnknownSavepoint is returned when releasing or rolling back a
+	// savepoint that is not open.
+	ErrUnknownSavepoint = errors.New("exec: unknown savepoint")
+)
+
+// savepoint holds what a journaled VM needs to roll back to the state it
+// was in when the savepoint was opened.
+type savepoint struct {
+	memSize int            // size of the linear memory
+	pages   map[int][]byte // original content of the pages written since, by index
+	globals map[int]uint64 // original value of the globals written since, by index
+	heap    []byte         // state of the heap, if it is an encoding.BinaryMarshaler
+}
+
+// Commit accepts the writes made to the linear memory and globals since
+// the last call to Commit or Rollback, or since the VM was created or
+// reset, and closes all savepoints.
+//
+// Journaled VMs record the original content of the pages of the linear
+// memory, and of the globals, the first time they are written after a
+// savepoint, along with the size of the memory and the state of the heap.
+// Writes made by the module, by SetBytes, and by Process.WriteAt are
+// journaled, but not writes made through the slice returned by Memory.
+func (vm *VM) Commit() error {
+	if !vm.journaled {
+		return ErrNotJournaled
+	}
+	vm.resetJournal()
+	return nil
+}
+
+// Rollback undoes the writes made to the linear memory and globals since
+// the last call to Commit or Rollback, or since the VM was created or
+// reset, for instance after a call that trapped, and closes all
+// savepoints.
+func (vm *VM) Rollback() error {
+	return vm.RollbackSavepoint(1)
+}
+
+// Savepoint opens a savepoint nested in the current transaction, and in
+// the savepoints already open, and returns its identifier. The
+// transaction itself is savepoint 1.
+func (vm *VM) Savepoint() (int, error) {
+	if !vm.journaled {
+		return 0, ErrNotJournaled
+	}
+	vm.savepoints = append(vm.savepoints, vm.newSavepoint())
+	return len(vm.savepoints), nil
+}
+
+// ReleaseSavepoint closes the savepoint id and those nested in it,
+// keeping their writes, which are then undone if an enclosing savepoint
+// or the transaction is rolled back.
+func (vm *VM) ReleaseSavepoint(id int) error {
+	if !vm.journaled {
+		return ErrNotJournaled
+	}
+	if id < 2 || id > len(vm.savepoints) {
+		return ErrUnknownSavepoint
+	}
+	for len(vm.savepoints) >= id {
+		n := len(vm.savepoints)
+		sp, parent := vm.savepoints[n-1], vm.savepoints[n-2]
+		for page, orig := range sp.pages {
+			if _, ok := parent.pages[page]; !ok && page*journalPageSize < parent.memSize {
+				parent.pages[page] = orig
+			}
+		}
+		for index, orig := range sp.globals {
+			if _, ok := parent.globals[index]; !ok {
+				parent.globals[index] = orig
+			}
+		}
+		vm.savepoints = vm.savepoints[:n-1]
+	}
+	return nil
+}
+
+// RollbackSavepoint undoes the writes made since the savepoint id was
+// opened, and closes it, along with the savepoints nested in it. Rolling
+// back savepoint 1 rolls back the transaction.
+func (vm *VM) RollbackSavepoint(id int) error {
+	if !vm.journaled {
+		return ErrNotJournaled
+	}
+	if id < 1 || id > len(vm.savepoints) {
+		return ErrUnknownSavepoint
+	}
+	for len(vm.savepoints) >= id {
+		n := len(vm.savepoints)
+		sp := vm.savepoints[n-1]
+		for page, orig := range sp.pages {
+			copy(vm.memory[page*journalPageSize:], orig)
+		}
+		vm.memory = vm.memory[:sp.memSize]
+		for index, orig := range sp.globals {
+			vm.globals[index] = orig
+		}
+		if sp.heap != nil {
+			if err := vm.heap.(encoding.BinaryUnmarshaler).UnmarshalBinary(sp.heap); err != nil {
+				return err
+			}
+		}
+		vm.savepoints = vm.savepoints[:n-1]
+	}
+	if len(vm.savepoints) == 0 {
+		vm.savepoints = append(vm.savepoints, vm.newSavepoint())
+	}
+	return nil
+}
+
+// resetJournal discards the savepoints of a journaled VM, and opens the
+// savepoint of a new transaction.
+func (vm *VM) resetJournal() {
+	if !vm.journaled {
+		return
+	}
+	vm.savepoints = append(vm.savepoints[:0], vm.newSavepoint())
+}
+
+func (vm *VM) newSavepoint() *savepoint {
+	sp := &savepoint{
+		memSize: len(vm.memory),
+		pages:   make(map[int][]byte),
+		globals: make(map[int]uint64),
+	}
+	if m, ok := vm.heap.(encoding.BinaryMarshaler); ok {
+		if _, ok := vm.heap.(encoding.BinaryUnmarshaler); ok {
+			sp.heap, _ = m.MarshalBinary()
+		}
+	}
+	return sp
+}
+
+// journalMemory records the original content of the pages holding the n
+// bytes at off, before they are written.
+func (vm *VM) journalMemory(off, n uint64) {
+	if n == 0 || len(vm.savepoints) == 0 {
+		return
+	}
+	sp := vm.savepoints[len(vm.savepoints)-1]
+	for page := int(off / journalPageSize); page <= int((off+n-1)/journalPageSize); page++ {
+		start := page * journalPageSize
+		if start >= sp.memSize {
+			// Pages added since the savepoint are dropped on rollback.
+			break
+		}
+		if _, ok := sp.pages[page]; ok {
+			continue
+		}
+		end := start + journalPageSize
+		if end > sp.memSize {
+			end = sp.memSize
+		}
+		sp.pages[page] = append([]byte(nil), vm.memory[start:end]...)
+	}
+}
+
+// journalGlobal records the original value of the global index, before
+// it is written.
+func (vm *VM) journalGlobal(index int) {
+	if len(vm.savepoints) == 0 {
+		return
+	}
+	sp := vm.savepoints[len(vm.savepoints)-1]
+	if _, ok := sp.globals[index]; !ok {
+		sp.globals[index] = vm.globals[index]
+	}
+}
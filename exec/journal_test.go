@@ -0,0 +1,181 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+// newJournaledVM returns a journaled VM whose main function increments a
+// counter stored in the linear memory, initially 5, and the mutable
+// global 1, then grows the memory and traps if its argument is not 0, or
+// returns the counter otherwise.
+func newJournaledVM(t *testing.T, opts ...VMOption) *VM {
+	code := []byte{
+		ops.I32Const, 0,
+		ops.I32Const, 0,
+		ops.I32Load, 2, 0,
+		ops.I32Const, 1,
+		ops.I32Add,
+		ops.I32Store, 2, 0,
+		ops.GetGlobal, 1,
+		ops.I32Const, 1,
+		ops.I32Add,
+		ops.SetGlobal, 1,
+		ops.GetLocal, 0,
+		ops.If, 0x40,
+		ops.I32Const, 1,
+		ops.GrowMemory, 0,
+		ops.Drop,
+		ops.Unreachable,
+		ops.End,
+		ops.I32Const, 0,
+		ops.I32Load, 2, 0,
+	}
+	m := newTestModule(i32ToI32, nil, code)
+	m.Memory = &wasm.SectionMemories{Entries: []wasm.Memory{{Limits: wasm.ResizableLimits{Initial: 1}}}}
+	m.LinearMemoryIndexSpace = [][]byte{{5, 0, 0, 0}}
+	exportHeapBase(m, 1024)
+	m.GlobalIndexSpace = append(m.GlobalIndexSpace, wasm.GlobalEntry{
+		Type: wasm.GlobalVar{Type: wasm.ValueTypeI32, Mutable: true},
+		Init: []byte{ops.I32Const, 0, ops.End},
+	})
+	return newTestVM(t, m, gas.NewMeter(1<<30), append(opts, EnableJournal(true), WithMemoryLayout(StandardLayout))...)
+}
+
+func TestJournal(t *testing.T) {
+	for _, aot := range []bool{false, true} {
+		vm := newJournaledVM(t, EnableAOT(aot))
+		counter := func() uint32 { return endianess.Uint32(vm.memory) }
+		check := func(when string, wantCounter uint32, wantGlobal uint64) {
+			t.Helper()
+			if got := counter(); got != wantCounter {
+				t.Errorf("AOT %v, %s: counter = %d, want %d", aot, when, got, wantCounter)
+			}
+			if got := vm.globals[1]; got != wantGlobal {
+				t.Errorf("AOT %v, %s: global = %d, want %d", aot, when, got, wantGlobal)
+			}
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err := vm.ExecCode(0, "", 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := vm.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		heap := vm.heap.(*FreeListHeap).Stats()
+
+		if _, err := vm.ExecCode(0, "", 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vm.SetBytes([]byte("temporary")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vm.ExecCode(0, "", 1); err == nil {
+			t.Fatalf("AOT %v: main(1) did not trap", aot)
+		}
+		if len(vm.memory) != 2*wasmPageSize {
+			t.Errorf("AOT %v: memory did not grow before the trap", aot)
+		}
+		if err := vm.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		check("after Rollback", 7, 2)
+		if len(vm.memory) != wasmPageSize {
+			t.Errorf("AOT %v: memory size after Rollback = %d, want %d", aot, len(vm.memory), wasmPageSize)
+		}
+		if got := vm.heap.(*FreeListHeap).Stats(); got != heap {
+			t.Errorf("AOT %v: heap after Rollback = %+v, want %+v", aot, got, heap)
+		}
+
+		outer, err := vm.Savepoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm.ExecCode(0, "", 0)
+		inner, _ := vm.Savepoint()
+		vm.ExecCode(0, "", 0)
+		if err := vm.RollbackSavepoint(inner); err != nil {
+			t.Fatal(err)
+		}
+		check("after rolling back the inner savepoint", 8, 3)
+		inner, _ = vm.Savepoint()
+		vm.ExecCode(0, "", 0)
+		if err := vm.ReleaseSavepoint(inner); err != nil {
+			t.Fatal(err)
+		}
+		check("after releasing the inner savepoint", 9, 4)
+		if err := vm.RollbackSavepoint(outer); err != nil {
+			t.Fatal(err)
+		}
+		check("after rolling back the outer savepoint", 7, 2)
+		if err := vm.ReleaseSavepoint(outer); err != ErrUnknownSavepoint {
+			t.Errorf("AOT %v: releasing a closed savepoint: error = %v, want %v", aot, err, ErrUnknownSavepoint)
+		}
+	}
+
+	vm := newTestVM(t, newTestModule(i32Result, nil, addCode), gas.NewMeter(1<<20))
+	if err := vm.Rollback(); err != ErrNotJournaled {
+		t.Errorf("Rollback on a VM that is not journaled: error = %v, want %v", err, ErrNotJournaled)
+	}
+}
+
+// nestedInvoker runs nested calls on vm, which writes to its memory, then
+// fails with err, if it is not nil.
+type nestedInvoker struct {
+	vm  *VM
+	err error
+}
+
+func (n nestedInvoker) InvokeInternal(contractAddr string, ownerAddr string, callerAddr string, vmContext *VMContext, code []byte, contractName string, method string, params interface{}, rtnType string) (interface{}, error) {
+	vmContext.SetRunningVM(n.vm)
+	if _, err := (&Process{vmContext: vmContext}).WriteAt([]byte{42}, 0); err != nil {
+		return nil, err
+	}
+	return nil, n.err
+}
+
+func TestInvokeInternalSavepoint(t *testing.T) {
+	vm, nested := newJournaledVM(t), newJournaledVM(t)
+	errFailed := errors.New("nested call failed")
+	vm.SetContrInvoker(nestedInvoker{nested, errFailed})
+	vm.vmContext.SetRunningVM(vm)
+	proc := NewProcess(vm)
+
+	if _, err := proc.InvokeInternal("nested", "owner", "contract", nil, "nested", "main", nil, ""); err != errFailed {
+		t.Fatalf("InvokeInternal: error = %v, want %v", err, errFailed)
+	}
+	if nested.memory[0] != 5 || vm.memory[0] != 5 {
+		t.Errorf("counters after a failed nested call = %d, %d, want 5, 5", nested.memory[0], vm.memory[0])
+	}
+	if len(nested.savepoints) != 1 || len(vm.savepoints) != 1 {
+		t.Errorf("%d, %d savepoints open after a nested call, want 1, 1", len(nested.savepoints), len(vm.savepoints))
+	}
+	if proc.VM() != vm {
+		t.Errorf("the calling VM is not running after a nested call")
+	}
+
+	vm.SetContrInvoker(nestedInvoker{nested, nil})
+	if _, err := proc.InvokeInternal("nested", "owner", "contract", nil, "nested", "main", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if nested.memory[0] != 42 || vm.memory[0] != 5 {
+		t.Errorf("counters after a nested call = %d, %d, want 42, 5", nested.memory[0], vm.memory[0])
+	}
+	if len(nested.savepoints) != 1 {
+		t.Errorf("%d savepoints open after a nested call, want 1", len(nested.savepoints))
+	}
+	nested.Rollback()
+	if nested.memory[0] != 5 {
+		t.Errorf("counter after Rollback = %d, want 5", nested.memory[0])
+	}
+}
@@ -7,6 +7,7 @@ package exec
 import (
 	"errors"
 	"fmt"
+	"io"
 	"math"
 
 	"github.com/Ankr-network/wagon/exec/common"
@@ -18,10 +19,10 @@ import (
 var ErrOutOfBoundsMemoryAccess = errors.New("exec: out of bounds memory access")
 
 const (
-	wasmStackSize     = 16384 //16 * 1024
-	vmStackStartIndex = 16384 //16 *1024
-	MinHeapMemorySize = 64 * 1024 //64k
-	MaxHeapMemorySize = 1024 *1024 //1M
+	wasmStackSize     = 16384       //16 * 1024
+	vmStackStartIndex = 16384       //16 *1024
+	MinHeapMemorySize = 64 * 1024   //64k
+	MaxHeapMemorySize = 1024 * 1024 //1M
 )
 
 var (
@@ -30,191 +31,139 @@ var (
 
 type memory []byte
 
-func (vm *VM) fetchBaseAddr() int {
-	return int(vm.fetchUint32() + uint32(vm.popInt32()))
+// effectiveAddr pops the base address of a memory access of size bytes
+// from the stack, and returns its effective address: the sum of the base
+// address and the offset immediate, computed on 33 bits so that it never
+// wraps around. The VM traps if the access is out of bounds.
+func (vm *VM) effectiveAddr(size uint64) int {
+	addr := uint64(vm.fetchUint32()) + uint64(vm.popUint32())
+	if addr+size > uint64(len(vm.memory)) {
+		vm.trap(TrapOutOfBoundsMemoryAccess, ErrOutOfBoundsMemoryAccess)
+	}
+	return int(addr)
 }
 
-// inBounds returns true when the next vm.fetchBaseAddr() + offset
-// indices are in bounds accesses to the linear memory.
-func (vm *VM) inBounds(offset int) bool {
-	addr := endianess.Uint32(vm.ctx.code[vm.ctx.pc:]) + uint32(vm.ctx.stack[len(vm.ctx.stack)-1])
-	return int(addr)+offset < len(vm.memory)
+// storeAddr returns the effective address of a store of size bytes, as
+// effectiveAddr does, and records the store with recordWrite.
+func (vm *VM) storeAddr(size uint64) int {
+	addr := vm.effectiveAddr(size)
+	if vm.journaled || vm.trackDirty {
+		vm.recordWrite(uint64(addr), size)
+	}
+	return addr
 }
 
-// curMem returns a slice to the memory segment pointed to by
-// the current base address on the bytecode stream.
-func (vm *VM) curMem() []byte {
-	return vm.memory[vm.fetchBaseAddr():]
+// recordWrite records a write of n bytes at off in the journal of
+// journaled VMs, and in the dirty chunks of VMs tracking them, before it
+// is made.
+func (vm *VM) recordWrite(off, n uint64) {
+	if vm.journaled {
+		vm.journalMemory(off, n)
+	}
+	if vm.trackDirty {
+		vm.markDirty(off, n)
+	}
 }
 
 func (vm *VM) i32Load() {
-	if !vm.inBounds(3) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushUint32(endianess.Uint32(vm.curMem()))
+	vm.pushUint32(endianess.Uint32(vm.memory[vm.effectiveAddr(4):]))
 }
 
 func (vm *VM) i32Load8s() {
-	if !vm.inBounds(0) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushInt32(int32(int8(vm.memory[vm.fetchBaseAddr()])))
+	vm.pushInt32(int32(int8(vm.memory[vm.effectiveAddr(1)])))
 }
 
 func (vm *VM) i32Load8u() {
-	if !vm.inBounds(0) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushUint32(uint32(uint8(vm.memory[vm.fetchBaseAddr()])))
+	vm.pushUint32(uint32(uint8(vm.memory[vm.effectiveAddr(1)])))
 }
 
 func (vm *VM) i32Load16s() {
-	if !vm.inBounds(1) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushInt32(int32(int16(endianess.Uint16(vm.curMem()))))
+	vm.pushInt32(int32(int16(endianess.Uint16(vm.memory[vm.effectiveAddr(2):]))))
 }
 
 func (vm *VM) i32Load16u() {
-	if !vm.inBounds(1) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushUint32(uint32(endianess.Uint16(vm.curMem())))
+	vm.pushUint32(uint32(endianess.Uint16(vm.memory[vm.effectiveAddr(2):])))
 }
 
 func (vm *VM) i64Load() {
-	if !vm.inBounds(7) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushUint64(endianess.Uint64(vm.curMem()))
+	vm.pushUint64(endianess.Uint64(vm.memory[vm.effectiveAddr(8):]))
 }
 
 func (vm *VM) i64Load8s() {
-	if !vm.inBounds(0) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushInt64(int64(int8(vm.memory[vm.fetchBaseAddr()])))
+	vm.pushInt64(int64(int8(vm.memory[vm.effectiveAddr(1)])))
 }
 
 func (vm *VM) i64Load8u() {
-	if !vm.inBounds(0) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushUint64(uint64(uint8(vm.memory[vm.fetchBaseAddr()])))
+	vm.pushUint64(uint64(uint8(vm.memory[vm.effectiveAddr(1)])))
 }
 
 func (vm *VM) i64Load16s() {
-	if !vm.inBounds(1) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushInt64(int64(int16(endianess.Uint16(vm.curMem()))))
+	vm.pushInt64(int64(int16(endianess.Uint16(vm.memory[vm.effectiveAddr(2):]))))
 }
 
 func (vm *VM) i64Load16u() {
-	if !vm.inBounds(1) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushUint64(uint64(endianess.Uint16(vm.curMem())))
+	vm.pushUint64(uint64(endianess.Uint16(vm.memory[vm.effectiveAddr(2):])))
 }
 
 func (vm *VM) i64Load32s() {
-	if !vm.inBounds(3) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushInt64(int64(int32(endianess.Uint32(vm.curMem()))))
+	vm.pushInt64(int64(int32(endianess.Uint32(vm.memory[vm.effectiveAddr(4):]))))
 }
 
 func (vm *VM) i64Load32u() {
-	if !vm.inBounds(3) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushUint64(uint64(endianess.Uint32(vm.curMem())))
+	vm.pushUint64(uint64(endianess.Uint32(vm.memory[vm.effectiveAddr(4):])))
 }
 
 func (vm *VM) f32Store() {
 	v := math.Float32bits(vm.popFloat32())
-	if !vm.inBounds(3) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	endianess.PutUint32(vm.curMem(), v)
+	endianess.PutUint32(vm.memory[vm.storeAddr(4):], v)
 }
 
 func (vm *VM) f32Load() {
-	if !vm.inBounds(3) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushFloat32(math.Float32frombits(endianess.Uint32(vm.curMem())))
+	vm.pushFloat32(math.Float32frombits(endianess.Uint32(vm.memory[vm.effectiveAddr(4):])))
 }
 
 func (vm *VM) f64Store() {
 	v := math.Float64bits(vm.popFloat64())
-	if !vm.inBounds(7) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	endianess.PutUint64(vm.curMem(), v)
+	endianess.PutUint64(vm.memory[vm.storeAddr(8):], v)
 }
 
 func (vm *VM) f64Load() {
-	if !vm.inBounds(7) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.pushFloat64(math.Float64frombits(endianess.Uint64(vm.curMem())))
+	vm.pushFloat64(math.Float64frombits(endianess.Uint64(vm.memory[vm.effectiveAddr(8):])))
 }
 
 func (vm *VM) i32Store() {
 	v := vm.popUint32()
-	if !vm.inBounds(3) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	endianess.PutUint32(vm.curMem(), v)
+	endianess.PutUint32(vm.memory[vm.storeAddr(4):], v)
 }
 
 func (vm *VM) i32Store8() {
 	v := byte(uint8(vm.popUint32()))
-	if !vm.inBounds(0) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.memory[vm.fetchBaseAddr()] = v
+	vm.memory[vm.storeAddr(1)] = v
 }
 
 func (vm *VM) i32Store16() {
 	v := uint16(vm.popUint32())
-	if !vm.inBounds(1) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	endianess.PutUint16(vm.curMem(), v)
+	endianess.PutUint16(vm.memory[vm.storeAddr(2):], v)
 }
 
 func (vm *VM) i64Store() {
 	v := vm.popUint64()
-	if !vm.inBounds(7) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	endianess.PutUint64(vm.curMem(), v)
+	endianess.PutUint64(vm.memory[vm.storeAddr(8):], v)
 }
 
 func (vm *VM) i64Store8() {
 	v := byte(uint8(vm.popUint64()))
-	if !vm.inBounds(0) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	vm.memory[vm.fetchBaseAddr()] = v
+	vm.memory[vm.storeAddr(1)] = v
 }
 
 func (vm *VM) i64Store16() {
 	v := uint16(vm.popUint64())
-	if !vm.inBounds(1) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	endianess.PutUint16(vm.curMem(), v)
+	endianess.PutUint16(vm.memory[vm.storeAddr(2):], v)
 }
 
 func (vm *VM) i64Store32() {
 	v := uint32(vm.popUint64())
-	if !vm.inBounds(3) {
-		panic(ErrOutOfBoundsMemoryAccess)
-	}
-	endianess.PutUint32(vm.curMem(), v)
+	endianess.PutUint32(vm.memory[vm.storeAddr(4):], v)
 }
 
 func (vm *VM) currentMemory() {
@@ -222,12 +171,41 @@ func (vm *VM) currentMemory() {
 	vm.pushInt32(int32(len(vm.memory) / wasmPageSize))
 }
 
+// growMemory grows the linear memory by n pages, and pushes its previous
+// size in pages, or -1 if it cannot grow that much. Native code is handed
+// the linear memory on every invocation, so it always sees its current size.
 func (vm *VM) growMemory() {
 	_ = vm.fetchInt8() // reserved (https://github.com/WebAssembly/design/blob/27ac254c854994103c24834a994be16f74f54186/BinaryEncoding.md#memory-related-operators-described-here)
-	curLen := len(vm.memory) / wasmPageSize
-	n := vm.popInt32()
-	vm.module.HeapMem.GrowMemory(uint(n*wasmPageSize))
-	vm.pushInt32(int32(curLen))
+	curPages := uint32(len(vm.memory) / wasmPageSize)
+	n := vm.popUint32()
+	if uint64(curPages)+uint64(n) > uint64(vm.memoryPageLimit()) {
+		vm.pushInt32(-1)
+		return
+	}
+	vm.spendGas(vm.schedule().GrowMemoryCost(n))
+	if n > 0 {
+		if vm.heap != nil {
+			if err := vm.heap.GrowMemory(uint(n) * wasmPageSize); err != nil {
+				vm.pushInt32(-1)
+				return
+			}
+		}
+		vm.memory = append(vm.memory, make([]byte, int(n)*wasmPageSize)...)
+	}
+	vm.pushUint32(curPages)
+}
+
+// memoryPageLimit returns the number of pages the linear memory can grow
+// to: the maximum declared by the module, if any, capped by the host.
+func (vm *VM) memoryPageLimit() uint32 {
+	if vm.module.Memory == nil || len(vm.module.Memory.Entries) == 0 {
+		return 0
+	}
+	limit := vm.maxMemoryPages
+	if l := vm.module.Memory.Entries[0].Limits; l.Flags&1 != 0 && l.Maximum < limit {
+		limit = l.Maximum
+	}
+	return limit
 }
 
 func (vm *VM) heapBase() (int32, error) {
@@ -235,9 +213,12 @@ func (vm *VM) heapBase() (int32, error) {
 		return -1, errors.New("vm module nil")
 	}
 
+	if vm.module.Export == nil {
+		return -1, errors.New("there is no __heap_base")
+	}
 	hbExportEntry, ok := vm.module.Export.Entries["__heap_base"]
 	if !ok {
-	   return -1, errors.New("there is no __heap_base")
+		return -1, errors.New("there is no __heap_base")
 	}
 
 	if hbExportEntry.Kind != wasm.ExternalGlobal {
@@ -257,12 +238,67 @@ func (vm *VM) heapBase() (int32, error) {
 	return heapBaseIndex.(int32), nil
 }
 
+// MemoryLayout describes how a VM lays out the linear memory of a module.
+type MemoryLayout int
+
+const (
+	// ContractLayout reserves the first wasmStackSize bytes of the linear
+	// memory for the stack, discarding the data segments placed there, and
+	// manages a heap of at least MinHeapMemorySize bytes placed above
+	// __heap_base, which the module must export.
+	ContractLayout MemoryLayout = iota
+	// StandardLayout sizes the linear memory as declared by the module, and
+	// applies its data segments at their offsets, as per the WebAssembly
+	// spec. The heap managed by the heap of the VM starts at __heap_base
+	// if the module exports it, and is empty otherwise.
+	StandardLayout
+)
+
+// ErrDataSegmentOutOfBounds is returned by NewVM when the data segments
+// of a module do not fit in its initial linear memory.
+var ErrDataSegmentOutOfBounds = errors.New("exec: data segment does not fit in the linear memory")
+
 func (vm *VM) initMemory() error {
-	if vm.module  == nil {
+	if vm.module == nil {
 		return errors.New("vm module nil")
 	}
+	if vm.layout == ContractLayout {
+		return vm.initContractMemory()
+	}
+
+	initial := vm.module.Memory.Entries[0].Limits.Initial
+	if initial > vm.maxMemoryPages {
+		return fmt.Errorf("exec: initial memory of %d pages exceeds the limit of %d pages", initial, vm.maxMemoryPages)
+	}
+	vm.memory = vm.zeroedMemory(uint64(initial) * wasmPageSize)
+	if len(vm.module.LinearMemoryIndexSpace[0]) > len(vm.memory) {
+		return ErrDataSegmentOutOfBounds
+	}
+	copy(vm.memory, vm.module.LinearMemoryIndexSpace[0])
+
+	vm.heapStart = uint64(len(vm.memory))
+	if base, err := vm.heapBase(); err == nil && uint64(uint32(base)) < vm.heapStart {
+		vm.heapStart = uint64(uint32(base))
+	}
+	vm.heap.Init(uint(uint64(len(vm.memory)) - vm.heapStart))
+	return nil
+}
+
+// zeroedMemory returns n zeroed bytes for the linear memory, reusing its
+// current buffer when it is large enough.
+func (vm *VM) zeroedMemory(n uint64) []byte {
+	if uint64(cap(vm.memory)) < n {
+		return make([]byte, n)
+	}
+	mem := vm.memory[:n]
+	for i := range mem {
+		mem[i] = 0
+	}
+	return mem
+}
 
-	initSize := uint(vm.module.Memory.Entries[0].Limits.Initial)*wasmPageSize
+func (vm *VM) initContractMemory() error {
+	initSize := uint(vm.module.Memory.Entries[0].Limits.Initial) * wasmPageSize
 	if !common.IsPowOf2(initSize) {
 		initSize = common.FixSize(initSize)
 	}
@@ -275,10 +311,14 @@ func (vm *VM) initMemory() error {
 	if err != nil {
 		return err
 	}
-	vm.memory  = make([]byte, uint(heapBaseIndex) + initSize)
-	vm.module.HeapMem.Init(initSize)
+	// The memory is rounded up to whole pages, as memory.size and
+	// memory.grow count them, and the heap extends to its end.
+	size := (uint64(heapBaseIndex) + uint64(initSize) + wasmPageSize - 1) &^ (wasmPageSize - 1)
+	vm.memory = vm.zeroedMemory(size)
+	vm.heapStart = uint64(heapBaseIndex)
+	vm.heap.Init(uint(size - vm.heapStart))
 
-	if vm.module.LinearMemoryIndexSpace[0] != nil {
+	if len(vm.module.LinearMemoryIndexSpace[0]) > wasmStackSize {
 		copy(vm.memory[vmStackStartIndex:], vm.module.LinearMemoryIndexSpace[0][wasmStackSize:])
 	}
 
@@ -286,11 +326,11 @@ func (vm *VM) initMemory() error {
 }
 
 func (vm *VM) initDelegateModuleMemory(module *wasm.Module) error {
-	if module  == nil {
+	if module == nil {
 		return errors.New("vm module nil")
 	}
 
-	initSize := uint(vm.module.Memory.Entries[0].Limits.Initial)*wasmPageSize
+	initSize := uint(vm.module.Memory.Entries[0].Limits.Initial) * wasmPageSize
 	if !common.IsPowOf2(initSize) {
 		initSize = common.FixSize(initSize)
 	}
@@ -303,8 +343,8 @@ func (vm *VM) initDelegateModuleMemory(module *wasm.Module) error {
 	if err != nil {
 		return err
 	}
-	vm.memory  = make([]byte, uint(heapBaseIndex) + initSize)
-	vm.module.HeapMem.Init(initSize)
+	vm.memory = make([]byte, uint(heapBaseIndex)+initSize)
+	vm.heap.Init(initSize)
 
 	if vm.module.LinearMemoryIndexSpace[0] != nil {
 		copy(vm.memory[vmStackStartIndex:], vm.module.LinearMemoryIndexSpace[0][wasmStackSize:])
@@ -314,7 +354,7 @@ func (vm *VM) initDelegateModuleMemory(module *wasm.Module) error {
 }
 
 func (vm *VM) Strlen(memIndex uint) (int, error) {
-	memLen :=len(vm.memory)
+	memLen := len(vm.memory)
 	if memIndex >= uint(memLen) {
 		return 0, InvalidMemIndex
 	}
@@ -326,15 +366,11 @@ func (vm *VM) Strlen(memIndex uint) (int, error) {
 		s++
 	}
 
-	if memIndex < vmStackStartIndex && (memIndex + uint(l)) >= vmStackStartIndex {
+	if vm.layout == ContractLayout && memIndex < vmStackStartIndex && (memIndex+uint(l)) >= vmStackStartIndex {
 		return 0, InvalidMemIndex
 	}
 
-	heapBaseIndex, err := vm.heapBase()
-	if err != nil {
-		return 0, err
-	}
-	if memIndex < uint(heapBaseIndex) && (memIndex + uint(l)) >= uint(heapBaseIndex) {
+	if memIndex < uint(vm.heapStart) && (memIndex+uint(l)) >= uint(vm.heapStart) {
 		return 0, InvalidMemIndex
 	}
 
@@ -342,7 +378,7 @@ func (vm *VM) Strlen(memIndex uint) (int, error) {
 }
 
 func (vm *VM) Strcmp(memIndex1 uint, memIndex2 uint) (int, error) {
-	memLen :=len(vm.memory)
+	memLen := len(vm.memory)
 	if memIndex1 >= uint(memLen) || memIndex2 >= uint(memLen) {
 		return 0, InvalidMemIndex
 	}
@@ -354,7 +390,7 @@ func (vm *VM) Strcmp(memIndex1 uint, memIndex2 uint) (int, error) {
 	}
 
 	minLen := common.MinI(len1, len2)
-	for i:= uint(0); i < uint(minLen); i++ {
+	for i := uint(0); i < uint(minLen); i++ {
 		if vm.memory[memIndex1+i] == vm.memory[memIndex2+i] {
 			continue
 		} else if vm.memory[memIndex1+i] < vm.memory[memIndex2+i] {
@@ -368,29 +404,33 @@ func (vm *VM) Strcmp(memIndex1 uint, memIndex2 uint) (int, error) {
 		return 1, nil
 	} else if len1 < len2 {
 		return -1, nil
-	}else {
+	} else {
 		return 0, nil
 	}
 }
 
 func (vm *VM) SetBytes(bytes []byte) (uint64, error) {
-	lenBytes   := len(bytes)
-	index, err := vm.module.HeapMem.Malloc(uint(lenBytes + 1))
+	lenBytes := len(bytes)
+	index, err := vm.heap.Malloc(uint(lenBytes + 1))
 	if err != nil {
 		return 0, err
 	}
 
-	heapBaseIndex, _ := vm.heapBase()
-	index = index + uint64(heapBaseIndex)
+	index = index + vm.heapStart
+	if vm.journaled || vm.trackDirty {
+		vm.recordWrite(index, uint64(lenBytes)+1)
+	}
 
 	copy(vm.memory[index:index+uint64(lenBytes)], bytes)
 	vm.memory[index+uint64(lenBytes)] = byte(0)
 
-    return index, nil
+	return index, nil
 }
 
 // ReadAt implements the ReaderAt interface: it copies into p
-// the content of memory at offset off.
+// the content of memory at offset off, up to the first NUL byte.
+// Reaching the end of the memory before filling p or finding
+// a NUL byte returns io.EOF.
 func (vm *VM) ReadAt(p []byte, off int64) (int, error) {
 	var length int
 
@@ -399,13 +439,19 @@ func (vm *VM) ReadAt(p []byte, off int64) (int, error) {
 	if p == nil || len(p) == 0 {
 		return 0, errors.New("the read buf invalid")
 	}
+	if off < 0 {
+		return 0, errors.New("the read offset invalid")
+	}
 
 	step := off
-	for length =0; length < len(p) && mem[step] != byte(0); {
+	for length = 0; length < len(p) && step < int64(len(mem)) && mem[step] != byte(0); {
 		p[length] = mem[step]
 		length++
 		step++
 	}
+	if length < len(p) && step >= int64(len(mem)) {
+		return length, io.EOF
+	}
 
 	return length, nil
 }
@@ -0,0 +1,213 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+// growCode grows the memory by its argument, then stores 42 at the end of
+// the memory and returns the result of grow_memory.
+var growCode = []byte{
+	ops.GetLocal, 0,
+	ops.GrowMemory, 0,
+	ops.CurrentMemory, 0,
+	ops.I32Const, 16, // 65536 = 1 << 16
+	ops.I32Shl,
+	ops.I32Const, 4,
+	ops.I32Sub,
+	ops.I32Const, 42,
+	ops.I32Store, 2, 0,
+}
+
+// newGrowVM returns a VM running growCode, with a linear memory of one
+// page that the module allows to grow to maxPages.
+func newGrowVM(t *testing.T, metric gas.GasMetric, maxPages uint32, opts ...VMOption) *VM {
+	m := newTestModule(i32ToI32, nil, growCode)
+	vm := newTestVM(t, m, metric, opts...)
+	m.Memory = &wasm.SectionMemories{Entries: []wasm.Memory{{Limits: wasm.ResizableLimits{Flags: 1, Initial: 1, Maximum: maxPages}}}}
+	vm.memory = make([]byte, wasmPageSize)
+	return vm
+}
+
+func TestGrowMemory(t *testing.T) {
+	metric := gas.NewMeter(1 << 30)
+	vm := newGrowVM(t, metric, 4)
+
+	used := metric.Used()
+	if _, err := vm.ExecCode(0, "", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(vm.memory), 3*wasmPageSize; got != want {
+		t.Fatalf("memory is %d bytes, want %d", got, want)
+	}
+	if got := endianess.Uint32(vm.memory[len(vm.memory)-4:]); got != 42 {
+		t.Fatalf("store after grow_memory wrote %d, want 42", got)
+	}
+	if metric.Used()-used < 2*gas.GasMemoryPage {
+		t.Fatalf("growing 2 pages used %d gas, want at least %d", metric.Used()-used, 2*gas.GasMemoryPage)
+	}
+
+	// Growing past the module's maximum fails, and leaves memory as is.
+	vm.memory = vm.memory[:wasmPageSize]
+	for _, n := range []uint64{4, 0xffffffff} {
+		res, err := vm.ExecCode(0, "", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.(int32) != -1 {
+			t.Fatalf("grow_memory(%d) returned %d, want -1", n, res)
+		}
+		if got := len(vm.memory); got != wasmPageSize {
+			t.Fatalf("grow_memory(%d) resized the memory to %d bytes", n, got)
+		}
+	}
+}
+
+func TestGrowMemoryResult(t *testing.T) {
+	code := []byte{ops.GetLocal, 0, ops.GrowMemory, 0}
+	for _, tc := range []struct {
+		maxPages, hostPages uint32
+		n                   uint64
+		want                int32
+	}{
+		{maxPages: 4, n: 0, want: 1},
+		{maxPages: 4, n: 3, want: 1},
+		{maxPages: 4, n: 4, want: -1},
+		{maxPages: 4, hostPages: 2, n: 1, want: 1},
+		{maxPages: 4, hostPages: 2, n: 2, want: -1},
+	} {
+		m := newTestModule(i32ToI32, nil, code)
+		vm := newTestVM(t, m, gas.NewMeter(1<<30), WithMaxMemoryPages(tc.hostPages))
+		m.Memory = &wasm.SectionMemories{Entries: []wasm.Memory{{Limits: wasm.ResizableLimits{Flags: 1, Initial: 1, Maximum: tc.maxPages}}}}
+		vm.memory = make([]byte, wasmPageSize)
+
+		res, err := vm.ExecCode(0, "", tc.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.(int32) != tc.want {
+			t.Errorf("%+v: grow_memory returned %d, want %d", tc, res, tc.want)
+		}
+	}
+}
+
+// newLayoutVM returns a VM laid out with layout, whose module has a linear
+// memory of pages pages, initialized with data, and exports heapBase as
+// __heap_base unless it is negative.
+func newLayoutVM(t *testing.T, layout MemoryLayout, pages uint32, data []byte, heapBase int32) (*VM, error) {
+	m := newTestModule(i32Result, nil, []byte{ops.I32Const, 0})
+	vm := newTestVM(t, m, gas.NewMeter(1<<30), WithMemoryLayout(layout))
+	m.Memory = &wasm.SectionMemories{Entries: []wasm.Memory{{Limits: wasm.ResizableLimits{Initial: pages}}}}
+	m.LinearMemoryIndexSpace = [][]byte{data}
+	vm.heap = NewFreeListHeap()
+	if heapBase >= 0 {
+		exportHeapBase(m, heapBase)
+	}
+	return vm, vm.initMemory()
+}
+
+// exportHeapBase adds a global holding heapBase to m, and exports it as
+// __heap_base.
+func exportHeapBase(m *wasm.Module, heapBase int32) {
+	m.GlobalIndexSpace = append(m.GlobalIndexSpace, wasm.GlobalEntry{
+		Type: wasm.GlobalVar{Type: wasm.ValueTypeI32},
+		Init: []byte{ops.I32Const, byte(heapBase) | 0x80, byte(heapBase>>7) | 0x80, byte(heapBase>>14) | 0x80, byte(heapBase>>21) & 0x7f, ops.End},
+	})
+	m.Export.Entries["__heap_base"] = wasm.ExportEntry{
+		FieldStr: "__heap_base",
+		Kind:     wasm.ExternalGlobal,
+		Index:    uint32(len(m.GlobalIndexSpace) - 1),
+	}
+}
+
+func TestStandardLayout(t *testing.T) {
+	data := make([]byte, 100)
+	data[0], data[99] = 1, 2
+
+	vm, err := newLayoutVM(t, StandardLayout, 1, data, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(vm.memory), wasmPageSize; got != want {
+		t.Fatalf("memory is %d bytes, want %d", got, want)
+	}
+	if vm.memory[0] != 1 || vm.memory[99] != 2 {
+		t.Fatalf("data segment not applied at its offset")
+	}
+	if got := vm.heap.(*FreeListHeap).Stats().Size; got != 0 {
+		t.Fatalf("heap is %d bytes without __heap_base, want 0", got)
+	}
+
+	vm, err = newLayoutVM(t, StandardLayout, 1, data, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := vm.heapStart, uint64(1024); got != want {
+		t.Fatalf("heap starts at %d, want %d", got, want)
+	}
+	if got, want := vm.heap.(*FreeListHeap).Stats().Size, uint64(wasmPageSize-1024); got != want {
+		t.Fatalf("heap is %d bytes, want %d", got, want)
+	}
+
+	if _, err := newLayoutVM(t, StandardLayout, 0, data, -1); err != ErrDataSegmentOutOfBounds {
+		t.Fatalf("data segment past the end of memory: got %v, want %v", err, ErrDataSegmentOutOfBounds)
+	}
+}
+
+func TestContractLayout(t *testing.T) {
+	data := make([]byte, wasmStackSize+4)
+	data[0], data[wasmStackSize] = 1, 2
+
+	if _, err := newLayoutVM(t, ContractLayout, 1, data, -1); err == nil {
+		t.Fatal("contract layout without __heap_base did not fail")
+	}
+
+	vm, err := newLayoutVM(t, ContractLayout, 1, data, wasmStackSize+4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.memory[0] != 0 || vm.memory[wasmStackSize] != 2 {
+		t.Fatalf("data in the stack not discarded, or data above it not applied")
+	}
+	if got, want := vm.heapStart, uint64(wasmStackSize+4); got != want {
+		t.Fatalf("heap starts at %d, want %d", got, want)
+	}
+
+	if vm := newTestVM(t, newTestModule(i32Result, nil, []byte{ops.I32Const, 0}), gas.NewMeter(1<<30)); vm.layout != ContractLayout {
+		t.Errorf("default layout = %d, want ContractLayout", vm.layout)
+	}
+}
+
+func TestContractLayoutPages(t *testing.T) {
+	// main grows the memory by one page, and returns the previous size
+	// plus the size after growing it.
+	code := []byte{
+		ops.I32Const, 1,
+		ops.GrowMemory, 0,
+		ops.CurrentMemory, 0,
+		ops.I32Add,
+	}
+	m := newTestModule(i32Result, nil, code)
+	m.Memory = &wasm.SectionMemories{Entries: []wasm.Memory{{Limits: wasm.ResizableLimits{Initial: 1}}}}
+	m.LinearMemoryIndexSpace = [][]byte{nil}
+	exportHeapBase(m, wasmStackSize+4)
+	vm := newTestVM(t, m, gas.NewMeter(1<<30))
+
+	if len(vm.memory)%wasmPageSize != 0 {
+		t.Fatalf("memory is %d bytes, not a whole number of pages", len(vm.memory))
+	}
+	if got, want := vm.heap.(*FreeListHeap).Stats().Size, uint64(len(vm.memory))-vm.heapStart; got != want {
+		t.Errorf("heap is %d bytes, want %d", got, want)
+	}
+	pages := int32(len(vm.memory) / wasmPageSize)
+	if res, err := vm.ExecCode(0, ""); err != nil || res != 2*pages+1 {
+		t.Errorf("grow and size = %v, %v, want %d", res, err, 2*pages+1)
+	}
+}
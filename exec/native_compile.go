@@ -45,6 +45,10 @@ func (c *nativeCompiler) Close() error {
 // executable, aligned regions of executable memory.
 type pageAllocator interface {
 	AllocateExec(asm []byte) (compile.NativeCodeUnit, error)
+	// Mark returns the current state of the allocator, and Release
+	// returns it to that state, freeing the code allocated in between.
+	Mark() compile.AllocatorMark
+	Release(m compile.AllocatorMark) error
 	Close() error
 }
 
@@ -91,16 +95,20 @@ func (vm *VM) tryNativeCompile() error {
 	}
 
 	for i := range vm.funcs {
-		if _, isGoFunc := vm.funcs[i].(*goFunction); isGoFunc {
+		// Host functions have no code to compile.
+		fn, ok := vm.funcs[i].(compiledFunction)
+		if !ok {
 			continue
 		}
-
-		fn := vm.funcs[i].(compiledFunction)
 		candidates, err := vm.nativeBackend.Scanner.ScanFunc(fn.code, fn.codeMeta)
 		if err != nil {
 			return fmt.Errorf("exec: AOT scan failed on vm.funcs[%d]: %v", i, err)
 		}
 
+		candidates = splitNativeCandidates(candidates, fn.codeMeta)
+		if vm.journaled {
+			candidates = excludeJournaledWrites(candidates, fn.codeMeta)
+		}
 		for _, candidate := range candidates {
 			if (candidate.Metrics.IntegerOps + candidate.Metrics.FloatOps) < minArithInstructionSequence {
 				continue
@@ -125,6 +133,8 @@ func (vm *VM) tryNativeCompile() error {
 			}
 			fn.asm = append(fn.asm, asmBlock{
 				nativeUnit: unit,
+				code:       asm,
+				startPC:    lower,
 				resumePC:   upper,
 			})
 
@@ -139,7 +149,7 @@ func (vm *VM) tryNativeCompile() error {
 			// a jump to the middle of re-compiled code.
 			// This conservative behaviour is the least likely to result in
 			// bugs becoming security issues.
-			for i := lower + 5; i < upper-1; i++ {
+			for i := lower + 5; i < upper; i++ {
 				fn.code[i] = ops.Unreachable
 			}
 		}
@@ -149,6 +159,33 @@ func (vm *VM) tryNativeCompile() error {
 	return nil
 }
 
+// splitNativeCandidates splits candidates so that instructions which end
+// a gas block, or whose effects outlive the call frame, are only ever the
+// last instruction of a native unit. This keeps every native unit within
+// a single gas block, and lets the VM trap for lack of gas before entering
+// a native unit without losing any observable effect.
+func splitNativeCandidates(candidates []compile.CompilationCandidate, meta *compile.BytecodeMetadata) []compile.CompilationCandidate {
+	out := make([]compile.CompilationCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		out = append(out, candidate.Split(meta, func(op byte) bool {
+			return endsGasBlock[op] || op == ops.SetGlobal
+		})...)
+	}
+	return out
+}
+
+// excludeJournaledWrites removes memory stores and global writes from
+// candidates, so that journaled VMs record them as they are interpreted.
+func excludeJournaledWrites(candidates []compile.CompilationCandidate, meta *compile.BytecodeMetadata) []compile.CompilationCandidate {
+	out := make([]compile.CompilationCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		out = append(out, candidate.Exclude(meta, func(op byte) bool {
+			return op == ops.SetGlobal || (op >= ops.I32Store && op <= ops.I64Store32)
+		})...)
+	}
+	return out
+}
+
 // nativeCodeInvocation calls into one of the assembled code blocks.
 // Assembled code blocks expect the following two pieces of
 // information on the stack:
@@ -156,16 +193,38 @@ func (vm *VM) tryNativeCompile() error {
 // [fp+pointerSize:fp+pointerSize*2]: sliceHeader for locals variables.
 func (vm *VM) nativeCodeInvocation(asmIndex uint32) {
 	block := vm.ctx.asm[asmIndex]
-	finishSignal := block.nativeUnit.Invoke(&vm.ctx.stack, &vm.ctx.locals, &vm.globals, &vm.memory)
+	var dirty *[]byte
+	if vm.trackDirty {
+		vm.growDirty()
+		dirty = &vm.dirty
+	}
+	finishSignal := block.nativeUnit.Invoke(&vm.ctx.stack, &vm.ctx.locals, &vm.globals, &vm.memory, dirty)
 
 	switch finishSignal.CompletionStatus() {
 	case compile.CompletionOK:
-	case compile.CompletionFatalInternalError:
-		panic("fatal error in native execution")
 	case compile.CompletionBadBounds:
-		panic("exec: out of bounds memory access")
+		vm.nativeTrap(finishSignal, TrapOutOfBoundsMemoryAccess, ErrOutOfBoundsMemoryAccess)
+	case compile.CompletionUnreachable:
+		vm.nativeTrap(finishSignal, TrapUnreachable, ErrUnreachable)
+	case compile.CompletionDivideByZero:
+		vm.nativeTrap(finishSignal, TrapIntegerDivideByZero, ErrIntegerDivideByZero)
+	case compile.CompletionIntegerOverflow:
+		vm.nativeTrap(finishSignal, TrapIntegerOverflow, ErrIntegerOverflow)
+	default:
+		vm.nativeTrap(finishSignal, TrapNativeExecution, ErrNativeExecution)
 	}
 	vm.ctx.pc = int64(block.resumePC)
+	vm.checkCanceled()
+}
+
+// nativeTrap traps the VM at the instruction native execution exited on.
+func (vm *VM) nativeTrap(signal compile.JITExitSignal, kind TrapKind, err error) {
+	pc := vm.ctx.opPC
+	meta := vm.funcs[vm.ctx.curFunc].(compiledFunction).codeMeta
+	if idx := int(signal.Index()); idx < len(meta.Instructions) {
+		pc = int64(meta.Instructions[idx].Start)
+	}
+	vm.trapAt(kind, err, pc)
 }
 
 // CompileStats returns statistics about native compilation performed on
@@ -176,11 +235,11 @@ func (vm *VM) CompileStats() NativeCompileStats {
 	}
 
 	for i := range vm.funcs {
-		if _, isGoFunc := vm.funcs[i].(*goFunction); isGoFunc {
+		// Host functions have no code to compile.
+		fn, ok := vm.funcs[i].(compiledFunction)
+		if !ok {
 			continue
 		}
-
-		fn := vm.funcs[i].(compiledFunction)
 		out.NumCompiledBlocks += len(fn.asm)
 
 		for _, inst := range fn.codeMeta.Instructions {
@@ -8,10 +8,12 @@ package exec
 
 import (
 	"bytes"
+	"errors"
 	"runtime"
 	"testing"
 
 	"github.com/Ankr-network/wagon/disasm"
+	"github.com/Ankr-network/wagon/exec/gas"
 	"github.com/Ankr-network/wagon/exec/internal/compile"
 	ops "github.com/Ankr-network/wagon/wasm/operators"
 )
@@ -33,12 +35,32 @@ func (s *mockSequenceScanner) ScanFunc(bc []byte, meta *compile.BytecodeMetadata
 	return s.emit, nil
 }
 
-type mockPageAllocator struct{}
+type mockPageAllocator struct {
+	allocated int // number of units allocated
+	marked    int // number of units allocated when Mark was called
+	failAt    int // if not 0, the allocation of this unit fails
+}
+
+var errAllocation = errors.New("allocation failed")
 
 func (a *mockPageAllocator) AllocateExec(asm []byte) (compile.NativeCodeUnit, error) {
+	if a.failAt != 0 && a.allocated+1 == a.failAt {
+		return nil, errAllocation
+	}
+	a.allocated++
 	return nil, nil
 }
 
+func (a *mockPageAllocator) Mark() compile.AllocatorMark {
+	a.marked = a.allocated
+	return compile.AllocatorMark{}
+}
+
+func (a *mockPageAllocator) Release(m compile.AllocatorMark) error {
+	a.allocated = a.marked
+	return nil
+}
+
 func (a *mockPageAllocator) Close() error {
 	return nil
 }
@@ -139,7 +161,7 @@ func TestBasicAMD64(t *testing.T) {
 	vm := &VM{
 		funcs: []function{
 			compiledFunction{
-				returns:      true,
+				returns:      1,
 				maxDepth:     6,
 				code:         code,
 				branchTables: meta.BranchTables,
@@ -149,7 +171,10 @@ func TestBasicAMD64(t *testing.T) {
 		ctx: context{
 			stack: make([]uint64, 0, 6),
 		},
+		vmContext:    NewVMContext(),
+		maxCallDepth: DefaultMaxCallDepth,
 	}
+	vm.vmContext.SetGasMetric(gas.NewMeter(1 << 20))
 	vm.newFuncTable()
 
 	_, be := nativeBackend()
@@ -182,6 +207,11 @@ func TestBasicAMD64(t *testing.T) {
 		}
 	}
 
+	blocks, err := buildGasBlocks(vm.schedule(), 0, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn.gasBlocks = blocks
 	fn.call(vm, 0)
 	if len(vm.ctx.stack) != 1 || vm.ctx.stack[0] != 120 {
 		t.Errorf("stack = %+v, want [120]", vm.ctx.stack)
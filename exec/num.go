@@ -34,24 +34,39 @@ func (vm *VM) i32Mul() {
 func (vm *VM) i32DivS() {
 	v2 := vm.popInt32()
 	v1 := vm.popInt32()
+	if v2 == 0 {
+		vm.trap(TrapIntegerDivideByZero, ErrIntegerDivideByZero)
+	}
+	if v1 == math.MinInt32 && v2 == -1 {
+		vm.trap(TrapIntegerOverflow, ErrIntegerOverflow)
+	}
 	vm.pushInt32(v1 / v2)
 }
 
 func (vm *VM) i32DivU() {
 	v2 := vm.popUint32()
 	v1 := vm.popUint32()
+	if v2 == 0 {
+		vm.trap(TrapIntegerDivideByZero, ErrIntegerDivideByZero)
+	}
 	vm.pushUint32(v1 / v2)
 }
 
 func (vm *VM) i32RemS() {
 	v2 := vm.popInt32()
 	v1 := vm.popInt32()
+	if v2 == 0 {
+		vm.trap(TrapIntegerDivideByZero, ErrIntegerDivideByZero)
+	}
 	vm.pushInt32(v1 % v2)
 }
 
 func (vm *VM) i32RemU() {
 	v2 := vm.popUint32()
 	v1 := vm.popUint32()
+	if v2 == 0 {
+		vm.trap(TrapIntegerDivideByZero, ErrIntegerDivideByZero)
+	}
 	vm.pushUint32(v1 % v2)
 }
 
@@ -194,24 +209,39 @@ func (vm *VM) i64Mul() {
 func (vm *VM) i64DivS() {
 	v2 := vm.popInt64()
 	v1 := vm.popInt64()
+	if v2 == 0 {
+		vm.trap(TrapIntegerDivideByZero, ErrIntegerDivideByZero)
+	}
+	if v1 == math.MinInt64 && v2 == -1 {
+		vm.trap(TrapIntegerOverflow, ErrIntegerOverflow)
+	}
 	vm.pushInt64(v1 / v2)
 }
 
 func (vm *VM) i64DivU() {
 	v2 := vm.popUint64()
 	v1 := vm.popUint64()
+	if v2 == 0 {
+		vm.trap(TrapIntegerDivideByZero, ErrIntegerDivideByZero)
+	}
 	vm.pushUint64(v1 / v2)
 }
 
 func (vm *VM) i64RemS() {
 	v2 := vm.popInt64()
 	v1 := vm.popInt64()
+	if v2 == 0 {
+		vm.trap(TrapIntegerDivideByZero, ErrIntegerDivideByZero)
+	}
 	vm.pushInt64(v1 % v2)
 }
 
 func (vm *VM) i64RemU() {
 	v2 := vm.popUint64()
 	v1 := vm.popUint64()
+	if v2 == 0 {
+		vm.trap(TrapIntegerDivideByZero, ErrIntegerDivideByZero)
+	}
 	vm.pushUint64(v1 % v2)
 }
 
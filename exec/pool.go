@@ -0,0 +1,92 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import "sync"
+
+// VMPool keeps idle VMs, keyed by contract, so that executions against the
+// same contract reuse instances instead of compiling its module again.
+// VMs are reset when they are returned to the pool, so that no state
+// leaks from one execution to the next. A VMPool is safe for concurrent
+// use.
+type VMPool struct {
+	newVM   func(key string) (*VM, error)
+	maxIdle int
+
+	mu   sync.Mutex
+	idle map[string][]*VM
+}
+
+// NewVMPool returns a pool creating VMs with newVM when it has no idle VM
+// for a key, and keeping at most maxIdle idle VMs per key. maxIdle <= 0
+// means no limit.
+func NewVMPool(newVM func(key string) (*VM, error), maxIdle int) *VMPool {
+	return &VMPool{
+		newVM:   newVM,
+		maxIdle: maxIdle,
+		idle:    make(map[string][]*VM),
+	}
+}
+
+// Get returns an idle VM for key, in the state NewVM left it in, or a new
+// VM if there is none. Idle VMs keep the gas metric of their previous
+// execution, which SetGasMetric replaces.
+func (p *VMPool) Get(key string) (*VM, error) {
+	p.mu.Lock()
+	vms := p.idle[key]
+	if n := len(vms); n > 0 {
+		vm := vms[n-1]
+		vms[n-1] = nil
+		p.idle[key] = vms[:n-1]
+		p.mu.Unlock()
+		return vm, nil
+	}
+	p.mu.Unlock()
+	return p.newVM(key)
+}
+
+// Put resets vm, and keeps it for later calls to Get with the same key.
+// VMs that fail to reset, or that exceed the number of idle VMs kept for
+// key, are closed instead. The VM must not be used after Put.
+func (p *VMPool) Put(key string, vm *VM) error {
+	if err := vm.Reset(); err != nil {
+		vm.Close()
+		return err
+	}
+
+	p.mu.Lock()
+	if p.maxIdle > 0 && len(p.idle[key]) >= p.maxIdle {
+		p.mu.Unlock()
+		return vm.Close()
+	}
+	p.idle[key] = append(p.idle[key], vm)
+	p.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of idle VMs kept for key.
+func (p *VMPool) Len(key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle[key])
+}
+
+// Close closes all idle VMs, and empties the pool.
+func (p *VMPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*VM)
+	p.mu.Unlock()
+
+	var err error
+	for _, vms := range idle {
+		for _, vm := range vms {
+			if cerr := vm.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
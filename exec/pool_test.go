@@ -0,0 +1,197 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+// newCounterVM returns a VM whose main function increments, and returns,
+// a counter stored in the linear memory, initially 5, and increments a
+// mutable global.
+func newCounterVM(t *testing.T) *VM {
+	code := []byte{
+		ops.I32Const, 0,
+		ops.I32Const, 0,
+		ops.I32Load, 2, 0,
+		ops.I32Const, 1,
+		ops.I32Add,
+		ops.I32Store, 2, 0,
+		ops.GetGlobal, 1,
+		ops.I32Const, 1,
+		ops.I32Add,
+		ops.SetGlobal, 1,
+		ops.I32Const, 0,
+		ops.I32Load, 2, 0,
+	}
+	vm := newMemoryVM(t, i32Result, code, []byte{5, 0, 0, 0})
+	vm.module.GlobalIndexSpace = append(vm.module.GlobalIndexSpace, wasm.GlobalEntry{
+		Type: wasm.GlobalVar{Type: wasm.ValueTypeI32, Mutable: true},
+		Init: []byte{ops.I32Const, 0, ops.End},
+	})
+	vm.globals = append(vm.globals, 0)
+	return vm
+}
+
+func TestReset(t *testing.T) {
+	vm := newCounterVM(t)
+	for _, want := range []int32{6, 7} {
+		if res, err := vm.ExecCode(0, ""); err != nil || res != want {
+			t.Fatalf("main() = %v, %v, want %d", res, err, want)
+		}
+	}
+	if _, err := vm.SetBytes([]byte("leak")); err != nil {
+		t.Fatal(err)
+	}
+	vm.vmContext.JsonObjectCache = []map[string]json.RawMessage{{"leak": json.RawMessage(`1`)}}
+	mem := vm.Memory()
+
+	if err := vm.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if vm.vmContext.JsonObjectCache != nil || vm.vmContext.runningVM != nil {
+		t.Errorf("VMContext not cleared by Reset: %+v", vm.vmContext)
+	}
+	metric := gas.NewMeter(1 << 20)
+	vm.SetGasMetric(metric)
+	if res, err := vm.ExecCode(0, ""); err != nil || res != int32(6) {
+		t.Errorf("main() after Reset = %v, %v, want 6", res, err)
+	}
+	if metric.GasLeft() == 1<<20 {
+		t.Errorf("the execution after SetGasMetric was not charged to the new metric")
+	}
+	if vm.globals[1] != 1 {
+		t.Errorf("global after Reset and a call = %d, want 1", vm.globals[1])
+	}
+	if stats := vm.heap.(*FreeListHeap).Stats(); stats.Allocations != 0 {
+		t.Errorf("%d allocations survived Reset", stats.Allocations)
+	}
+	if &vm.Memory()[0] != &mem[0] {
+		t.Errorf("Reset did not reuse the linear memory")
+	}
+	for i, b := range vm.Memory()[1024 : 1024+4] {
+		if b != 0 {
+			t.Fatalf("heap byte %d = %d after Reset, want 0", i, b)
+		}
+	}
+}
+
+func TestTableIsPerVM(t *testing.T) {
+	m := newTestModule(i32Result, nil, addCode)
+	m.TableIndexSpace = [][]uint32{{0, 0}}
+	a := newTestVM(t, m, gas.NewMeter(1<<20))
+	b := newTestVM(t, m, gas.NewMeter(1<<20))
+
+	a.table[1] = 7
+	snapshot, err := a.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := RestoreVM(m, snapshot, gas.NewMeter(1<<20), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.table[1] != 7 {
+		t.Errorf("restored table = %v, want [0 7]", restored.table)
+	}
+	if err := a.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if a.table[1] != 0 {
+		t.Errorf("table after Reset = %v, want [0 0]", a.table)
+	}
+	restored.table[0] = 9
+	if b.table[0] != 0 || b.table[1] != 0 || m.TableIndexSpace[0][0] != 0 || m.TableIndexSpace[0][1] != 0 {
+		t.Errorf("tables of other VMs were modified: VM %v, module %v", b.table, m.TableIndexSpace[0])
+	}
+}
+
+func TestPutAfterOutOfGas(t *testing.T) {
+	// The start function of the module increments the counter.
+	vm := newCounterVM(t)
+	vm.module.Start = &wasm.SectionStartFunction{Index: 0}
+	if err := vm.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	pool := NewVMPool(func(key string) (*VM, error) { return vm, nil }, 1)
+
+	metric := gas.NewMeter(1)
+	vm.SetGasMetric(metric)
+	if _, err := vm.ExecCode(0, ""); !errors.Is(err, ErrOutOfGas) {
+		t.Fatalf("main() with 1 gas: error = %v, want %v", err, ErrOutOfGas)
+	}
+	used := metric.Used()
+	if err := pool.Put("counter", vm); err != nil {
+		t.Fatalf("Put after running out of gas: %v", err)
+	}
+	if metric.Used() != used {
+		t.Errorf("the start function run by Put was charged to the previous execution")
+	}
+	if pool.Len("counter") != 1 {
+		t.Fatalf("the VM was not kept by the pool")
+	}
+
+	vm, err := pool.Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.SetGasMetric(gas.NewMeter(1 << 20))
+	if res, err := vm.ExecCode(0, ""); err != nil || res != int32(7) {
+		t.Errorf("main() after Put = %v, %v, want 7", res, err)
+	}
+}
+
+func TestVMPool(t *testing.T) {
+	created := 0
+	pool := NewVMPool(func(key string) (*VM, error) {
+		created++
+		return newCounterVM(t), nil
+	}, 1)
+
+	a, err := pool.Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pool.Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != 2 {
+		t.Fatalf("created %d VMs, want 2", created)
+	}
+	a.ExecCode(0, "")
+	if err := pool.Put("counter", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Put("counter", b); err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.Len("counter"); n != 1 {
+		t.Fatalf("pool keeps %d idle VMs, want 1", n)
+	}
+
+	vm, err := pool.Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm != a || created != 2 {
+		t.Fatalf("Get did not reuse the idle VM")
+	}
+	if res, err := vm.ExecCode(0, ""); err != nil || res != int32(6) {
+		t.Errorf("main() on a pooled VM = %v, %v, want 6", res, err)
+	}
+	if _, err := pool.Get("other"); err != nil || created != 3 {
+		t.Errorf("Get(other) = %v, created %d VMs, want 3", err, created)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
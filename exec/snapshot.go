@@ -0,0 +1,320 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	vmevent "github.com/Ankr-network/wagon/exec/event"
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+)
+
+// snapshotVersion is the version of the encoding of snapshots. It must be
+// increased whenever the encoding changes.
+const snapshotVersion = 1
+
+var snapshotMagic = []byte("wgns")
+
+var (
+	// ErrInvalidSnapshot is returned by RestoreVM when the snapshot is
+	// truncated or corrupted, or holds a state no VM can be in, such as a
+	// heap extending past the linear memory.
+	ErrInvalidSnapshot = errors.New("exec: invalid snapshot")
+	// ErrSnapshotVersion is returned by RestoreVM when the snapshot was
+	// encoded by an unsupported version of wagon.
+	ErrSnapshotVersion = errors.New("exec: unsupported snapshot version")
+	// ErrSnapshotMismatch is returned by RestoreVM when the snapshot was
+	// not taken from a VM of the same module, or its linear memory does
+	// not fit in the limits of the module and of the options.
+	ErrSnapshotMismatch = errors.New("exec: snapshot does not match the module")
+)
+
+// Snapshot returns the state of the VM, which RestoreVM resumes, possibly
+// in another process: its linear memory, the state of its heap, its
+// globals and table, its addresses, and the JsonObjectCache of its
+// VMContext. The heap must implement encoding.BinaryMarshaler, as
+// FreeListHeap does. Snapshot must not be called while the VM executes.
+//
+// A snapshot starts with a magic number and the version of its encoding,
+// and ends with the SHA-256 checksum of everything before it.
+func (vm *VM) Snapshot() ([]byte, error) {
+	var w snapshotWriter
+	w.buf = append(w.buf, snapshotMagic...)
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, snapshotVersion)
+
+	key := moduleKey(vm.module)
+	w.buf = append(w.buf, key[:]...)
+	w.string(vm.contractAddr)
+	w.string(vm.ownerAddr)
+	w.string(vm.callerAddr)
+
+	w.bytes(vm.memory)
+	w.uvarint(vm.heapStart)
+	w.uvarint(uint64(len(vm.globals)))
+	for _, g := range vm.globals {
+		w.uvarint(g)
+	}
+	if len(vm.module.TableIndexSpace) == 0 {
+		w.uvarint(0)
+	} else {
+		w.uvarint(uint64(len(vm.table)) + 1)
+		for _, index := range vm.table {
+			w.uvarint(uint64(index))
+		}
+	}
+	if vm.heap == nil {
+		w.uvarint(0)
+	} else {
+		m, ok := vm.heap.(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, fmt.Errorf("exec: heap of type %T cannot be saved in a snapshot", vm.heap)
+		}
+		heap, err := m.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		w.uvarint(uint64(len(heap)) + 1)
+		w.buf = append(w.buf, heap...)
+	}
+
+	cache := vm.vmContext.JsonObjectCache
+	w.uvarint(uint64(len(cache)))
+	for _, objects := range cache {
+		if objects == nil {
+			w.uvarint(0)
+			continue
+		}
+		keys := make([]string, 0, len(objects))
+		for k := range objects {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.uvarint(uint64(len(keys)) + 1)
+		for _, k := range keys {
+			w.string(k)
+			w.bytes(objects[k])
+		}
+	}
+
+	sum := sha256.Sum256(w.buf)
+	return append(w.buf, sum[:]...), nil
+}
+
+// RestoreVM creates a VM of module, in the state saved by Snapshot. The
+// module must be the one the snapshot was taken from, as read by
+// wasm.ReadModule, and its start function is not run. The gas metric,
+// publisher and options are those of NewVM, and are not saved in
+// snapshots.
+func RestoreVM(module *wasm.Module, snapshot []byte, metric gas.GasMetric, publisher vmevent.Publisher, opts ...VMOption) (*VM, error) {
+	n := len(snapshotMagic) + 4
+	if len(snapshot) < n+sha256.Size || !bytes.Equal(snapshot[:len(snapshotMagic)], snapshotMagic) {
+		return nil, ErrInvalidSnapshot
+	}
+	if binary.LittleEndian.Uint32(snapshot[len(snapshotMagic):]) != snapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+	body := snapshot[:len(snapshot)-sha256.Size]
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:], snapshot[len(body):]) {
+		return nil, ErrInvalidSnapshot
+	}
+	r := snapshotReader{buf: body[n:]}
+	if len(r.buf) < sha256.Size {
+		return nil, ErrInvalidSnapshot
+	}
+	if key := moduleKey(module); !bytes.Equal(key[:], r.buf[:sha256.Size]) {
+		return nil, ErrSnapshotMismatch
+	}
+	r.buf = r.buf[sha256.Size:]
+
+	vm, err := newSoleVM(r.string(), r.string(), r.string(), metric, publisher, module, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.restore(&r); err != nil {
+		vm.Close()
+		return nil, err
+	}
+	return vm, nil
+}
+
+// restore sets the state of the VM from the rest of a snapshot, after its
+// addresses.
+func (vm *VM) restore(r *snapshotReader) error {
+	memory := r.bytes()
+	if r.err == nil {
+		if err := vm.checkSnapshotMemory(len(memory)); err != nil {
+			return err
+		}
+	}
+	vm.memory = append(vm.memory[:0], memory...)
+	vm.heapStart = r.uvarint()
+	if vm.heapStart > uint64(len(vm.memory)) {
+		return ErrInvalidSnapshot
+	}
+
+	if n := r.count(); r.err == nil && n != len(vm.globals) {
+		return ErrSnapshotMismatch
+	}
+	for i := range vm.globals {
+		vm.globals[i] = r.uvarint()
+	}
+
+	if n := r.count(); n != 0 {
+		if r.err == nil && (len(vm.module.TableIndexSpace) == 0 || n-1 != len(vm.table)) {
+			return ErrSnapshotMismatch
+		}
+		for i := range vm.table {
+			vm.table[i] = uint32(r.uvarint())
+		}
+	}
+
+	if n := r.count(); n != 0 {
+		heap := r.next(n - 1)
+		u, ok := vm.heap.(encoding.BinaryUnmarshaler)
+		if r.err == nil && !ok {
+			return fmt.Errorf("exec: heap of type %T cannot be restored from a snapshot", vm.heap)
+		}
+		if r.err == nil {
+			if err := u.UnmarshalBinary(heap); err != nil {
+				return err
+			}
+			if h, ok := vm.heap.(*FreeListHeap); ok && h.size > uint64(len(vm.memory))-vm.heapStart {
+				return ErrInvalidSnapshot
+			}
+		}
+	}
+
+	cache := make([]map[string]json.RawMessage, r.count())
+	for i := range cache {
+		n := r.count()
+		if n == 0 {
+			continue
+		}
+		cache[i] = make(map[string]json.RawMessage, n-1)
+		for j := 0; j < n-1; j++ {
+			k := r.string()
+			cache[i][k] = json.RawMessage(append([]byte(nil), r.bytes()...))
+		}
+	}
+	if err := r.end(); err != nil {
+		return err
+	}
+	if len(cache) != 0 {
+		vm.vmContext.JsonObjectCache = cache
+	}
+	vm.resetJournal()
+	vm.ClearDirtyMemory()
+	return nil
+}
+
+// checkSnapshotMemory checks that a linear memory of n bytes, restored
+// from a snapshot, is made of whole pages, and has a size the VM could
+// have grown it to: at least the initial size declared by the module, and
+// at most its limit, unless the VM was created larger.
+func (vm *VM) checkSnapshotMemory(n int) error {
+	if vm.module.Memory == nil || len(vm.module.Memory.Entries) == 0 {
+		if n != 0 {
+			return ErrSnapshotMismatch
+		}
+		return nil
+	}
+	if n%wasmPageSize != 0 {
+		return ErrInvalidSnapshot
+	}
+	pages := uint64(n / wasmPageSize)
+	limit := uint64(vm.memoryPageLimit())
+	if initial := uint64(len(vm.memory) / wasmPageSize); initial > limit {
+		limit = initial
+	}
+	if pages < uint64(vm.module.Memory.Entries[0].Limits.Initial) || pages > limit {
+		return ErrSnapshotMismatch
+	}
+	return nil
+}
+
+// snapshotWriter appends values to a snapshot.
+type snapshotWriter struct {
+	buf []byte
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *snapshotWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *snapshotWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// snapshotReader reads the values written by a snapshotWriter. The first
+// error is kept, after which reads return zero values.
+type snapshotReader struct {
+	buf []byte
+	err error
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = ErrInvalidSnapshot
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// count reads a number of elements, which is at most the number of bytes
+// left, as elements take at least one byte.
+func (r *snapshotReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.buf))+1 {
+		r.err = ErrInvalidSnapshot
+		return 0
+	}
+	return int(n)
+}
+
+// next returns the n next bytes.
+func (r *snapshotReader) next(n int) []byte {
+	if r.err != nil || n > len(r.buf) {
+		r.err = ErrInvalidSnapshot
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *snapshotReader) bytes() []byte {
+	return r.next(r.count())
+}
+
+func (r *snapshotReader) string() string {
+	return string(r.bytes())
+}
+
+// end checks that the whole snapshot was read.
+func (r *snapshotReader) end() error {
+	if r.err == nil && len(r.buf) != 0 {
+		r.err = ErrInvalidSnapshot
+	}
+	return r.err
+}
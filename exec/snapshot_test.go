@@ -0,0 +1,102 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+)
+
+func TestSnapshot(t *testing.T) {
+	vm := newCounterVM(t)
+	for i := 0; i < 2; i++ {
+		if _, err := vm.ExecCode(0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ptr, err := vm.SetBytes([]byte("kept"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.vmContext.JsonObjectCache = []map[string]json.RawMessage{{"b": json.RawMessage(`2`), "a": json.RawMessage(`"x"`)}, nil}
+
+	snapshot, err := vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := RestoreVM(vm.module, snapshot, gas.NewMeter(1<<30), nil, WithMemoryLayout(StandardLayout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := restored.Snapshot(); err != nil || !bytes.Equal(again, snapshot) {
+		t.Errorf("snapshot of the restored VM differs: %v", err)
+	}
+	if restored.contractAddr != vm.contractAddr || restored.callerAddr != vm.callerAddr {
+		t.Errorf("restored addresses = %q, %q, want %q, %q", restored.contractAddr, restored.callerAddr, vm.contractAddr, vm.callerAddr)
+	}
+	if !reflect.DeepEqual(restored.vmContext.JsonObjectCache, vm.vmContext.JsonObjectCache) {
+		t.Errorf("restored JsonObjectCache = %v, want %v", restored.vmContext.JsonObjectCache, vm.vmContext.JsonObjectCache)
+	}
+	if s, err := restored.ReadString(int64(ptr)); err != nil || s != "kept" {
+		t.Errorf("restored string = %q, %v, want kept", s, err)
+	}
+	if got, want := restored.heap.(*FreeListHeap).Stats(), vm.heap.(*FreeListHeap).Stats(); got != want {
+		t.Errorf("restored heap stats = %+v, want %+v", got, want)
+	}
+	if res, err := restored.ExecCode(0, ""); err != nil || res != int32(8) {
+		t.Errorf("main() after restore = %v, %v, want 8", res, err)
+	}
+	if restored.globals[1] != 3 {
+		t.Errorf("global after restore and a call = %d, want 3", restored.globals[1])
+	}
+
+	corrupted := append([]byte(nil), snapshot...)
+	corrupted[len(corrupted)/2] ^= 1
+	if _, err := RestoreVM(vm.module, corrupted, gas.NewMeter(1<<30), nil); err != ErrInvalidSnapshot {
+		t.Errorf("restoring a corrupted snapshot: error = %v, want %v", err, ErrInvalidSnapshot)
+	}
+	future := append([]byte(nil), snapshot...)
+	future[len(snapshotMagic)]++
+	if _, err := RestoreVM(vm.module, future, gas.NewMeter(1<<30), nil); err != ErrSnapshotVersion {
+		t.Errorf("restoring a snapshot of another version: error = %v, want %v", err, ErrSnapshotVersion)
+	}
+	if _, err := RestoreVM(newTestModule(i32Result, nil, addCode), snapshot, gas.NewMeter(1<<30), nil); err != ErrSnapshotMismatch {
+		t.Errorf("restoring a snapshot of another module: error = %v, want %v", err, ErrSnapshotMismatch)
+	}
+}
+
+func TestSnapshotLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(vm *VM, h *FreeListHeap)
+		opts   []VMOption
+		want   error
+	}{
+		{"partial page", func(vm *VM, h *FreeListHeap) { vm.memory = vm.memory[:len(vm.memory)-1] }, nil, ErrInvalidSnapshot},
+		{"below the initial size", func(vm *VM, h *FreeListHeap) { vm.memory = nil }, nil, ErrSnapshotMismatch},
+		{"beyond the page limit", func(vm *VM, h *FreeListHeap) {
+			vm.memory = append(vm.memory, make([]byte, wasmPageSize)...)
+			h.GrowMemory(wasmPageSize)
+		}, []VMOption{WithMaxMemoryPages(1)}, ErrSnapshotMismatch},
+		{"heap start beyond the memory", func(vm *VM, h *FreeListHeap) { vm.heapStart = uint64(len(vm.memory)) + 1 }, nil, ErrInvalidSnapshot},
+		{"heap beyond the memory", func(vm *VM, h *FreeListHeap) { h.GrowMemory(wasmPageSize) }, nil, ErrInvalidSnapshot},
+		{"allocation beyond the heap", func(vm *VM, h *FreeListHeap) { h.used[h.size] = heapAlign }, nil, ErrInvalidSnapshot},
+	} {
+		vm := newCounterVM(t)
+		tc.modify(vm, vm.heap.(*FreeListHeap))
+		snapshot, err := vm.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := append(tc.opts, WithMemoryLayout(StandardLayout))
+		if _, err := RestoreVM(vm.module, snapshot, gas.NewMeter(1<<30), nil, opts...); err != tc.want {
+			t.Errorf("%s: error = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
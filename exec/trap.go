@@ -0,0 +1,148 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrOutOfGas is the error value used while trapping the VM when the
+	// gas metric cannot pay for the execution of an instruction.
+	ErrOutOfGas = errors.New("exec: out of gas")
+	// ErrIntegerDivideByZero is the error value used while trapping the VM
+	// when an integer is divided by zero.
+	ErrIntegerDivideByZero = errors.New("exec: integer divide by zero")
+	// ErrIntegerOverflow is the error value used while trapping the VM when
+	// the result of a signed integer division cannot be represented.
+	ErrIntegerOverflow = errors.New("exec: integer overflow")
+	// ErrInvalidConversionToInteger is the error value used while trapping
+	// the VM when a float that is NaN, or out of the range of the target
+	// integer type, is truncated to an integer.
+	ErrInvalidConversionToInteger = errors.New("exec: invalid conversion to integer")
+	// ErrNativeExecution is the error value used while trapping the VM
+	// when native code fails for an internal reason.
+	ErrNativeExecution = errors.New("exec: fatal error in native execution")
+	// ErrTerminated is the error value used while trapping the VM when
+	// its execution is stopped by Process.Terminate, or when it is used
+	// after being closed.
+	ErrTerminated = errors.New("exec: execution terminated")
+	// ErrCanceled is the error value used while trapping the VM when the
+	// context passed to ExecCodeContext is canceled.
+	ErrCanceled = errors.New("exec: execution canceled")
+	// ErrDeadlineExceeded is the error value used while trapping the VM
+	// when the deadline of the context passed to ExecCodeContext expires.
+	ErrDeadlineExceeded = errors.New("exec: execution deadline exceeded")
+	// ErrCallStackExhausted is the error value used while trapping the VM
+	// when calls are nested deeper than the limit set by WithMaxCallDepth.
+	ErrCallStackExhausted = errors.New("exec: call stack exhausted")
+)
+
+// TrapKind identifies the reason why the VM trapped.
+type TrapKind int
+
+// Valid trap kinds.
+const (
+	TrapUnknown TrapKind = iota
+	TrapOutOfGas
+	TrapUnreachable
+	TrapOutOfBoundsMemoryAccess
+	TrapUndefinedElement
+	TrapSignatureMismatch
+	TrapIntegerDivideByZero
+	TrapIntegerOverflow
+	TrapInvalidConversionToInteger
+	TrapHostFunction
+	TrapNativeExecution
+	TrapTerminated
+	TrapCanceled
+	TrapCallStackExhausted
+)
+
+var trapKindNames = [...]string{
+	TrapUnknown:                    "unknown",
+	TrapOutOfGas:                   "out of gas",
+	TrapUnreachable:                "unreachable",
+	TrapOutOfBoundsMemoryAccess:    "out of bounds memory access",
+	TrapUndefinedElement:           "undefined element",
+	TrapSignatureMismatch:          "signature mismatch",
+	TrapIntegerDivideByZero:        "integer divide by zero",
+	TrapIntegerOverflow:            "integer overflow",
+	TrapInvalidConversionToInteger: "invalid conversion to integer",
+	TrapHostFunction:               "host function",
+	TrapNativeExecution:            "native execution",
+	TrapTerminated:                 "terminated",
+	TrapCanceled:                   "canceled",
+	TrapCallStackExhausted:         "call stack exhausted",
+}
+
+func (k TrapKind) String() string {
+	if k < 0 || int(k) >= len(trapKindNames) {
+		return fmt.Sprintf("TrapKind(%d)", int(k))
+	}
+	return trapKindNames[k]
+}
+
+// Trap is the error returned by ExecCode when the execution of the VM
+// traps. Err is the underlying error, such as ErrOutOfGas, and can be
+// tested for with errors.Is.
+type Trap struct {
+	Kind      TrapKind
+	FuncIndex int64 // index of the function executing when the VM trapped
+	PC        int64 // offset of the trapping instruction in the compiled code
+	Err       error
+}
+
+func (t *Trap) Error() string {
+	return fmt.Sprintf("%v (function %d, pc %d)", t.Err, t.FuncIndex, t.PC)
+}
+
+func (t *Trap) Unwrap() error {
+	return t.Err
+}
+
+// HostError is the error of a trap of kind TrapHostFunction, raised when
+// a host function fails. Err is the error returned by the function.
+type HostError struct {
+	Name string // name of the host function
+	Err  error
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("exec: host function %s: %v", e.Name, e.Err)
+}
+
+func (e *HostError) Unwrap() error {
+	return e.Err
+}
+
+// hostTrap stops the execution of the VM because the host function name
+// failed with err.
+func (vm *VM) hostTrap(name string, err error) {
+	vm.trap(TrapHostFunction, &HostError{Name: name, Err: err})
+}
+
+// hostReturned stops the execution of the VM if the host function name
+// returned a non-nil err, or terminated the execution.
+func (vm *VM) hostReturned(name string, err error) {
+	if err != nil {
+		vm.hostTrap(name, err)
+	}
+	if vm.abort {
+		vm.trap(TrapTerminated, ErrTerminated)
+	}
+	vm.checkCanceled()
+}
+
+// trap stops the execution of the VM at the instruction being executed.
+func (vm *VM) trap(kind TrapKind, err error) {
+	vm.trapAt(kind, err, vm.ctx.opPC)
+}
+
+// trapAt stops the execution of the VM at the instruction at pc.
+func (vm *VM) trapAt(kind TrapKind, err error, pc int64) {
+	panic(&Trap{Kind: kind, FuncIndex: vm.ctx.curFunc, PC: pc, Err: err})
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/Ankr-network/wagon/exec/gas"
+	"github.com/Ankr-network/wagon/wasm"
+	ops "github.com/Ankr-network/wagon/wasm/operators"
+)
+
+var i64i64ToI64 = wasm.FunctionSig{
+	Form:        0,
+	ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64},
+	ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+}
+
+// opPC returns the offset of the first instruction with the given opcode
+// in the compiled code of function 0.
+func opPC(t *testing.T, vm *VM, op byte) int64 {
+	t.Helper()
+	for _, inst := range vm.funcs[0].(compiledFunction).codeMeta.Instructions {
+		if inst.Op == op {
+			return int64(inst.Start)
+		}
+	}
+	t.Fatalf("opcode %#x not found", op)
+	return 0
+}
+
+func checkTrap(t *testing.T, err error, kind TrapKind, target error, pc int64) {
+	t.Helper()
+	var trap *Trap
+	if !errors.As(err, &trap) {
+		t.Fatalf("error %v is not a trap", err)
+	}
+	if trap.Kind != kind || trap.FuncIndex != 0 || trap.PC != pc {
+		t.Fatalf("trap = {%v, %d, %d}, want {%v, 0, %d}", trap.Kind, trap.FuncIndex, trap.PC, kind, pc)
+	}
+	if !errors.Is(err, target) {
+		t.Fatalf("trap %v is not %v", err, target)
+	}
+}
+
+func TestTrapDivision(t *testing.T) {
+	for _, op := range []byte{ops.I64DivS, ops.I64RemS} {
+		code := []byte{ops.GetLocal, 0, ops.GetLocal, 1, op}
+		for _, aot := range []bool{false, true} {
+			vm := newTestVM(t, newTestModule(i64i64ToI64, nil, code), gas.NewMeter(1<<20), EnableAOT(aot))
+			if supported, _ := nativeBackend(); aot && supported && vm.CompileStats().NumCompiledBlocks == 0 {
+				t.Fatal("division was not compiled to native code")
+			}
+			pc := opPC(t, vm, op)
+
+			_, err := vm.ExecCode(0, "", 1, 0)
+			checkTrap(t, err, TrapIntegerDivideByZero, ErrIntegerDivideByZero, pc)
+
+			res, err := vm.ExecCode(0, "", 1<<63, math.MaxUint64)
+			if op == ops.I64RemS {
+				if err != nil || res.(int64) != 0 {
+					t.Fatalf("aot=%v: i64.rem_s(min, -1) = (%v, %v), want (0, nil)", aot, res, err)
+				}
+				continue
+			}
+			checkTrap(t, err, TrapIntegerOverflow, ErrIntegerOverflow, pc)
+		}
+	}
+}
+
+func TestTrapInvalidConversion(t *testing.T) {
+	sig := wasm.FunctionSig{
+		Form:        0,
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeF64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32},
+	}
+	code := []byte{ops.GetLocal, 0, ops.I32TruncUF64}
+	vm := newTestVM(t, newTestModule(sig, nil, code), gas.NewMeter(1<<20))
+	pc := opPC(t, vm, ops.I32TruncUF64)
+
+	_, err := vm.ExecCode(0, "", math.Float64bits(math.NaN()))
+	checkTrap(t, err, TrapInvalidConversionToInteger, ErrInvalidConversionToInteger, pc)
+	_, err = vm.ExecCode(0, "", math.Float64bits(-1))
+	checkTrap(t, err, TrapIntegerOverflow, ErrIntegerOverflow, pc)
+	_, err = vm.ExecCode(0, "", math.Float64bits(1<<32))
+	checkTrap(t, err, TrapIntegerOverflow, ErrIntegerOverflow, pc)
+
+	res, err := vm.ExecCode(0, "", math.Float64bits(-0.5))
+	if err != nil || res.(int32) != 0 {
+		t.Fatalf("i32.trunc_u/f64(-0.5) = (%v, %v), want (0, nil)", res, err)
+	}
+}
+
+func TestTrapUnreachable(t *testing.T) {
+	code := []byte{ops.I32Const, 1, ops.Drop, ops.Unreachable}
+	vm := newTestVM(t, newTestModule(wasm.FunctionSig{Form: 0}, nil, code), gas.NewMeter(1<<20))
+	_, err := vm.ExecCode(0, "")
+	checkTrap(t, err, TrapUnreachable, ErrUnreachable, opPC(t, vm, ops.Unreachable))
+}
+
+func TestTrapOutOfGas(t *testing.T) {
+	vm := newTestVM(t, newTestModule(i32Result, nil, addCode), gas.NewMeter(0))
+	_, err := vm.ExecCode(0, "")
+	checkTrap(t, err, TrapOutOfGas, ErrOutOfGas, 0)
+}
+
+func TestTrapCallStackExhausted(t *testing.T) {
+	// depth(n) recurses n times, and returns n.
+	depth := []byte{
+		ops.GetLocal, 0,
+		ops.If, byte(wasm.ValueTypeI32),
+		ops.GetLocal, 0, ops.I32Const, 1, ops.I32Sub,
+		ops.Call, 0,
+		ops.I32Const, 1, ops.I32Add,
+		ops.Else,
+		ops.I32Const, 0,
+		ops.End,
+	}
+	vm := newTestVM(t, newTestModule(i32ToI32, nil, depth), gas.NewMeter(1<<30), WithMaxCallDepth(10))
+	if res, err := vm.ExecCode(0, "", 10); err != nil || res != int32(10) {
+		t.Fatalf("depth(10) = %v, %v, want 10", res, err)
+	}
+	_, err := vm.ExecCode(0, "", 11)
+	checkTrap(t, err, TrapCallStackExhausted, ErrCallStackExhausted, opPC(t, vm, ops.Call))
+	if res, err := vm.ExecCode(0, "", 10); err != nil || res != int32(10) {
+		t.Fatalf("depth(10) after a trap = %v, %v, want 10", res, err)
+	}
+
+	// Unbounded recursion is stopped by the default limit.
+	vm = newTestVM(t, newTestModule(wasm.FunctionSig{Form: 0}, nil, []byte{ops.Call, 0}), gas.NewMeter(1<<30))
+	_, err = vm.ExecCode(0, "")
+	checkTrap(t, err, TrapCallStackExhausted, ErrCallStackExhausted, opPC(t, vm, ops.Call))
+}
+
+func TestTrapOutOfBoundsMemoryAccess(t *testing.T) {
+	for _, tc := range []struct {
+		base   uint64
+		offset []byte // LEB128 encoded
+		trap   bool
+	}{
+		{base: 65532, offset: []byte{0}},
+		{base: 65533, offset: []byte{0}, trap: true},
+		{base: 65530, offset: []byte{2}},
+		{base: 65530, offset: []byte{3}, trap: true},
+		{base: 0xffffffff, offset: []byte{4}, trap: true},
+		{base: math.MaxUint64, offset: []byte{4}, trap: true},
+		{base: 1, offset: []byte{0xff, 0xff, 0xff, 0xff, 0x0f}, trap: true},
+	} {
+		code := []byte{ops.GetLocal, 0, ops.I32Const, 0, ops.I32Add, ops.I32Load, 2}
+		code = append(code, tc.offset...)
+		for _, aot := range []bool{false, true} {
+			vm := newTestVM(t, newTestModule(i32ToI32, nil, code), gas.NewMeter(1<<20), EnableAOT(aot))
+			if supported, _ := nativeBackend(); aot && supported && vm.CompileStats().NumCompiledBlocks == 0 {
+				t.Fatal("load was not compiled to native code")
+			}
+			vm.memory = make([]byte, wasmPageSize)
+
+			_, err := vm.ExecCode(0, "", tc.base)
+			if !tc.trap {
+				if err != nil {
+					t.Fatalf("aot=%v, base=%#x, offset=%x: %v", aot, tc.base, tc.offset, err)
+				}
+				continue
+			}
+			checkTrap(t, err, TrapOutOfBoundsMemoryAccess, ErrOutOfBoundsMemoryAccess, opPC(t, vm, ops.I32Load))
+		}
+	}
+}
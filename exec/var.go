@@ -27,5 +27,8 @@ func (vm *VM) getGlobal() {
 
 func (vm *VM) setGlobal() {
 	index := vm.fetchUint32()
+	if vm.journaled {
+		vm.journalGlobal(int(index))
+	}
 	vm.globals[int(index)] = vm.popUint64()
 }
@@ -6,14 +6,13 @@
 package exec
 
 import (
+	gocontext "context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
-	"math/big"
 
-	"github.com/Ankr-network/wagon/disasm"
 	vmevent "github.com/Ankr-network/wagon/exec/event"
 	"github.com/Ankr-network/wagon/exec/gas"
 	"github.com/Ankr-network/wagon/exec/internal/compile"
@@ -53,6 +52,7 @@ type context struct {
 	code    []byte
 	asm     []asmBlock
 	pc      int64
+	opPC    int64 // offset of the instruction being executed
 	curFunc int64
 }
 
@@ -67,6 +67,22 @@ type VM struct {
 
 	funcTable [256]func()
 
+	gasSchedule    gas.GasSchedule
+	maxMemoryPages uint32 // host cap on the size of the linear memory
+	layout         MemoryLayout
+	heap           wasm.HeapMemory // allocator of the heap of the linear memory
+	heapStart      uint64          // offset of the memory managed by heap
+	maxCallDepth   int
+	callDepth      int      // number of calls nested in the function run by ExecCode
+	table          []uint32 // elements of the table, copied from the module
+
+	journaled  bool         // writes to the memory and globals are journaled
+	savepoints []*savepoint // open savepoints of a journaled VM, innermost last
+	trackDirty bool         // writes to the memory are tracked in dirty
+	dirty      []byte       // 1 for each DirtyChunkSize bytes of memory written
+
+	canonicalNaNs bool // floating-point operators push the canonical NaN
+
 	// RecoverPanic controls whether the `ExecCode` method
 	// recovers from a panic and returns it as an error
 	// instead.
@@ -74,7 +90,14 @@ type VM struct {
 	// or encountering an invalid instruction, e.g. `unreachable`.
 	RecoverPanic bool
 
-	abort bool // Flag for host functions to terminate execution
+	abort     bool // Flag for host functions to terminate execution
+	closed    bool // the VM was closed, and can no longer run
+	executing bool // ExecCode is running, and host functions may re-enter it
+
+	// execCtx is the context of the execution started by ExecCodeContext,
+	// whose done channel is cached in done.
+	execCtx gocontext.Context
+	done    <-chan struct{}
 
 	nativeBackend *nativeCompiler
 
@@ -92,10 +115,22 @@ type VM struct {
 // As per the WebAssembly spec: https://github.com/WebAssembly/design/blob/27ac254c854994103c24834a994be16f74f54186/Semantics.md#linear-memory
 const wasmPageSize = 65536 // (64 KB)
 
+// maxMemoryPages is the number of pages of a 4GiB linear memory, the
+// largest that 32-bit addresses can reach.
+const maxMemoryPages = 65536
+
 var endianess = binary.LittleEndian
 
 type config struct {
-	EnableAOT bool
+	EnableAOT      bool
+	GasSchedule    gas.GasSchedule
+	MaxMemoryPages uint32
+	MemoryLayout   MemoryLayout
+	MaxCallDepth   int
+	CacheDir       string
+	Journal        bool
+	TrackDirty     bool
+	FloatMode      FloatMode
 }
 
 // VMOption describes a customization that can be applied to the VM.
@@ -110,19 +145,174 @@ func EnableAOT(v bool) VMOption {
 	}
 }
 
+// WithGasSchedule sets the gas schedule the VM charges execution against.
+// VMs created without this option use gas.ScheduleV1.
+func WithGasSchedule(s gas.GasSchedule) VMOption {
+	return func(c *config) {
+		c.GasSchedule = s
+	}
+}
+
+// WithMaxMemoryPages caps the number of 64KiB pages grow_memory can grow
+// the linear memory to, on top of the maximum declared by the module. For
+// instance, WithMaxMemoryPages(MaxHeapMemorySize / 65536) limits the
+// memory to MaxHeapMemorySize. VMs created without this option only
+// honour the module's maximum.
+func WithMaxMemoryPages(pages uint32) VMOption {
+	return func(c *config) {
+		c.MaxMemoryPages = pages
+	}
+}
+
+// WithMemoryLayout sets how the VM lays out the linear memory of the
+// module. VMs created without this option use ContractLayout.
+func WithMemoryLayout(l MemoryLayout) VMOption {
+	return func(c *config) {
+		c.MemoryLayout = l
+	}
+}
+
+// DefaultMaxCallDepth is the number of nested calls a VM allows when it
+// is created without WithMaxCallDepth.
+const DefaultMaxCallDepth = 16384
+
+// WithMaxCallDepth sets the number of nested calls the functions of the
+// module can make before the VM traps with ErrCallStackExhausted. As calls
+// recurse on the Go stack, the limit keeps recursive modules from
+// overflowing it.
+func WithMaxCallDepth(depth int) VMOption {
+	return func(c *config) {
+		c.MaxCallDepth = depth
+	}
+}
+
+// EnableJournal makes the VM journal its writes to the linear memory and
+// globals, so that they can be undone with Rollback. See Commit.
+func EnableJournal(v bool) VMOption {
+	return func(c *config) {
+		c.Journal = v
+	}
+}
+
+// TrackDirtyMemory makes the VM track the chunks of its linear memory that
+// are written, so that they can be exported with MemoryDiff.
+func TrackDirtyMemory(v bool) VMOption {
+	return func(c *config) {
+		c.TrackDirty = v
+	}
+}
+
+// WithFloatMode sets how the VM executes floating-point operators. VMs
+// created without this option use HardwareFloats.
+func WithFloatMode(mode FloatMode) VMOption {
+	return func(c *config) {
+		c.FloatMode = mode
+	}
+}
+
+// WithCacheDir caches the compiled code of modules, including their native
+// code, in files of the directory dir, which is created if needed. Modules
+// found in the cache are not compiled again. Entries that are stale or
+// corrupted are ignored, and replaced once the module is compiled.
+// Failing to write to the cache does not fail the compilation.
+//
+// The directory must only be writable by trusted users: the checksums of
+// its files detect corruption, not tampering, and the native code they
+// hold is executed as is.
+func WithCacheDir(dir string) VMOption {
+	return func(c *config) {
+		c.CacheDir = dir
+	}
+}
+
+// defaultGasSchedule is shared by all VMs created without WithGasSchedule,
+// and must never be modified.
+var defaultGasSchedule gas.GasSchedule = gas.ScheduleV1()
+
+// UnpricedOpcodeError is returned by NewVM when a function of the module
+// uses an opcode that the active gas schedule does not price.
+type UnpricedOpcodeError struct {
+	FuncIndex int
+	Op        byte
+	Version   uint32 // version of the gas schedule
+}
+
+func (e UnpricedOpcodeError) Error() string {
+	return fmt.Sprintf("exec: opcode %#x in function %d is not priced by gas schedule v%d", e.Op, e.FuncIndex, e.Version)
+}
+
 // NewVM creates a new VM from a given module and options. If the module defines
-// a start function, it will be executed.
+// a start function, it will be executed. The heap of the VM is managed by
+// the HeapMem of the module if it is set, and by a FreeListHeap of its own
+// otherwise.
+//
+// NewVM compiles the module for the VM alone. Use Compile and
+// NewVMFromCompiled to share a compilation between several VMs.
 func NewVM(contractAddr string, ownerAddr string, callerAddr string, metric gas.GasMetric, publisher vmevent.Publisher, module *wasm.Module, opts ...VMOption) (*VM, error) {
-	var vm VM
-	var options config
-	for _, opt := range opts {
-		opt(&options)
+	vm, err := newSoleVM(contractAddr, ownerAddr, callerAddr, metric, publisher, module, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.runStart(); err != nil {
+		vm.Close()
+		return nil, err
+	}
+	return vm, nil
+}
+
+// newSoleVM compiles module for a new VM alone, without running its start
+// function.
+func newSoleVM(contractAddr string, ownerAddr string, callerAddr string, metric gas.GasMetric, publisher vmevent.Publisher, module *wasm.Module, opts ...VMOption) (*VM, error) {
+	c, err := Compile(module, opts...)
+	if err != nil {
+		return nil, err
+	}
+	heap := module.HeapMem
+	if heap == nil {
+		heap = NewFreeListHeap()
+	}
+
+	vm, err := newVM(contractAddr, ownerAddr, callerAddr, metric, publisher, c, heap)
+	if err != nil {
+		c.Close()
+		return nil, err
 	}
+	// The VM is the only user of the compiled module, and frees its
+	// native code when closed.
+	vm.nativeBackend = c.native
+	return vm, nil
+}
+
+// newVM instantiates the compiled module c, with heap managing the heap
+// of its linear memory. The start function of the module is not run.
+func newVM(contractAddr string, ownerAddr string, callerAddr string, metric gas.GasMetric, publisher vmevent.Publisher, c *CompiledModule, heap wasm.HeapMemory) (*VM, error) {
+	var vm VM
+	options := c.options
 
-	vm.funcs = make([]function, len(module.FunctionIndexSpace))
-	vm.globals = make([]uint64, len(module.GlobalIndexSpace))
+	vm.funcs = c.funcs
+	vm.globals = make([]uint64, len(c.module.GlobalIndexSpace))
 	vm.newFuncTable()
-	vm.module = module
+	vm.module = c.module
+	vm.heap = heap
+	if len(c.module.TableIndexSpace) != 0 {
+		vm.table = append([]uint32(nil), c.module.TableIndexSpace[0]...)
+	}
+	vm.journaled = options.Journal
+	vm.trackDirty = options.TrackDirty
+	vm.canonicalNaNs = options.FloatMode == CanonicalNaNs
+	if vm.canonicalNaNs {
+		vm.canonicalizeNaNs()
+	}
+	vm.gasSchedule = options.GasSchedule
+	vm.layout = options.MemoryLayout
+	vm.maxCallDepth = options.MaxCallDepth
+	if vm.maxCallDepth <= 0 {
+		vm.maxCallDepth = DefaultMaxCallDepth
+	}
+	vm.maxMemoryPages = options.MaxMemoryPages
+	if vm.maxMemoryPages == 0 || vm.maxMemoryPages > maxMemoryPages {
+		vm.maxMemoryPages = maxMemoryPages
+	}
 	vm.vmContext = NewVMContext()
 	vm.contractAddr = contractAddr
 	vm.ownerAddr = ownerAddr
@@ -131,78 +321,33 @@ func NewVM(contractAddr string, ownerAddr string, callerAddr string, metric gas.
 	vm.vmContext.SetGasMetric(metric)
 	vm.vmContext.SetPublisher(publisher)
 
-	if module.Memory != nil && len(module.Memory.Entries) != 0 {
-		if len(module.Memory.Entries) > 1 {
-			return nil, ErrMultipleLinearMemories
-		}
-
+	if vm.module.Memory != nil && len(vm.module.Memory.Entries) != 0 {
 		err := vm.initMemory()
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	nNatives := 0
-	for i, fn := range module.FunctionIndexSpace {
-		// Skip native methods as they need not be
-		// disassembled; simply add them at the end
-		// of the `funcs` array as is, as specified
-		// in the spec. See the "host functions"
-		// section of:
-		// https://webassembly.github.io/spec/core/exec/modules.html#allocation
-		if fn.IsHost() {
-			vm.funcs[i] = goFunction{
-				typ: fn.Host.Type(),
-				val: fn.Host,
-			}
-			nNatives++
-			continue
-		}
-
-		disassembly, err := disasm.NewDisassembly(fn, module)
-		if err != nil {
-			return nil, err
-		}
-
-		totalLocalVars := 0
-		totalLocalVars += len(fn.Sig.ParamTypes)
-		for _, entry := range fn.Body.Locals {
-			totalLocalVars += int(entry.Count)
-		}
-		code, meta := compile.Compile(disassembly.Code)
-		vm.funcs[i] = compiledFunction{
-			codeMeta:       meta,
-			code:           code,
-			branchTables:   meta.BranchTables,
-			maxDepth:       disassembly.MaxDepth,
-			totalLocalVars: totalLocalVars,
-			args:           len(fn.Sig.ParamTypes),
-			returns:        len(fn.Sig.ReturnTypes) != 0,
-		}
-	}
-
 	if err := vm.resetGlobals(); err != nil {
 		return nil, err
 	}
 
-	if module.Start != nil {
-		_, err := vm.ExecCode(int64(module.Start.Index), "")
-		if err != nil {
-			return nil, err
-		}
-	}
+	return &vm, nil
+}
 
-	if options.EnableAOT {
-		supportedBackend, backend := nativeBackend()
-		if supportedBackend {
-			vm.nativeBackend = backend
-			if err := vm.tryNativeCompile(); err != nil {
-				return nil, err
-			}
+// runStart executes the start function of the module, if it defines one.
+// The journal and the dirty chunks of the VM then start from the
+// resulting state.
+func (vm *VM) runStart() error {
+	if vm.module.Start != nil {
+		_, err := vm.ExecCode(int64(vm.module.Start.Index), "")
+		if err != nil {
+			return err
 		}
 	}
-
-	return &vm, nil
+	vm.resetJournal()
+	vm.ClearDirtyMemory()
+	return nil
 }
 
 func (vm *VM) resetGlobals() error {
@@ -334,23 +479,55 @@ func (vm *VM) pushFloat32(f float32) {
 
 // ExecCode calls the function with the given index and arguments.
 // fnIndex should be a valid index into the function index space of
-// the VM's module.
-func (vm *VM) ExecCode(fnIndex int64, rtnType string, args ...uint64) (rtrn interface{}, err error) {
-	// If used as a library, client code should set vm.RecoverPanic to true
-	// in order to have an error returned.
-	if vm.RecoverPanic {
-		defer func() {
-			if r := recover(); r != nil {
-				switch e := r.(type) {
-				case error:
-					err = e
-				default:
-					err = fmt.Errorf("exec: %v", e)
-				}
-			}
-		}()
+// the VM's module. The result is nil if the function returns no value,
+// and a []interface{} holding each of the results if it returns more
+// than one. If rtnType is "string", integer results are read back as
+// pointers to NUL-terminated strings in the linear memory.
+func (vm *VM) ExecCode(fnIndex int64, rtnType string, args ...uint64) (interface{}, error) {
+	res, err := vm.execFunc(fnIndex, args)
+	if err != nil {
+		return nil, err
+	}
+	types := vm.module.GetFunction(int(fnIndex)).Sig.ReturnTypes
+	switch len(types) {
+	case 0:
+		return nil, nil
+	case 1:
+		return vm.decodeResult(types[0], res[0], rtnType)
+	}
+	rtrns := make([]interface{}, len(types))
+	for i, t := range types {
+		if rtrns[i], err = vm.decodeResult(t, res[i], rtnType); err != nil {
+			return nil, err
+		}
 	}
-	if int(fnIndex) > len(vm.funcs) {
+	return rtrns, nil
+}
+
+// execFunc calls the function with the given index and arguments, and
+// returns a copy of its raw results.
+func (vm *VM) execFunc(fnIndex int64, args []uint64) (rtrns []uint64, err error) {
+	// Traps are always returned as a *Trap error. Other panics are only
+	// recovered if vm.RecoverPanic is set, in which case they are returned
+	// as an error as well.
+	defer func() {
+		if r := recover(); r != nil {
+			if trap, ok := r.(*Trap); ok {
+				rtrns, err = nil, trap
+				return
+			}
+			if !vm.RecoverPanic {
+				panic(r)
+			}
+			switch e := r.(type) {
+			case error:
+				err = e
+			default:
+				err = fmt.Errorf("exec: %v", e)
+			}
+		}
+	}()
+	if fnIndex < 0 || int(fnIndex) >= len(vm.funcs) {
 		return nil, InvalidFunctionIndexError(fnIndex)
 	}
 	if len(vm.module.GetFunction(int(fnIndex)).Sig.ParamTypes) != len(args) {
@@ -358,7 +535,25 @@ func (vm *VM) ExecCode(fnIndex int64, rtnType string, args ...uint64) (rtrn inte
 	}
 	compiled, ok := vm.funcs[fnIndex].(compiledFunction)
 	if !ok {
-		panic(fmt.Sprintf("exec: function at index %d is not a compiled function", fnIndex))
+		return nil, fmt.Errorf("exec: function at index %d is not a compiled function", fnIndex)
+	}
+
+	// Host functions may call back into the VM. Such a nested execution
+	// runs on a context of its own, counts as a call made by the one it
+	// interrupted, and leaves it as it was once it returns.
+	if vm.executing {
+		if vm.callDepth >= vm.maxCallDepth {
+			vm.trap(TrapCallStackExhausted, ErrCallStackExhausted)
+		}
+		prevCtx, prevDepth := vm.ctx, vm.callDepth
+		defer func() { vm.ctx, vm.callDepth = prevCtx, prevDepth }()
+		vm.ctx = context{}
+		vm.callDepth++
+	} else {
+		vm.executing = true
+		defer func() { vm.executing = false }()
+		vm.abort = false
+		vm.callDepth = 0
 	}
 
 	depth := compiled.maxDepth + 1
@@ -373,95 +568,91 @@ func (vm *VM) ExecCode(fnIndex int64, rtnType string, args ...uint64) (rtrn inte
 	vm.ctx.code = compiled.code
 	vm.ctx.asm = compiled.asm
 	vm.ctx.curFunc = fnIndex
+	if vm.closed {
+		vm.trapAt(TrapTerminated, ErrTerminated, 0)
+	}
 
 	for i, arg := range args {
 		vm.ctx.locals[i] = arg
 	}
 
 	vm.vmContext.runningVM = vm
+	vm.checkCanceled()
 
-	res := vm.execCode(compiled)
-	if compiled.returns {
-		rtrnType := vm.module.GetFunction(int(fnIndex)).Sig.ReturnTypes[0]
-		switch rtrnType {
-		case wasm.ValueTypeI32:
-			if rtnType == "string" {
-				rtrn, _ = vm.vmContext.runningVM.ReadString(int64(int32(res)))
-			}else {
-				rtrn = int32(res)
-			}
-		case wasm.ValueTypeI64:
-			if rtnType == "string" {
-				rtrn, _ = vm.vmContext.runningVM.ReadString(int64(res))
-			}else {
-				rtrn = int64(res)
-			}
-		case wasm.ValueTypeF32:
-			rtrn = math.Float32frombits(uint32(res))
-		case wasm.ValueTypeF64:
-			rtrn = math.Float64frombits(res)
-		default:
-			return nil, InvalidReturnTypeError(rtrnType)
+	return append([]uint64(nil), vm.execCode(compiled)...), nil
+}
+
+// decodeResult converts a raw result of type t to an int32, int64, float32
+// or float64 value, or to a string read back from the linear memory if
+// rtnType is "string".
+func (vm *VM) decodeResult(t wasm.ValueType, res uint64, rtnType string) (interface{}, error) {
+	switch t {
+	case wasm.ValueTypeI32:
+		if rtnType == "string" {
+			return vm.ReadString(int64(int32(res)))
+		}
+		return int32(res), nil
+	case wasm.ValueTypeI64:
+		if rtnType == "string" {
+			return vm.ReadString(int64(res))
 		}
+		return int64(res), nil
+	case wasm.ValueTypeF32:
+		return math.Float32frombits(uint32(res)), nil
+	case wasm.ValueTypeF64:
+		return math.Float64frombits(res), nil
 	}
-
-	return rtrn, nil
+	return nil, InvalidReturnTypeError(t)
 }
 
-func (vm *VM) execCode(compiled compiledFunction) uint64 {
+func (vm *VM) execCode(compiled compiledFunction) []uint64 {
+	// Gas is charged whenever execution reaches gasEnd, the end of
+	// the current gas block. Taken branches reset gasEnd, as their
+	// target starts a new block.
+	var gasEnd int64
+	var unpaid *gasInst
 outer:
 	for int(vm.ctx.pc) < len(vm.ctx.code) && !vm.abort {
+		vm.ctx.opPC = vm.ctx.pc
+		if vm.ctx.pc >= gasEnd {
+			if unpaid != nil && vm.ctx.pc == unpaid.trapAt {
+				vm.outOfGasAt(unpaid)
+			}
+			gasEnd, unpaid = vm.chargeGasBlock(compiled.gasBlocks, vm.ctx.pc)
+		}
 		op := vm.ctx.code[vm.ctx.pc]
 		vm.ctx.pc++
 		switch op {
 		case ops.Return:
-			gasUsed := new(big.Int).SetUint64(gas.OpsGasTable[op])
-			if !vm.vmContext.gasMetric.SpendGas(gasUsed) {
-				panic("OutOfGas, vm execCode terminated")
-			}
 			break outer
 		case compile.OpJmp:
-			gasUsed := new(big.Int).SetUint64(gas.CompileGasTable[op])
-			if !vm.vmContext.gasMetric.SpendGas(gasUsed) {
-				panic("OutOfGas, vm execCode terminated")
-			}
 			vm.ctx.pc = vm.fetchInt64()
+			if vm.ctx.pc <= vm.ctx.opPC {
+				vm.checkCanceled()
+			}
+			gasEnd = 0
 			continue
 		case compile.OpJmpZ:
-			gasUsed := new(big.Int).SetUint64(gas.CompileGasTable[op])
-			if !vm.vmContext.gasMetric.SpendGas(gasUsed) {
-				panic("OutOfGas, vm execCode terminated")
-			}
 			target := vm.fetchInt64()
 			if vm.popUint32() == 0 {
 				vm.ctx.pc = target
+				gasEnd = 0
 				continue
 			}
 		case compile.OpJmpNz:
-			gasUsed := new(big.Int).SetUint64(gas.CompileGasTable[op])
-			if !vm.vmContext.gasMetric.SpendGas(gasUsed) {
-				panic("OutOfGas, vm execCode terminated")
-			}
 			target := vm.fetchInt64()
-			preserveTop := vm.fetchBool()
+			preserve := vm.fetchInt64()
 			discard := vm.fetchInt64()
 			if vm.popUint32() != 0 {
 				vm.ctx.pc = target
-				var top uint64
-				if preserveTop {
-					top = vm.ctx.stack[len(vm.ctx.stack)-1]
-				}
-				vm.ctx.stack = vm.ctx.stack[:len(vm.ctx.stack)-int(discard)]
-				if preserveTop {
-					vm.pushUint64(top)
+				vm.unwind(int(discard), int(preserve))
+				if target <= vm.ctx.opPC {
+					vm.checkCanceled()
 				}
+				gasEnd = 0
 				continue
 			}
 		case ops.BrTable:
-			gasUsed := new(big.Int).SetUint64(gas.OpsGasTable[op])
-			if !vm.vmContext.gasMetric.SpendGas(gasUsed) {
-				panic("OutOfGas, vm execCode terminated")
-			}
 			index := vm.fetchInt64()
 			label := vm.popInt32()
 			cf, ok := vm.funcs[vm.ctx.curFunc].(compiledFunction)
@@ -480,64 +671,92 @@ outer:
 				break outer
 			}
 			vm.ctx.pc = target.Addr
-			var top uint64
-			if target.PreserveTop {
-				top = vm.ctx.stack[len(vm.ctx.stack)-1]
-			}
-			vm.ctx.stack = vm.ctx.stack[:len(vm.ctx.stack)-int(target.Discard)]
-			if target.PreserveTop {
-				vm.pushUint64(top)
+			vm.unwind(int(target.Discard), int(target.Preserve))
+			if target.Addr <= vm.ctx.opPC {
+				vm.checkCanceled()
 			}
+			gasEnd = 0
 			continue
 		case compile.OpDiscard:
-			gasUsed := new(big.Int).SetUint64(gas.CompileGasTable[op])
-			if !vm.vmContext.gasMetric.SpendGas(gasUsed) {
-				panic("OutOfGas, vm execCode terminated")
-			}
 			place := vm.fetchInt64()
 			vm.ctx.stack = vm.ctx.stack[:len(vm.ctx.stack)-int(place)]
 		case compile.OpDiscardPreserveTop:
-			gasUsed := new(big.Int).SetUint64(gas.CompileGasTable[op])
-			if !vm.vmContext.gasMetric.SpendGas(gasUsed) {
-				panic("OutOfGas, vm execCode terminated")
-			}
-			top := vm.ctx.stack[len(vm.ctx.stack)-1]
 			place := vm.fetchInt64()
-			vm.ctx.stack = vm.ctx.stack[:len(vm.ctx.stack)-int(place)]
-			vm.pushUint64(top)
+			vm.unwind(int(place), 1)
+		case compile.OpDiscardPreserve:
+			preserve := vm.fetchInt64()
+			place := vm.fetchInt64()
+			vm.unwind(int(place), int(preserve))
 
 		case ops.WagonNativeExec:
-			gasUsed := new(big.Int).SetUint64(gas.OpsGasTable[op])
-			if !vm.vmContext.gasMetric.SpendGas(gasUsed) {
-				panic("OutOfGas, vm execCode terminated")
-			}
 			i := vm.fetchUint32()
 			vm.nativeCodeInvocation(i)
 		default:
-			gasUsed := new(big.Int).SetUint64(gas.OpsGasTable[op])
-			if !vm.vmContext.gasMetric.SpendGas(gasUsed) {
-				panic("OutOfGas, vm execCode terminated")
-			}
 			vm.funcTable[op]()
 		}
 	}
 
-	if compiled.returns {
-		return vm.ctx.stack[len(vm.ctx.stack)-1]
+	// The results of an aborted execution are meaningless.
+	if vm.abort {
+		vm.trap(TrapTerminated, ErrTerminated)
 	}
-	return 0
+	return vm.ctx.stack[len(vm.ctx.stack)-compiled.returns:]
 }
 
-// Restart readies the VM for another run.
+// unwind discards discard values from the stack, while preserving the
+// preserve values at its top.
+func (vm *VM) unwind(discard, preserve int) {
+	n := len(vm.ctx.stack)
+	copy(vm.ctx.stack[n-discard:], vm.ctx.stack[n-preserve:])
+	vm.ctx.stack = vm.ctx.stack[:n-discard+preserve]
+}
+
+// Restart readies the VM for another run. Unlike Reset, it only restores
+// the globals, and leaves the linear memory as it is.
 func (vm *VM) Restart() {
 	vm.resetGlobals()
 	vm.ctx.locals = make([]uint64, 0)
 	vm.abort = false
 }
 
+// Reset restores the VM to the state NewVM left it in: the linear memory
+// holds the data segments of the module again, the heap allocator is
+// reinitialized, the globals and the table regain their initial values,
+// and the start function of the module, if any, is run again, without
+// being charged to the gas metric of the VM. The state of the VMContext, such as its JsonObjectCache, is cleared, but its gas
+// metric and publisher are kept: use SetGasMetric to charge the next
+// executions to another metric. The compiled code of the module is kept,
+// which makes resetting a VM much cheaper than creating a new one.
+func (vm *VM) Reset() error {
+	vm.vmContext.reset()
+	vm.abort = false
+	vm.callDepth = 0
+	vm.ctx.stack = vm.ctx.stack[:0]
+	vm.ctx.locals = make([]uint64, 0)
+
+	if vm.module.Memory != nil && len(vm.module.Memory.Entries) != 0 {
+		if err := vm.initMemory(); err != nil {
+			return err
+		}
+	}
+	if err := vm.resetGlobals(); err != nil {
+		return err
+	}
+	if len(vm.module.TableIndexSpace) != 0 {
+		vm.table = append(vm.table[:0], vm.module.TableIndexSpace[0]...)
+	}
+
+	// The start function ran when the VM was created, and running it
+	// again belongs to neither the previous execution nor the next one.
+	metric := vm.vmContext.gasMetric
+	vm.vmContext.SetGasMetric(gas.NewMeter(math.MaxUint64))
+	defer vm.vmContext.SetGasMetric(metric)
+	return vm.runStart()
+}
+
 // Close frees any resources managed by the VM.
 func (vm *VM) Close() error {
-	vm.abort = true // prevents further use.
+	vm.closed = true // prevents further use.
 	if vm.nativeBackend != nil {
 		if err := vm.nativeBackend.Close(); err != nil {
 			return err
@@ -554,11 +773,11 @@ func (vm *VM) Logger() log.Logger {
 	return vm.log
 }
 
-func (vm *VM) SetContrInvoker(contrInvoker ContractInvoker){
+func (vm *VM) SetContrInvoker(contrInvoker ContractInvoker) {
 	vm.contrInvoker = contrInvoker
 }
 
-func (vm *VM) ContrInvoker() ContractInvoker{
+func (vm *VM) ContrInvoker() ContractInvoker {
 	return vm.contrInvoker
 }
 
@@ -578,6 +797,18 @@ func (vm *VM) CallerAddr() string {
 	return vm.callerAddr
 }
 
+// SetCallerAddr sets the address of the caller of the contract, for VMs
+// reused across calls, such as those of a VMPool.
+func (vm *VM) SetCallerAddr(callerAddr string) {
+	vm.callerAddr = callerAddr
+}
+
+// SetGasMetric sets the gas metric the VM charges execution against, for
+// VMs reused across calls, such as those of a VMPool.
+func (vm *VM) SetGasMetric(metric gas.GasMetric) {
+	vm.vmContext.SetGasMetric(metric)
+}
+
 // Process is a proxy passed to host functions in order to access
 // things such as memory and control.
 type Process struct {
@@ -600,7 +831,8 @@ func (proc *Process) ReadString(off int64) (string, error) {
 }
 
 // WriteAt implements the WriterAt interface: it writes the content of p
-// into the VM memory at offset off.
+// into the VM memory at offset off, followed by a NUL byte if there is
+// room for it.
 func (proc *Process) WriteAt(p []byte, off int64) (int, error) {
 	mem := proc.vmContext.runningVM.Memory()
 
@@ -610,7 +842,14 @@ func (proc *Process) WriteAt(p []byte, off int64) (int, error) {
 	} else {
 		length = len(p)
 	}
+	written := length
+	if int(off)+length < len(mem) {
+		written++ // NUL terminator
+	}
 
+	if vm := proc.vmContext.runningVM; vm.journaled || vm.trackDirty {
+		vm.recordWrite(uint64(off), uint64(written))
+	}
 	copy(mem[off:], p[:length])
 
 	var err error
@@ -618,7 +857,9 @@ func (proc *Process) WriteAt(p []byte, off int64) (int, error) {
 		err = io.ErrShortWrite
 	}
 
-	mem[off+int64(length)] = byte(0)
+	if written > length {
+		mem[off+int64(length)] = byte(0)
+	}
 
 	return length, err
 }
@@ -632,11 +873,41 @@ func (proc *Process) VM() *VM {
 	return proc.vmContext.runningVM
 }
 
-// Terminate stops the execution of the current module.
+// Terminate stops the execution of the current module once the host
+// function calling it returns. The execution then fails with a Trap of
+// kind TrapTerminated.
 func (proc *Process) Terminate() {
 	proc.vmContext.runningVM.abort = true
 }
 
-func (proc *Process) VMContext() *VMContext{
+func (proc *Process) VMContext() *VMContext {
 	return proc.vmContext
 }
+
+// GasMetric returns the gas metric the running VM is charged against.
+func (proc *Process) GasMetric() gas.GasMetric {
+	return proc.vmContext.gasMetric
+}
+
+// GasLeft returns the amount of gas the running VM can still spend.
+func (proc *Process) GasLeft() uint64 {
+	return proc.vmContext.gasMetric.GasLeft()
+}
+
+// RefundGas gives back amount gas previously spent by the VM, for example
+// when a host function frees storage.
+func (proc *Process) RefundGas(amount uint64) {
+	proc.vmContext.gasMetric.Refund(amount)
+}
+
+// LimitGas caps the gas available to code run through the VM context,
+// such as a nested ContractInvoker.InvokeInternal call, to limit. Gas
+// spent under the cap is also charged to the current metric. The returned
+// function lifts the cap.
+func (proc *Process) LimitGas(limit uint64) (restore func()) {
+	metric := proc.vmContext.gasMetric
+	proc.vmContext.SetGasMetric(metric.SubMetric(limit))
+	return func() {
+		proc.vmContext.SetGasMetric(metric)
+	}
+}
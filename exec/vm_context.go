@@ -19,14 +19,35 @@ type VMContext struct{
 	gasMetric gas.GasMetric
 	publisher vmevent.Publisher
 	JsonObjectCache []map[string]json.RawMessage
+
+	nested *nestedCall // innermost Process.InvokeInternal call in progress
 }
 
 func NewVMContext() *VMContext {
 	return &VMContext{callVM: make([]*VM, maxVMNest)}
 }
 
+// reset clears what previous executions left in the context: the running
+// and called VMs, and the JsonObjectCache. The gas metric and the
+// publisher are kept.
+func (vmc *VMContext) reset() {
+	vmc.runningVM = nil
+	for i := range vmc.callVM {
+		vmc.callVM[i] = nil
+	}
+	vmc.vmIndex = 0
+	vmc.JsonObjectCache = nil
+	vmc.nested = nil
+}
+
+// SetRunningVM makes vm the running VM. ContractInvokers call it with the
+// VM running a nested call, which, if it is journaled, then runs in a
+// savepoint of its own: see Process.InvokeInternal.
 func (vmc *VMContext) SetRunningVM(vm *VM) {
 	vmc.runningVM = vm
+	if vmc.nested != nil && vm != nil {
+		vmc.nested.enter(vm)
+	}
 }
 
 func (vmc *VMContext) RunningVM() *VM {
@@ -12,6 +12,7 @@ import (
 	"reflect"
 
 	"github.com/Ankr-network/wagon/exec"
+	"github.com/Ankr-network/wagon/exec/gas"
 	"github.com/Ankr-network/wagon/wasm"
 )
 
@@ -82,27 +83,27 @@ func ExampleVM_add() {
 		log.Fatalf("could not read module: %v", err)
 	}
 
-	vm, err := exec.NewVM(m)
+	vm, err := exec.NewVM("contract", "owner", "caller", gas.NewMeter(1<<20), nil, m)
 	if err != nil {
 		log.Fatalf("could not create wagon vm: %v", err)
 	}
 
 	const fct1 = 2 // index of function fct1
-	out, err := vm.ExecCode(fct1)
+	out, err := vm.ExecCode(fct1, "")
 	if err != nil {
 		log.Fatalf("could not execute fct1(): %v", err)
 	}
 	fmt.Printf("fct1() -> %v\n", out)
 
 	const fct2 = 3 // index of function fct2
-	out, err = vm.ExecCode(fct2, 40, 6)
+	out, err = vm.ExecCode(fct2, "", 40, 6)
 	if err != nil {
 		log.Fatalf("could not execute fct2(40, 6): %v", err)
 	}
 	fmt.Printf("fct2() -> %v\n", out)
 
 	const fct3 = 4 // index of function fct3
-	out, err = vm.ExecCode(fct3, 42, 42)
+	out, err = vm.ExecCode(fct3, "", 42, 42)
 	if err != nil {
 		log.Fatalf("could not execute fct3(42, 42): %v", err)
 	}
@@ -11,14 +11,21 @@ import (
 var (
 	smallMemoryVM      = &VM{memory: []byte{1, 2, 3}}
 	emptyMemoryVM      = &VM{memory: []byte{}}
-	smallMemoryProcess = &Process{vm: smallMemoryVM}
-	emptyMemoryProcess = &Process{vm: emptyMemoryVM}
+	smallMemoryProcess = runningProcess(smallMemoryVM)
+	emptyMemoryProcess = runningProcess(emptyMemoryVM)
 	tooBigABuffer      = []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 0}
 )
 
+// runningProcess returns the Process of host functions called by vm.
+func runningProcess(vm *VM) *Process {
+	vm.vmContext = NewVMContext()
+	vm.vmContext.SetRunningVM(vm)
+	return NewProcess(vm)
+}
+
 func TestNormalWrite(t *testing.T) {
 	vm := &VM{memory: make([]byte, 300)}
-	proc := &Process{vm: vm}
+	proc := runningProcess(vm)
 	n, err := proc.WriteAt(tooBigABuffer, 0)
 	if err != nil {
 		t.Fatalf("Found an error when writing: %v", err)
@@ -96,7 +103,7 @@ func TestWriteEmpty(t *testing.T) {
 
 func TestWriteOffset(t *testing.T) {
 	vm := &VM{memory: make([]byte, 300)}
-	proc := &Process{vm: vm}
+	proc := runningProcess(vm)
 
 	n, err := proc.WriteAt(tooBigABuffer, 2)
 	if err != nil {
@@ -40,6 +40,15 @@ func (e UnmatchedOpError) Error() string {
 	return fmt.Sprintf("encountered unmatched %s", n1.Name)
 }
 
+// FloatOpError is the error of functions using a floating-point operator,
+// which the RejectFloats option forbids.
+type FloatOpError byte
+
+func (e FloatOpError) Error() string {
+	n1, _ := ops.New(byte(e))
+	return fmt.Sprintf("floating-point op %s is not allowed", n1.Name)
+}
+
 type InvalidLabelError uint32
 
 func (e InvalidLabelError) Error() string {
@@ -14,8 +14,36 @@ import (
 	ops "github.com/Ankr-network/wagon/wasm/operators"
 )
 
+// VerifyOption describes an additional check made by VerifyModule.
+type VerifyOption func(c *config)
+
+type config struct {
+	rejectFloats bool
+}
+
+// RejectFloats makes VerifyModule reject the functions which use a
+// floating-point operator with a FloatOpError.
+func RejectFloats() VerifyOption {
+	return func(c *config) {
+		c.rejectFloats = true
+	}
+}
+
+// isFloatOp reports whether op takes or returns floating-point values.
+func isFloatOp(op ops.Op) bool {
+	if op.Returns == wasm.ValueTypeF32 || op.Returns == wasm.ValueTypeF64 {
+		return true
+	}
+	for _, arg := range op.Args {
+		if arg == wasm.ValueTypeF32 || arg == wasm.ValueTypeF64 {
+			return true
+		}
+	}
+	return false
+}
+
 // vibhavp: TODO: We do not verify whether blocks don't access for the parent block, do that.
-func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Module) (*mockVM, error) {
+func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Module, c config) (*mockVM, error) {
 	vm := &mockVM{
 		stack:    []operand{},
 		stackTop: 0,
@@ -57,6 +85,9 @@ func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Modu
 		if err != nil {
 			return vm, err
 		}
+		if c.rejectFloats && isFloatOp(opStruct) {
+			return vm, FloatOpError(op)
+		}
 
 		logger.Printf("PC: %d OP: %s polymorphic: %v", vm.pc(), opStruct.Name, vm.isPolymorphic())
 
@@ -68,19 +99,25 @@ func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Modu
 
 		switch op {
 		case ops.If, ops.Block, ops.Loop:
-			sig, err := vm.fetchByte()
-			if err != nil {
+			var blockType wasm.BlockType
+			if err := blockType.UnmarshalWASM(vm.code); err != nil {
+				if _, ok := err.(wasm.InvalidBlockTypeError); ok {
+					return vm, InvalidImmediateError{"block_type", opStruct.Name}
+				}
 				return vm, err
 			}
+			sig, err := module.GetBlockSig(blockType)
+			if err != nil {
+				return vm, InvalidImmediateError{"block_type", opStruct.Name}
+			}
 
-			switch wasm.ValueType(sig) {
-			case wasm.ValueTypeI32, wasm.ValueTypeI64, wasm.ValueTypeF32, wasm.ValueTypeF64, wasm.ValueType(wasm.BlockTypeEmpty):
-				vm.pushBlock(op, wasm.BlockType(sig))
-			default:
-				if !vm.isPolymorphic() {
-					return vm, InvalidImmediateError{"block_type", opStruct.Name}
-				}
+			// The parameters of the block move from the stack of the
+			// parent block to the stack of the new one.
+			if err := vm.popOperands(sig.ParamTypes); err != nil {
+				return vm, err
 			}
+			vm.pushBlock(op, blockType, sig)
+			vm.pushOperands(sig.ParamTypes)
 
 		case ops.Else:
 			block := vm.topBlock()
@@ -88,14 +125,11 @@ func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Modu
 				return vm, UnmatchedOpError(op)
 			}
 
-			if block.blockType != wasm.BlockTypeEmpty {
-				top, under := vm.topOperand()
-				if !vm.isPolymorphic() && (under || top.Type != wasm.ValueType(block.blockType)) {
-					return vm, InvalidTypeError{wasm.ValueType(block.blockType), top.Type}
-				}
-				vm.pushOperand(wasm.ValueType(block.blockType))
+			if err := vm.checkOperands(block.sig.ReturnTypes); !vm.isPolymorphic() && err != nil {
+				return vm, err
 			}
 			vm.stackTop = block.stackTop
+			vm.pushOperands(block.sig.ParamTypes)
 		case ops.End:
 			isPolymorphic := vm.isPolymorphic()
 
@@ -104,17 +138,11 @@ func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Modu
 				return vm, UnmatchedOpError(op)
 			}
 
-			if block.blockType != wasm.BlockTypeEmpty {
-				top, under := vm.topOperand()
-				if !isPolymorphic && (under || top.Type != wasm.ValueType(block.blockType)) {
-					return vm, InvalidTypeError{wasm.ValueType(block.blockType), top.Type}
-				}
-				vm.stackTop = block.stackTop
-				vm.pushOperand(wasm.ValueType(block.blockType))
-				vm.stackTop = block.stackTop + 1 // as we pushed an element
-			} else {
-				vm.stackTop = block.stackTop
+			if err := vm.checkOperands(block.sig.ReturnTypes); !isPolymorphic && err != nil {
+				return vm, err
 			}
+			vm.stackTop = block.stackTop
+			vm.pushOperands(block.sig.ReturnTypes)
 
 		case ops.BrIf, ops.Br:
 			depth, err := vm.fetchVarUint()
@@ -160,15 +188,8 @@ func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Modu
 			vm.setPolymorphic()
 
 		case ops.Return:
-			if len(fn.ReturnTypes) > 1 {
-				panic("not implemented")
-			}
-			if len(fn.ReturnTypes) != 0 {
-				// only single returns supported for now
-				top, under := vm.popOperand()
-				if !vm.isPolymorphic() && (under || top.Type != fn.ReturnTypes[0]) {
-					return vm, InvalidTypeError{fn.ReturnTypes[0], top.Type}
-				}
+			if err := vm.popOperands(fn.ReturnTypes); err != nil {
+				return vm, err
 			}
 			vm.setPolymorphic()
 
@@ -278,9 +299,7 @@ func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Modu
 				}
 			}
 
-			if len(fn.Sig.ReturnTypes) > 0 {
-				vm.pushOperand(fn.Sig.ReturnTypes[0])
-			}
+			vm.pushOperands(fn.Sig.ReturnTypes)
 
 		case ops.CallIndirect:
 			if module.Table == nil || len(module.Table.Entries) == 0 {
@@ -328,9 +347,7 @@ func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Modu
 				}
 			}
 
-			if len(fnExpectSig.ReturnTypes) > 0 {
-				vm.pushOperand(fnExpectSig.ReturnTypes[0])
-			}
+			vm.pushOperands(fnExpectSig.ReturnTypes)
 
 		case ops.Drop:
 			if _, under := vm.popOperand(); !vm.isPolymorphic() && under {
@@ -357,7 +374,7 @@ func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Modu
 
 			// last 2 popped values should be of the same type
 			if operands[0].Type != operands[1].Type {
-				return vm, InvalidTypeError{operands[1].Type, operands[2].Type}
+				return vm, InvalidTypeError{operands[1].Type, operands[0].Type}
 			}
 
 			vm.pushOperand(operands[1].Type)
@@ -368,8 +385,12 @@ func verifyBody(fn *wasm.FunctionSig, body *wasm.FunctionBody, module *wasm.Modu
 }
 
 // VerifyModule verifies the given module according to WebAssembly verification
-// specs.
-func VerifyModule(module *wasm.Module) error {
+// specs, and makes the additional checks described by opts.
+func VerifyModule(module *wasm.Module, opts ...VerifyOption) error {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
 	if module.Function == nil || module.Types == nil || len(module.Types.Entries) == 0 {
 		return nil
 	}
@@ -379,7 +400,7 @@ func VerifyModule(module *wasm.Module) error {
 
 	logger.Printf("There are %d functions", len(module.Function.Types))
 	for i, fn := range module.FunctionIndexSpace {
-		if vm, err := verifyBody(fn.Sig, fn.Body, module); err != nil {
+		if vm, err := verifyBody(fn.Sig, fn.Body, module, c); err != nil {
 			return Error{vm.pc(), i, err}
 		}
 		logger.Printf("No errors in function %d", i)
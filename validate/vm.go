@@ -33,12 +33,13 @@ type mockVM struct {
 // it is used to verify that the block signature set by the operator is the correct
 // one when the block ends
 type block struct {
-	pc          int            // the pc where the control flow operator starting the block is located
-	stackTop    int            // stack top when the block started
-	blockType   wasm.BlockType // block_type signature of the control operator
-	op          byte           // opcode for the operator starting the new block
-	polymorphic bool           // whether the block has a polymorphic stack
-	loop        bool           // whether the block is the body of a loop instruction
+	pc          int               // the pc where the control flow operator starting the block is located
+	stackTop    int               // stack top when the block started, without its parameters
+	blockType   wasm.BlockType    // block_type signature of the control operator
+	sig         *wasm.FunctionSig // types of the parameters and results of the block
+	op          byte              // opcode for the operator starting the new block
+	polymorphic bool              // whether the block has a polymorphic stack
+	loop        bool              // whether the block is the body of a loop instruction
 }
 
 func (vm *mockVM) fetchVarUint() (uint32, error) {
@@ -75,12 +76,13 @@ func (vm *mockVM) fetchUint64() (uint64, error) {
 	return binary.LittleEndian.Uint64(buf[:]), nil
 }
 
-func (vm *mockVM) pushBlock(op byte, blockType wasm.BlockType) {
+func (vm *mockVM) pushBlock(op byte, blockType wasm.BlockType, sig *wasm.FunctionSig) {
 	logger.Printf("Pushing block %v", blockType)
 	vm.blocks = append(vm.blocks, block{
 		pc:          vm.pc(),
 		stackTop:    vm.stackTop,
 		blockType:   blockType,
+		sig:         sig,
 		polymorphic: vm.isPolymorphic(),
 		op:          op,
 		loop:        op == ops.Loop,
@@ -99,35 +101,62 @@ func (vm *mockVM) getBlockFromDepth(depth int) *block {
 // Returns nil if depth is a valid nesting depth value that can be
 // branched to.
 func (vm *mockVM) canBranch(depth int) error {
-	blockType := wasm.BlockTypeEmpty
+	var types []wasm.ValueType
 
 	block := vm.getBlockFromDepth(depth)
-	// jumping to the start of a loop block doesn't push a value
-	// on the stack.
+	// jumping to the start of a loop block takes the parameters
+	// of the loop with it, rather than its results.
 	if block == nil {
 		if depth == len(vm.blocks) {
 			// equivalent to a `return', as the function
 			// body is an "implicit" block
-			if len(vm.curFunc.ReturnTypes) != 0 {
-				blockType = wasm.BlockType(vm.curFunc.ReturnTypes[0])
-			}
+			types = vm.curFunc.ReturnTypes
 		} else {
 			return InvalidLabelError(uint32(depth))
 		}
-	} else if !block.loop {
-		blockType = block.blockType
+	} else if block.loop {
+		types = block.sig.ParamTypes
+	} else {
+		types = block.sig.ReturnTypes
 	}
 
-	if blockType != wasm.BlockTypeEmpty {
-		top, under := vm.topOperand()
-		if under || top.Type != wasm.ValueType(blockType) {
-			return InvalidTypeError{wasm.ValueType(blockType), top.Type}
+	return vm.checkOperands(types)
+}
+
+// checkOperands returns an error if the operands at the top of the stack
+// do not have the given types, the last of which is expected on top.
+func (vm *mockVM) checkOperands(types []wasm.ValueType) error {
+	for i, t := range types {
+		var got wasm.ValueType
+		index := vm.stackTop - len(types) + i
+		if index >= 0 {
+			got = vm.stack[index].Type
+		}
+		if index < 0 || got != t {
+			return InvalidTypeError{t, got}
 		}
 	}
+	return nil
+}
 
+// popOperands pops operands of the given types, the last of which is
+// expected on top of the stack.
+func (vm *mockVM) popOperands(types []wasm.ValueType) error {
+	for i := len(types) - 1; i >= 0; i-- {
+		o, under := vm.popOperand()
+		if !vm.isPolymorphic() && (under || o.Type != types[i]) {
+			return InvalidTypeError{types[i], o.Type}
+		}
+	}
 	return nil
 }
 
+func (vm *mockVM) pushOperands(types []wasm.ValueType) {
+	for _, t := range types {
+		vm.pushOperand(t)
+	}
+}
+
 // returns nil in case of an underflow
 func (vm *mockVM) popBlock() *block {
 	if len(vm.blocks) == 0 {
@@ -210,12 +210,31 @@ func (module *Module) resolveImports(resolve ResolveFunc) error {
 			if int(index) >= len(importedModule.TableIndexSpace) {
 				return InvalidTableIndexError(index)
 			}
+			// An imported table takes the first index of the table index
+			// space, so that it is used in place of a missing table section.
+			if module.Table == nil {
+				module.Table = &SectionTables{}
+			}
+			if len(module.Table.Entries) == 0 {
+				module.Table.Entries = append(module.Table.Entries, importEntry.Type.(TableImport).Type)
+			}
+			if len(module.TableIndexSpace) == 0 {
+				module.TableIndexSpace = make([][]uint32, 1)
+			}
 			module.TableIndexSpace[0] = importedModule.TableIndexSpace[0]
 			module.imports.Tables++
 		case ExternalMemory:
 			if int(index) >= len(importedModule.LinearMemoryIndexSpace) {
 				return InvalidLinearMemoryIndexError(index)
 			}
+			// Likewise for an imported memory, which is otherwise ignored
+			// by modules that do not declare a memory of their own.
+			if module.Memory == nil {
+				module.Memory = &SectionMemories{}
+			}
+			if len(module.Memory.Entries) == 0 {
+				module.Memory.Entries = append(module.Memory.Entries, importEntry.Type.(MemoryImport).Type)
+			}
 			module.LinearMemoryIndexSpace[0] = importedModule.LinearMemoryIndexSpace[0]
 			module.imports.Memories++
 		default:
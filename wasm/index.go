@@ -59,9 +59,12 @@ func (m *Module) populateFunctions() error {
 		}
 	}
 
-	// If available, fill in the name field for the imported functions
+	// If available, fill in the name field for the imported functions,
+	// which otherwise keep the name given by the module exporting them
 	for i := range m.FunctionIndexSpace {
-		m.FunctionIndexSpace[i].Name = names[uint32(i)]
+		if name, ok := names[uint32(i)]; ok {
+			m.FunctionIndexSpace[i].Name = name
+		}
 	}
 
 	// Add the functions from the wasm itself to the function list
@@ -98,6 +101,25 @@ func (m *Module) GetFunction(i int) *Function {
 	return &m.FunctionIndexSpace[i]
 }
 
+// GetBlockSig returns the signature of blocks of type b: the types of the
+// values they take from the stack, and of those they leave on it. It
+// returns an error if b refers to a type that does not exist.
+func (m *Module) GetBlockSig(b BlockType) (*FunctionSig, error) {
+	if index, ok := b.TypeIndex(); ok {
+		if m == nil || m.Types == nil || int(index) >= len(m.Types.Entries) {
+			return nil, InvalidBlockTypeError(index)
+		}
+		return &m.Types.Entries[index], nil
+	}
+	switch b {
+	case BlockTypeEmpty:
+		return &FunctionSig{Form: TypeFunc}, nil
+	case BlockType(ValueTypeI32), BlockType(ValueTypeI64), BlockType(ValueTypeF32), BlockType(ValueTypeF64):
+		return &FunctionSig{Form: TypeFunc, ReturnTypes: []ValueType{ValueType(b)}}, nil
+	}
+	return nil, InvalidBlockTypeError(b)
+}
+
 func (m *Module) populateGlobals() error {
 	if m.Global == nil {
 		return nil
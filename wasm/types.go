@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 
 	"github.com/Ankr-network/wagon/wasm/leb128"
 )
@@ -64,17 +65,81 @@ func (t ValueType) MarshalWASM(w io.Writer) error {
 	return err
 }
 
-// BlockType represents the signature of a structured block
-type BlockType ValueType // varint7
+// BlockType represents the signature of a structured block. It is either
+// BlockTypeEmpty, the ValueType of the single value yielded by the block,
+// or, as per the multi-value proposal, the index of a function type in the
+// type section, as returned by BlockTypeIndex.
+type BlockType uint64 // varint33
 const BlockTypeEmpty BlockType = 0x40
 
+// blockTypeIndexed marks block types referring to the type section.
+const blockTypeIndexed BlockType = 1 << 32
+
+// BlockTypeIndex returns the type of blocks whose signature is the
+// function type at index in the type section.
+func BlockTypeIndex(index uint32) BlockType {
+	return blockTypeIndexed | BlockType(index)
+}
+
+// TypeIndex returns the index of the function type in the type section
+// that b refers to, and whether it refers to one.
+func (b BlockType) TypeIndex() (uint32, bool) {
+	if b&blockTypeIndexed == 0 {
+		return 0, false
+	}
+	return uint32(b), true
+}
+
 func (b BlockType) String() string {
 	if b == BlockTypeEmpty {
 		return "<empty block>"
 	}
+	if index, ok := b.TypeIndex(); ok {
+		return fmt.Sprintf("<type %d>", index)
+	}
 	return ValueType(b).String()
 }
 
+// InvalidBlockTypeError is returned when a block type is neither empty, a
+// value type, nor a valid index to the type section.
+type InvalidBlockTypeError int64
+
+func (e InvalidBlockTypeError) Error() string {
+	return fmt.Sprintf("wasm: invalid block type %d", int64(e))
+}
+
+func (b *BlockType) UnmarshalWASM(r io.Reader) error {
+	v, err := leb128.ReadVarint64(r)
+	if err != nil {
+		return err
+	}
+	if v >= 0 {
+		if v > math.MaxUint32 {
+			return InvalidBlockTypeError(v)
+		}
+		*b = BlockTypeIndex(uint32(v))
+		return nil
+	}
+	// Empty and value types are encoded as negative single byte values.
+	if v < -0x40 {
+		return InvalidBlockTypeError(v)
+	}
+	switch t := BlockType(v & 0x7f); t {
+	case BlockTypeEmpty, BlockType(ValueTypeI32), BlockType(ValueTypeI64), BlockType(ValueTypeF32), BlockType(ValueTypeF64):
+		*b = t
+		return nil
+	}
+	return InvalidBlockTypeError(v)
+}
+
+func (b BlockType) MarshalWASM(w io.Writer) error {
+	if index, ok := b.TypeIndex(); ok {
+		_, err := leb128.WriteVarint64(w, int64(index))
+		return err
+	}
+	return writeByte(w, byte(b))
+}
+
 // ElemType describes the type of a table's elements
 type ElemType uint8 // varint7
 // ElemTypeAnyFunc descibres an any_func value
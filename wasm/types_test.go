@@ -0,0 +1,52 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wasm_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Ankr-network/wagon/wasm"
+)
+
+func TestBlockType(t *testing.T) {
+	for _, tc := range []struct {
+		b   wasm.BlockType
+		raw []byte
+	}{
+		{wasm.BlockTypeEmpty, []byte{0x40}},
+		{wasm.BlockType(wasm.ValueTypeI32), []byte{0x7f}},
+		{wasm.BlockType(wasm.ValueTypeF64), []byte{0x7c}},
+		{wasm.BlockTypeIndex(0), []byte{0x00}},
+		{wasm.BlockTypeIndex(64), []byte{0xc0, 0x00}},
+		{wasm.BlockTypeIndex(300), []byte{0xac, 0x02}},
+	} {
+		buf := new(bytes.Buffer)
+		if err := tc.b.MarshalWASM(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), tc.raw) {
+			t.Errorf("%v encoded as %x, want %x", tc.b, buf.Bytes(), tc.raw)
+		}
+		var b wasm.BlockType
+		if err := b.UnmarshalWASM(bytes.NewReader(tc.raw)); err != nil {
+			t.Fatalf("decoding %x: %v", tc.raw, err)
+		}
+		if b != tc.b {
+			t.Errorf("%x decoded as %v, want %v", tc.raw, b, tc.b)
+		}
+	}
+
+	var b wasm.BlockType
+	if err := b.UnmarshalWASM(bytes.NewReader([]byte{0x7b})); err != wasm.InvalidBlockTypeError(-5) {
+		t.Errorf("decoding 7b: error = %v", err)
+	}
+	if index, ok := wasm.BlockTypeIndex(3).TypeIndex(); !ok || index != 3 {
+		t.Errorf("TypeIndex() = %d, %v, want 3, true", index, ok)
+	}
+	if _, ok := wasm.BlockTypeEmpty.TypeIndex(); ok {
+		t.Errorf("BlockTypeEmpty has a type index")
+	}
+}